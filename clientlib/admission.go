@@ -0,0 +1,104 @@
+package shadowsocks2
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// admission 限制本地TCP连接的并发数. 连接数达到上限时, 驱逐最久没有收发数据的连接,
+// 或者设置了 wait 时排队等待空位, 超时拒绝
+type admission struct {
+	evicted, rejected uint64 // atomic, first for 64-bit alignment
+	slots             chan struct{}
+	wait              time.Duration
+
+	mu    sync.Mutex
+	conns map[*connLastSeen]struct{} // 占有空位且可被驱逐的连接
+}
+
+func newAdmission(max int, wait time.Duration) *admission {
+	return &admission{
+		slots: make(chan struct{}, max),
+		wait:  wait,
+		conns: make(map[*connLastSeen]struct{}),
+	}
+}
+
+// admit 为c取得一个空位, 失败时关闭c并返回nil. 成功后须调用 release
+func (a *admission) admit(ctx context.Context, c net.Conn) *connLastSeen {
+	lc := &connLastSeen{Conn: c, lastSeen: time.Now().UnixNano()}
+	select {
+	case a.slots <- struct{}{}:
+	default:
+		if !a.acquire(ctx) {
+			atomic.AddUint64(&a.rejected, 1)
+			c.Close()
+			return nil
+		}
+	}
+	a.mu.Lock()
+	a.conns[lc] = struct{}{}
+	a.mu.Unlock()
+	return lc
+}
+
+// acquire 在没有空位时排队, 或者驱逐一个连接并接过它的空位
+func (a *admission) acquire(ctx context.Context) bool {
+	if a.wait > 0 {
+		t := time.NewTimer(a.wait)
+		defer t.Stop()
+		select {
+		case a.slots <- struct{}{}:
+			return true
+		case <-t.C:
+		case <-ctx.Done():
+		}
+		return false
+	}
+	for {
+		if victim := a.evict(); victim != nil {
+			atomic.AddUint64(&a.evicted, 1)
+			victim.Close()
+			return true
+		}
+		// 占有空位的连接都还没有登记, 稍后再试
+		select {
+		case a.slots <- struct{}{}:
+			return true
+		case <-time.After(evictRetry):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// evictRetry 为没有可驱逐的连接时重试的间隔
+const evictRetry = 10 * time.Millisecond
+
+// evict 取出最久没有活动的连接, 没有时返回nil
+func (a *admission) evict() *connLastSeen {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var victim *connLastSeen
+	for c := range a.conns {
+		if victim == nil || c.idleSince() < victim.idleSince() {
+			victim = c
+		}
+	}
+	delete(a.conns, victim)
+	return victim
+}
+
+// release 释放c的空位, 被驱逐的连接的空位已交给驱逐它的连接
+func (a *admission) release(c *connLastSeen) {
+	a.mu.Lock()
+	_, held := a.conns[c]
+	delete(a.conns, c)
+	a.mu.Unlock()
+	if held {
+		<-a.slots
+	}
+}
@@ -0,0 +1,147 @@
+package shadowsocks2
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testConn returns the local end of a connection and a channel closed once
+// the local end is closed.
+func testConn() (net.Conn, <-chan struct{}) {
+	c, peer := net.Pipe()
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, peer)
+		peer.Close()
+		close(closed)
+	}()
+	return c, closed
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestAdmissionEvictsLeastRecentlyActive(t *testing.T) {
+	a := newAdmission(3, 0)
+	var conns []*connLastSeen
+	var closed []<-chan struct{}
+	for i := 0; i < 3; i++ {
+		c, ch := testConn()
+		lc := a.admit(context.Background(), c)
+		if lc == nil {
+			t.Fatalf("connection %d rejected below the limit", i)
+		}
+		conns, closed = append(conns, lc), append(closed, ch)
+	}
+	now := time.Now()
+	atomic.StoreInt64(&conns[0].lastSeen, now.Add(-time.Second).UnixNano())
+	atomic.StoreInt64(&conns[1].lastSeen, now.Add(-3*time.Second).UnixNano())
+	atomic.StoreInt64(&conns[2].lastSeen, now.Add(-2*time.Second).UnixNano())
+	conns[1].Write([]byte("x")) // activity makes it the most recent
+
+	c, _ := testConn()
+	lc := a.admit(context.Background(), c)
+	if lc == nil {
+		t.Fatal("connection over the limit rejected, want the least recently active evicted")
+	}
+	if !isClosed(closed[2]) {
+		t.Error("the least recently active connection was not closed")
+	}
+	if n := atomic.LoadUint64(&a.evicted); n != 1 {
+		t.Errorf("evicted = %d, want 1", n)
+	}
+	if n := atomic.LoadUint64(&a.rejected); n != 0 {
+		t.Errorf("rejected = %d, want 0", n)
+	}
+
+	// The slot of the evicted connection went to lc.
+	a.release(conns[2])
+	if n := len(a.slots); n != 3 {
+		t.Errorf("%d slots taken after the evicted connection ended, want 3", n)
+	}
+	a.release(lc)
+	if n := len(a.slots); n != 2 {
+		t.Errorf("%d slots taken after a connection ended, want 2", n)
+	}
+}
+
+func TestAdmissionEvictRetries(t *testing.T) {
+	a := newAdmission(1, 0)
+	a.slots <- struct{}{} // held by a connection not registered yet
+	admitted := make(chan *connLastSeen)
+	go func() {
+		c, _ := testConn()
+		admitted <- a.admit(context.Background(), c)
+	}()
+	time.Sleep(3 * evictRetry)
+	c, closed := testConn()
+	lc := &connLastSeen{Conn: c}
+	a.mu.Lock()
+	a.conns[lc] = struct{}{}
+	a.mu.Unlock()
+
+	select {
+	case got := <-admitted:
+		if got == nil {
+			t.Fatal("connection rejected")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("admit still waiting once a connection can be evicted")
+	}
+	if !isClosed(closed) {
+		t.Error("the registered connection was not evicted")
+	}
+}
+
+func TestAdmissionWait(t *testing.T) {
+	const wait = 50 * time.Millisecond
+	a := newAdmission(1, wait)
+	c, _ := testConn()
+	first := a.admit(context.Background(), c)
+
+	c, closed := testConn()
+	start := time.Now()
+	if a.admit(context.Background(), c) != nil {
+		t.Fatal("connection admitted over the limit")
+	}
+	if d := time.Since(start); d < wait {
+		t.Errorf("rejected after %v, want %v", d, wait)
+	}
+	if !isClosed(closed) {
+		t.Error("the rejected connection was not closed")
+	}
+	if n := atomic.LoadUint64(&a.rejected); n != 1 {
+		t.Errorf("rejected = %d, want 1", n)
+	}
+	if n := atomic.LoadUint64(&a.evicted); n != 0 {
+		t.Errorf("evicted = %d, want 0", n)
+	}
+
+	// A connection ending in time makes room for one waiting.
+	time.AfterFunc(wait/5, func() { a.release(first) })
+	c, _ = testConn()
+	if a.admit(context.Background(), c) == nil {
+		t.Error("waiting connection rejected though a slot was released")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c, _ = testConn()
+	if a.admit(ctx, c) != nil {
+		t.Error("connection admitted once the client stopped")
+	}
+	if n := atomic.LoadUint64(&a.rejected); n != 2 {
+		t.Errorf("rejected = %d, want 2", n)
+	}
+}
@@ -8,18 +8,22 @@ import (
 	"runtime"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/shadowsocks/go-shadowsocks2/freconn"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
 type Client struct {
+	lastConnID       int64 // atomic, first for 64-bit alignment
 	TCPSocksListener net.Listener
 	UDPSocksPC       net.PacketConn
 	MaxConnCount     int
+	ConnWait         time.Duration // wait for a free slot instead of evicting if > 0
 	udpTimeout       time.Duration
 	udpBufSize       int
-	connCount        int
+	admission        *admission
 	udpServerAddr    net.Addr
 	connResetRLock   sync.RWMutex
 	connecter        Connecter
@@ -27,11 +31,18 @@ type Client struct {
 	pcResetRLock     sync.RWMutex
 	pcConnect        PcConnecter
 	upgradePc        shadowUpgradePacketConn
-	mutex            sync.Mutex
-	ConnMap          sync.Map
 	ctx              context.Context
 	cancel           context.CancelFunc
 	outboundID       int
+	socksAuth        socks.Auth
+	udpClients       *socks.UDPClients
+	socksReply       bool // reply once the server reached the target
+	socksUDP         bool // answer UDP ASSOCIATE, for a client relaying UDP
+	log              logFunc
+	events           *eventSink
+	sessions         sync.Map // id -> *session
+	transport        string   // of TCP connections to the server, for sessions
+	pcTransport      string   // of UDP sessions
 }
 
 func NewClient(maxConnCount, UDPBufSize int, UDPTimeout time.Duration) *Client {
@@ -46,6 +57,20 @@ func NewClient(maxConnCount, UDPBufSize int, UDPTimeout time.Duration) *Client {
 	return c
 }
 
+func (c *Client) logf(f string, v ...interface{}) { c.log.printf(f, v...) }
+
+// SetSocksAuth requires SOCKS clients to authenticate with username and
+// password, and drops UDP packets of clients without an authenticated UDP
+// ASSOCIATE connection. An empty username disables authentication.
+func (c *Client) SetSocksAuth(username, password string) {
+	if username == "" {
+		c.socksAuth, c.udpClients = nil, nil
+		return
+	}
+	c.socksAuth = socks.UserPassAuth(username, password)
+	c.udpClients = socks.NewUDPClients()
+}
+
 type Connecter interface {
 	Connect() (net.Conn, error)
 	ServerHost() string
@@ -54,82 +79,45 @@ type Connecter interface {
 type shadowUpgradeConn func(net.Conn) net.Conn
 type shadowUpgradePacketConn func(net.PacketConn) net.PacketConn
 
-// Create a SOCKS server listening on addr and proxy to server.
+// Create a SOCKS and HTTP proxy server listening on addr and proxy to server.
 func (c *Client) StartsocksConnLocal(addr string, connecter Connecter, shadow shadowUpgradeConn) error {
-	logf("SOCKS proxy %s <-> %s", addr, connecter.ServerHost())
+	c.logf("SOCKS proxy %s <-> %s", addr, connecter.ServerHost())
 	var err error
 	c.TCPSocksListener, err = net.Listen("tcp", addr)
 	if err != nil {
-		logf("failed to listen on %s: %v", addr, err)
+		c.logf("failed to listen on %s: %v", addr, err)
 		return err
 	}
 	c.connecter = connecter
 	c.upgradeConn = shadow
+	if c.MaxConnCount > 0 {
+		c.admission = newAdmission(c.MaxConnCount, c.ConnWait)
+	}
 	go func() {
-		connCh := make(chan net.Conn)
-		defer close(connCh)
-		if c.MaxConnCount > 0 {
-			for i := 0; i < c.MaxConnCount; i++ {
-				go func() {
-					for conn := range connCh {
-						lAddr := conn.RemoteAddr().String()
-						c.ConnMap.Store(lAddr, conn)
-						c.connCount++
-						// logf("Conn count++: %d", c.connCount)
-						c.handleConn(conn)
-						c.connCount--
-						// logf("Conn count--: %d", c.connCount)
-						c.ConnMap.Delete(lAddr)
-					}
-				}()
-			}
-		}
 		for {
 			lc, err := c.TCPSocksListener.Accept()
 			if err != nil {
-				logf("failed to accept: %s", err)
+				c.logf("failed to accept: %s", err)
 				if c.ctx.Err() != nil {
 					return
 				}
+				if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+					c.events.emit(&Event{Type: EventFatal, Message: err.Error()})
+					return
+				}
 				continue
 			}
 			lc.(*net.TCPConn).SetKeepAlive(true)
-			if c.MaxConnCount == 0 {
+			if c.admission == nil {
 				go c.handleConn(lc)
-			} else {
-				if c.connCount >= c.MaxConnCount {
-					go func() {
-						c.mutex.Lock()
-						defer c.mutex.Unlock()
-						var lastSeen *connLastSeen
-						var key interface{}
-						c.ConnMap.Range(func(k, v interface{}) bool {
-							conn := v.(*connLastSeen)
-							if lastSeen == nil {
-								lastSeen = conn
-								key = k
-								return true
-							}
-							if conn.lastSeen.Before(lastSeen.lastSeen) {
-								lastSeen = conn
-								key = k
-							}
-							return true
-						})
-						if lastSeen != nil {
-							lastSeen.Close()
-							lastSeen.SetDeadline(time.Now())
-							c.ConnMap.Delete(key)
-						}
-					}()
-				}
-				lastSeenConn := &connLastSeen{
-					Conn:     lc,
-					lastSeen: time.Now(),
-				}
-				connCh <- lastSeenConn
-
+				continue
 			}
+			go func() {
+				if lc := c.admission.admit(c.ctx, lc); lc != nil {
+					c.handleConn(lc)
+					c.admission.release(lc)
+				}
+			}()
 		}
 	}()
 
@@ -147,58 +135,116 @@ func (c *Client) handleConn(lc net.Conn) {
 	if c.connecter == nil || c.upgradeConn == nil {
 		return
 	}
-	tgt, err := socks.Handshake(lc)
+	r, err := socks.ReadRequest(lc, c.socksAuth, c.socksUDP)
+	if err == nil && !c.socksReply {
+		if r.Cmd != socks.CmdConnect {
+			r.Reply(socks.ErrCommandNotSupported, nil)
+			err = socks.ErrCommandNotSupported
+		} else {
+			err = r.Reply(nil, nil)
+		}
+	}
 	if err != nil {
 		// UDP: keep the connection until disconnect then free the UDP socket
+		if err == socks.InfoUDPAssociate && c.udpClients != nil {
+			c.udpClients.Hold(lc)
+			c.logf("UDP Associate End.")
+			return
+		}
 		if err == socks.InfoUDPAssociate {
-			buf := []byte{}
+			buf := make([]byte, 1)
 			// block here
 			for {
 				_, err := lc.Read(buf)
 				if err, ok := err.(net.Error); ok && err.Timeout() {
 					continue
 				}
-				logf("UDP Associate End.")
+				c.logf("UDP Associate End.")
 				return
 			}
 		}
-		logf("failed to get target address: %v", err)
+		c.logf("failed to get target address: %v", err)
 		return
 	}
+	id := atomic.AddInt64(&c.lastConnID, 1)
+	c.events.emit(&Event{Type: EventConnOpen, ID: id, Target: r.Addr.String()})
+	var rx, tx int64
+	defer func() {
+		e := &Event{Type: EventConnClose, ID: id, Target: r.Addr.String(), Rx: rx, Tx: tx}
+		if err != nil {
+			e.Message = err.Error()
+		}
+		c.events.emit(e)
+	}()
+	s := newSession(id, "tcp", c.transport, lc.RemoteAddr())
+	s.setTarget(r.Addr)
+	c.track(s, lc)
+	defer c.untrack(s)
+	lc = &sessionConn{Conn: lc, s: s}
+
 	c.connResetRLock.RLock()
 	rc, err := c.connecter.Connect()
 	if err != nil {
-		logf("Connect to %s failed: %s", c.connecter.ServerHost(), err)
+		c.logf("Connect to %s failed: %s", c.connecter.ServerHost(), err)
+		c.events.emit(&Event{Type: EventServerError, Server: c.connecter.ServerHost(), Message: err.Error()})
 		c.connResetRLock.RUnlock()
+		if c.socksReply {
+			r.Reply(err, nil)
+		}
 		return
 	}
 	defer rc.Close()
+	if fc, ok := rc.(*freconn.Conn); ok && fc.Stat != nil {
+		s.setStat(fc.Stat)
+	}
 
 	remoteConn := c.upgradeConn(rc)
-	if client.outboundID != 0 {
+	if c.outboundID != 0 {
 		transipInfoBytes := make([]byte, 4)
-		binary.BigEndian.PutUint16(transipInfoBytes[:2], uint16(client.outboundID))
+		binary.BigEndian.PutUint16(transipInfoBytes[:2], uint16(c.outboundID))
 		if _, err = remoteConn.Write(transipInfoBytes); err != nil {
-			logf("failed to send transip Info: %v", err)
+			c.logf("failed to send transip Info: %v", err)
 			c.connResetRLock.RUnlock()
 			return
 		}
 	}
-	if _, err = remoteConn.Write(tgt); err != nil {
-		logf("failed to send target address: %v", err)
+	tgt := append([]byte{}, r.Addr...)
+	replies := 0
+	if c.socksReply {
+		tgt[0] |= socks.FlagReply
+		replies = 1
+		if r.Cmd == socks.CmdBind {
+			tgt[0] |= socks.FlagBind
+			replies = 2
+		}
+	}
+	if _, err = remoteConn.Write(append(tgt, r.Payload...)); err != nil {
+		c.logf("failed to send target address: %v", err)
 		c.connResetRLock.RUnlock()
+		if c.socksReply {
+			r.Reply(err, nil)
+		}
 		return
 	}
-
-	logf("proxy %s <-> %s <-> %s", lc.RemoteAddr(), c.connecter.ServerHost(), tgt)
 	c.connResetRLock.RUnlock()
+	for i := 0; i < replies; i++ {
+		var bnd socks.Addr
+		bnd, err = socks.ReadReply(remoteConn)
+		r.Reply(err, bnd)
+		if err != nil {
+			c.logf("failed to reach %s: %v", r.Addr, err)
+			return
+		}
+	}
+
+	c.logf("proxy %s <-> %s <-> %s", lc.RemoteAddr(), c.connecter.ServerHost(), r.Addr)
 
-	_, _, err = relay(remoteConn, lc)
+	tx, rx, err = relay(remoteConn, lc)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		err = nil // ignore i/o timeout
+	}
 	if err != nil {
-		if err, ok := err.(net.Error); ok && err.Timeout() {
-			return // ignore i/o timeout
-		}
-		logf("relay error: %v", err)
+		c.logf("relay error: %v", err)
 	}
 }
 
@@ -211,7 +257,7 @@ func (c *Client) udpSocksLocal(laddr string, server net.Addr, connecter PcConnec
 	var err error
 	c.UDPSocksPC, err = net.ListenPacket("udp", laddr)
 	if err != nil {
-		logf("UDP local listen error: %v", err)
+		c.logf("UDP local listen error: %v", err)
 		return err
 	}
 	c.pcConnect = connecter
@@ -220,41 +266,72 @@ func (c *Client) udpSocksLocal(laddr string, server net.Addr, connecter PcConnec
 	go func() {
 		defer c.UDPSocksPC.Close()
 
-		nm := newNATmap(config.UDPTimeout)
+		nm := newNATmap(c.udpTimeout)
+		nm.log = c.log
+		frags := socks.NewUDPReassembler()
 		buf := make([]byte, udpBufSize)
 
 		for {
 			select {
 			case <-c.ctx.Done():
-				logf("exit udp\n")
+				c.logf("exit udp\n")
 				return
 			default:
 				// 原数据从不发送接收到报文的前三个字节,但是transip要在数据前加上4个字节,所以跳过一个字节开始接收
 				n, raddr, err := c.UDPSocksPC.ReadFrom(buf[1:])
 				if err != nil {
-					logf("UDP local read error: %v", err)
+					c.logf("UDP local read error: %v", err)
+					if ne, ok := err.(net.Error); c.ctx.Err() == nil && (!ok || !ne.Temporary()) {
+						c.events.emit(&Event{Type: EventFatal, Message: err.Error()})
+						return
+					}
 					continue
 				}
+				if c.udpClients != nil && !c.udpClients.Allowed(raddr) {
+					c.logf("UDP socks packet from %s without UDP ASSOCIATE, dropped", raddr)
+					continue
+				}
+				pkt, err := frags.Add(raddr, buf[1:n+1])
+				if err != nil {
+					c.logf("UDP socks packet from %s dropped: %v", raddr, err)
+					continue
+				}
+				if pkt == nil {
+					continue // more fragments to come
+				}
+				c.pcResetRLock.RLock()
 				pc := nm.Get(raddr.String())
 				if pc == nil {
-					c.pcResetRLock.RLock()
 					pc, err = c.pcConnect.DialPacketConn(&net.UDPAddr{})
 					if err != nil {
-						logf("UDP local listen error: %v", err)
+						c.logf("UDP local listen error: %v", err)
+						c.events.emit(&Event{Type: EventServerError, Server: c.udpServerAddr.String(), Message: err.Error()})
 						c.pcResetRLock.RUnlock()
 						continue
 					}
-					logf("UDP socks tunnel %s <-> %s <-> %s", laddr, c.udpServerAddr, socks.Addr(buf[4:]))
-					pc = c.upgradePc(pc)
+					c.logf("UDP socks tunnel %s <-> %s <-> %s", laddr, c.udpServerAddr, socks.SplitAddr(pkt))
+					s := newSession(atomic.AddInt64(&c.lastConnID, 1), "udp", c.pcTransport, raddr)
+					spc := &sessionPacketConn{PacketConn: c.upgradePc(pc), s: s, c: c}
+					c.track(s, spc)
+					pc = spc
 					nm.Add(raddr, c.UDPSocksPC, pc, socksClient)
 				}
+				if spc, ok := pc.(*sessionPacketConn); ok {
+					tgt := socks.SplitAddr(pkt)
+					spc.s.setTarget(tgt)
+					spc.s.add(&spc.s.tx, len(pkt)-len(tgt))
+				}
 				transipInfoBytes := make([]byte, 4)
-				binary.BigEndian.PutUint16(transipInfoBytes[:2], uint16(client.outboundID))
-				copy(buf, transipInfoBytes)
-				_, err = pc.WriteTo(buf[:n+1], c.udpServerAddr)
+				binary.BigEndian.PutUint16(transipInfoBytes[:2], uint16(c.outboundID))
+				out := buf[:n+1]
+				if buf[3] != 0 { // FRAG set: pkt was reassembled out of buf
+					out = append(make([]byte, len(transipInfoBytes), len(transipInfoBytes)+len(pkt)), pkt...)
+				}
+				copy(out, transipInfoBytes)
+				_, err = pc.WriteTo(out, c.udpServerAddr)
 				c.pcResetRLock.RUnlock()
 				if err != nil {
-					logf("UDP local write error: %v", err)
+					c.logf("UDP local write error: %v", err)
 					continue
 				}
 			}
@@ -264,19 +341,19 @@ func (c *Client) udpSocksLocal(laddr string, server net.Addr, connecter PcConnec
 }
 
 func (c *Client) Stop() error {
-	logf("stopping tcp ss")
+	c.logf("stopping tcp ss")
 	c.cancel()
 	if c.TCPSocksListener != nil {
 		err := c.TCPSocksListener.Close()
 		if err != nil {
-			logf("close tcp listener failed: %s", err)
+			c.logf("close tcp listener failed: %s", err)
 			return err
 		}
 	}
 	if c.UDPSocksPC != nil {
 		err := c.UDPSocksPC.Close()
 		if err != nil {
-			logf("stop ss err: %s", err)
+			c.logf("stop ss err: %s", err)
 			return errors.New("stop ss err: " + err.Error())
 		}
 	}
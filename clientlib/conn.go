@@ -3,6 +3,7 @@ package shadowsocks2
 import (
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,23 +34,26 @@ func relay(left, right net.Conn) (int64, int64, error) {
 	return n, rs.N, err
 }
 
+// connLastSeen records when data was last read or written.
 type connLastSeen struct {
+	lastSeen int64 // atomic UnixNano, first for 64-bit alignment
 	net.Conn
-	lastSeen time.Time
 }
 
+func (c *connLastSeen) idleSince() int64 { return atomic.LoadInt64(&c.lastSeen) }
+
 func (c *connLastSeen) Read(b []byte) (n int, err error) {
 	n, err = c.Conn.Read(b)
-	if err != nil {
-		c.lastSeen = time.Now()
+	if n > 0 {
+		atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
 	}
 	return
 }
 
 func (c *connLastSeen) Write(p []byte) (n int, err error) {
 	n, err = c.Conn.Write(p)
-	if err != nil {
-		c.lastSeen = time.Now()
+	if n > 0 {
+		atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
 	}
 	return
 }
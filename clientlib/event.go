@@ -0,0 +1,112 @@
+package shadowsocks2
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// 事件类型
+const (
+	EventStarted     = 1 // 代理已启动: Addr 本地地址, Server 服务器
+	EventStopped     = 2 // 代理已停止
+	EventServerError = 3 // 连接服务器失败: Server, Message 错误
+	EventMpxPool     = 4 // mpx连接池变化: Count 当前连接数, Total 目标连接数
+	EventConnOpen    = 5 // 本地TCP连接开始: ID, Target
+	EventConnClose   = 6 // 本地TCP连接结束: ID, Target, Rx, Tx, Message 错误(可能为空)
+	EventFatal       = 7 // 致命错误, 代理无法继续工作: Message
+)
+
+// eventQueueLen 为待投递事件的上限, 宿主处理不过来时丢弃新的事件
+const eventQueueLen = 1024
+
+// Event 是Proxy产生的事件, 只有与 Type 相关的字段有值
+type Event struct {
+	Type    int
+	ID      int64 // 连接ID
+	Addr    string
+	Server  string
+	Target  string
+	Rx      int64 // 从目标收到的字节数
+	Tx      int64 // 发往目标的字节数
+	Count   int
+	Total   int
+	Message string
+}
+
+// EventHandler 由宿主实现, 在单独的goroutine中按顺序收到事件
+type EventHandler interface {
+	OnEvent(e *Event)
+}
+
+// eventQueue 异步投递事件, 不会阻塞转发. nil 表示没有宿主接收事件
+type eventQueue struct {
+	drops  *uint64 // 原子操作, 由Proxy持有, 更换宿主后继续累计
+	ch     chan *Event
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newEventQueue(h EventHandler, drops *uint64) *eventQueue {
+	q := &eventQueue{drops: drops, ch: make(chan *Event, eventQueueLen)}
+	go func() {
+		for e := range q.ch {
+			h.OnEvent(e)
+		}
+	}()
+	return q
+}
+
+func (q *eventQueue) emit(e *Event) {
+	if q == nil {
+		return
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		atomic.AddUint64(q.drops, 1)
+		return
+	}
+	select {
+	case q.ch <- e:
+	default:
+		atomic.AddUint64(q.drops, 1)
+	}
+}
+
+// close 停止接收事件, 已排队的事件仍会投递给宿主, 之后的事件计为丢弃
+func (q *eventQueue) close() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+}
+
+// eventSink 持有Proxy当前的事件队列, 已启动的客户端通过它发送事件,
+// 因此更换宿主后的事件投递给新的宿主. nil 表示没有宿主接收事件
+type eventSink struct {
+	mu sync.RWMutex
+	q  *eventQueue
+}
+
+func (s *eventSink) emit(e *Event) {
+	if s == nil {
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.q.emit(e)
+}
+
+// set 换上队列q, 关闭原来的队列
+func (s *eventSink) set(q *eventQueue) {
+	s.mu.Lock()
+	old := s.q
+	s.q = q
+	s.mu.Unlock()
+	old.close()
+}
@@ -0,0 +1,69 @@
+package shadowsocks2
+
+import (
+	"testing"
+	"time"
+)
+
+// blockingHandler records events once unblocked.
+type blockingHandler struct {
+	unblock chan struct{}
+	events  chan *Event
+}
+
+func (h *blockingHandler) OnEvent(e *Event) {
+	<-h.unblock
+	h.events <- e
+}
+
+func TestSetEventHandlerDrains(t *testing.T) {
+	p := NewProxy()
+	old := &blockingHandler{unblock: make(chan struct{}), events: make(chan *Event, eventQueueLen+1)}
+	p.SetEventHandler(old)
+	q := p.events
+	q.emit(&Event{Type: EventConnOpen, ID: 0})
+	time.Sleep(10 * time.Millisecond) // let the handler take it and block
+	for i := 1; i <= eventQueueLen; i++ {
+		q.emit(&Event{Type: EventConnOpen, ID: int64(i)})
+	}
+	q.emit(&Event{Type: EventConnOpen, ID: -1})
+	if n := p.DroppedEvents(); n != 1 {
+		t.Errorf("DroppedEvents() = %d with a full queue, want 1", n)
+	}
+
+	next := &blockingHandler{unblock: make(chan struct{}), events: make(chan *Event, 1)}
+	close(next.unblock)
+	p.SetEventHandler(next)
+	q.emit(&Event{Type: EventConnClose}) // from a proxy started before
+	select {
+	case e := <-next.events:
+		if e.Type != EventConnClose {
+			t.Errorf("the new handler got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the new handler did not get the event of a proxy started before")
+	}
+	if n := p.DroppedEvents(); n != 1 {
+		t.Errorf("DroppedEvents() = %d after the handler changed, want 1", n)
+	}
+
+	close(old.unblock)
+	for i := 0; i < eventQueueLen+1; i++ {
+		select {
+		case e := <-old.events:
+			if e.ID != int64(i) {
+				t.Fatalf("event %d has ID %d", i, e.ID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the previous handler got %d events, want %d", i, eventQueueLen+1)
+		}
+	}
+	select {
+	case e := <-old.events:
+		t.Errorf("the previous handler got %+v emitted after the handler changed", e)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if n := p.DroppedEvents(); n != 1 {
+		t.Errorf("DroppedEvents() = %d once drained, want 1", n)
+	}
+}
@@ -1,21 +1,15 @@
 package shadowsocks2
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
 	"net"
-	"net/url"
-	"os"
-	"strings"
+	"strconv"
 	"time"
 
-	"github.com/fregie/mpx"
 	"github.com/shadowsocks/go-shadowsocks2/freconn"
-	"github.com/shadowsocks/go-shadowsocks2/websocket"
-
-	"github.com/shadowsocks/go-shadowsocks2/core"
-	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/shadowsocks/go-shadowsocks2/ssurl"
 )
 
 type ssConfig struct {
@@ -23,399 +17,163 @@ type ssConfig struct {
 	UDPTimeout   time.Duration
 	UDPBufSize   int
 	WSTimeout    time.Duration
+	WSTLS        *tls.Config
 	MaxConnCount int
+	ConnWait     time.Duration
+	SocksUser    string
+	SocksPass    string
+	SocksReply   bool
 }
 
-var config = ssConfig{
-	Verbose:    true,
-	UDPTimeout: 10 * time.Second,
-	UDPBufSize: 64 * 1024,
-	WSTimeout:  10 * time.Second,
-}
+// globalStat 统计所有Proxy的流量, 每个Proxy的统计是它的子统计
+var globalStat = freconn.NewStat()
 
-var (
-	logWriter    = os.Stdout
-	logger       = log.New(logWriter, "[shadowsocks]", log.LstdFlags)
-	stat         = freconn.NewStat()
-	client       *Client
-	localIP      string
-	tcpConnecter = &TCPConnecter{}
-)
+// defaultProxy 是包级函数操作的实例
+var defaultProxy = NewProxy()
 
 var ERR_MPXFirstConnectionFail = errors.New("Connect Failed")
 
 func logf(f string, v ...interface{}) {
-	if config.Verbose {
-		logger.Printf(f, v...)
-	}
+	defaultProxy.logf(f, v...)
 }
 
-// SetlogOut 设置websocket timeout，单位 ms, 默认 10s
-func SetWSTimeout(timeout int) {
-	if timeout > 0 {
-		config.WSTimeout = time.Duration(timeout) * time.Millisecond
-	}
+// SetGlobalRateLimit 限制所有Proxy合计的下行和上行带宽(bit/s), 参数同 Proxy.SetRateLimit
+func SetGlobalRateLimit(download, upload, burst int64) {
+	globalLimit.down.SetRate(download, burst)
+	globalLimit.up.SetRate(upload, burst)
 }
 
-// SetlogOut 设定日志输出到哪个文件
-func SetlogOut(path string) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	logWriter = f
-	logger.SetOutput(logWriter)
-	return nil
+// SetRateLimit 限制默认实例的带宽, 参数同 Proxy.SetRateLimit
+func SetRateLimit(download, upload, burst int64) { defaultProxy.SetRateLimit(download, upload, burst) }
+
+// SetConnRateLimit 限制默认实例每个TCP连接的带宽, 参数同 Proxy.SetRateLimit
+func SetConnRateLimit(download, upload, burst int64) {
+	defaultProxy.SetConnRateLimit(download, upload, burst)
+}
+
+// SetWSTimeout 设置websocket timeout，单位 ms, 默认 10s
+func SetWSTimeout(timeout int) { defaultProxy.SetWSTimeout(timeout) }
+
+// SetWSTLS 设置websocket是否使用TLS (wss://), 参数见 Proxy.SetWSTLS
+func SetWSTLS(enable bool, serverName, rootCAs, pinnedSHA256 string, insecure bool) error {
+	return defaultProxy.SetWSTLS(enable, serverName, rootCAs, pinnedSHA256, insecure)
 }
 
+// SetlogOut 设定日志输出到哪个文件
+func SetlogOut(path string) error { return defaultProxy.SetLogOut(path) }
+
 // FinishLog 停止记录日志，关闭对应文件
-func FinishLog() error {
-	if logWriter != nil {
-		return logWriter.Close()
-	}
-	return errors.New("log writter is nil")
+func FinishLog() error { return defaultProxy.FinishLog() }
+
+// SetSocksAuth 设置本地SOCKS5代理的用户名和密码 (RFC 1929), 用户名为空时不需要认证
+// 在启动之前调用
+func SetSocksAuth(username, password string) error {
+	return defaultProxy.SetSocksAuth(username, password)
 }
 
+// SetSocksReply 设置是否在服务器连上目标之后才回复SOCKS客户端, 并支持BIND命令
+// 服务器需为本程序, 在启动之前调用
+func SetSocksReply(enable bool) { defaultProxy.SetSocksReply(enable) }
+
+// SetEventHandler 设置接收事件的宿主, 为nil时不再发送事件, 可在运行中调用
+func SetEventHandler(h EventHandler) { defaultProxy.SetEventHandler(h) }
+
+// DroppedEvents 返回因宿主处理过慢而丢弃的事件数
+func DroppedEvents() int64 { return defaultProxy.DroppedEvents() }
+
+// Sessions 返回活动的TCP连接和UDP会话
+func Sessions() *SessionList { return defaultProxy.Sessions() }
+
+// CloseSession 关闭ID为id的TCP连接或UDP会话, 不存在时返回false
+func CloseSession(id int64) bool { return defaultProxy.CloseSession(id) }
+
 // SetMaxConnCount 设置最大并发连接数
-func SetMaxConnCount(maxConnCount int) {
-	if maxConnCount < 0 {
-		maxConnCount = 0
-	}
-	config.MaxConnCount = maxConnCount
-}
+func SetMaxConnCount(maxConnCount int) { defaultProxy.SetMaxConnCount(maxConnCount) }
 
-func SetLocalIP(ip string) error {
-	TCPAddr, err := net.ResolveTCPAddr("tcp4", ip+":0")
-	if err != nil {
-		logf("local addr failed: %s", err)
-		return err
-	}
-	tcpConnecter.localTCPAddr = TCPAddr
-	localIP = ip
-	return nil
-}
+// SetConnWait 设置连接数达到上限时新连接排队等待的时间, 单位 ms, 0 为驱逐最久未活动的连接
+func SetConnWait(timeout int) { defaultProxy.SetConnWait(timeout) }
+
+// EvictedConns 返回因连接数达到上限而被驱逐的连接数
+func EvictedConns() int64 { return defaultProxy.EvictedConns() }
+
+// RejectedConns 返回排队超时而被拒绝的连接数
+func RejectedConns() int64 { return defaultProxy.RejectedConns() }
+
+func SetLocalIP(ip string) error { return defaultProxy.SetLocalIP(ip) }
 
 func StartUDPTunnel(server string, serverPort int, method string, password string, tunnel string) error {
-	config.Verbose = true
-	var key []byte
-	addr := fmt.Sprintf("%s:%d", server, serverPort)
-	cipher := method
-	ciph, err := core.PickCipher(cipher, key, password)
-	if err != nil {
-		log.Print(err)
-		return err
-	}
-	socks.UDPEnabled = true
-	p := strings.Split(tunnel, "=")
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		log.Print(err)
-		return err
-	}
-	udpLocal(p[0], udpAddr, p[1], &UDPConnecter{}, ciph.PacketConn)
-	return nil
+	return defaultProxy.StartUDPTunnel(server, serverPort, method, password, tunnel)
 }
 
 func StartUDPWSTunnel(server string, serverPort int, method, URL, username string, password string, tunnel string) error {
-	config.Verbose = true
-	addr := fmt.Sprintf("%s:%d", server, serverPort)
-	connecter := &WSConnecter{
-		ServerAddr: addr,
-		URL:        URL,
-		Username:   username,
-		Stat:       stat,
-	}
-	var key []byte
-	ciph, err := core.PickCipher(method, key, password)
-	if err != nil {
-		log.Print(err)
-		return err
-	}
-	socks.UDPEnabled = true
-	p := strings.Split(tunnel, "=")
-	wsAddr := websocket.WSAddr{
-		URL: url.URL{Scheme: "ws", Host: connecter.ServerAddr, Path: connecter.URL},
-	}
-	udpLocal(p[0], &wsAddr, p[1], connecter, ciph.PacketConn)
-	return nil
+	return defaultProxy.StartUDPWSTunnel(server, serverPort, method, URL, username, password, tunnel)
 }
 
 func StartTCPtunnel(server string, serverPort int, method string, password string, tunnel string) error {
-	config.Verbose = true
-	var key []byte
-	addr := fmt.Sprintf("%s:%d", server, serverPort)
-	cipher := method
-	ciph, err := core.PickCipher(cipher, key, password)
-	if err != nil {
-		log.Print(err)
-		return err
-	}
-	p := strings.Split(tunnel, "=")
-	tcpTun(p[0], addr, p[1], ciph.StreamConn)
-	return nil
+	return defaultProxy.StartTCPTunnel(server, serverPort, method, password, tunnel)
 }
 
 // StartTCPUDP 启动SS(TCP和UDP)
 func StartTCPUDP(server string, serverPort int, method string, password string, localPort int, verbose bool, outboundID int) error {
-	config.Verbose = verbose
-	var key []byte
-	if server == "" || password == "" {
-		return errors.New("server, password can not be empty")
-	}
-	if serverPort <= 0 || serverPort > 65535 {
-		return errors.New("server port must be between 0 and 65535")
-	}
-	if localPort <= 0 || localPort > 65535 {
-		return errors.New("local port must be between 0 and 65535")
-	}
+	return defaultProxy.StartTCPUDP(server, serverPort, method, password, localPort, verbose, outboundID)
+}
 
-	var err error
-	addr := fmt.Sprintf("%s:%d", server, serverPort)
-	cipher := method
+// StartTCPUDPURL 以ss:// URL (SIP002或旧式base64格式) 启动SS(TCP和UDP)
+func StartTCPUDPURL(ssURL string, localPort int, verbose bool, outboundID int) error {
+	return defaultProxy.StartTCPUDPURL(ssURL, localPort, verbose, outboundID)
+}
 
-	ciph, err := core.PickCipher(cipher, key, password)
-	if err != nil {
-		log.Print(err)
-		return err
+// ServerURL 返回可分享的SIP002格式ss:// URL
+func ServerURL(server string, serverPort int, method, password, tag string) string {
+	u := &ssurl.URL{
+		Cipher:   method,
+		Password: password,
+		Host:     net.JoinHostPort(server, strconv.Itoa(serverPort)),
+		Tag:      tag,
 	}
+	return u.String()
+}
 
-	socks.UDPEnabled = true
-	localAddr := fmt.Sprintf("%s:%d", "0.0.0.0", localPort)
-	client = NewClient(config.MaxConnCount, config.UDPBufSize, config.UDPTimeout)
-	client.outboundID = outboundID
-	tcpConnecter.ServerAddr = addr
-	stat.Reset()
-	tcpConnecter.Stat = stat
-
-	logf("Start shadowsocks on TCP, server: %s", tcpConnecter.ServerAddr)
-	err = client.StartsocksConnLocal(localAddr, tcpConnecter, ciph.StreamConn)
-	if err != nil {
-		return err
-	}
-	logf("Start shadowsocks on UDP, server: %s", tcpConnecter.ServerAddr)
-	upgradePC := func(pc net.PacketConn) net.PacketConn {
-		spc := ciph.PacketConn(pc)
-		newPC := freconn.UpgradePacketConn(spc)
-		newPC.EnableStat(stat)
-		return newPC
+func parseURL(s string) (server string, serverPort int, u *ssurl.URL, err error) {
+	if u, err = ssurl.Parse(s); err != nil {
+		return
 	}
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return err
+	if u.Plugin != "" {
+		err = fmt.Errorf("plugin %s: plugins are not supported", u.Plugin)
+		return
 	}
-	err = client.udpSocksLocal(localAddr, udpAddr, &UDPConnecter{}, upgradePC)
+	server, port, err := net.SplitHostPort(u.Host)
 	if err != nil {
-		return err
+		return
 	}
-	return nil
+	serverPort, err = strconv.Atoi(port)
+	return
 }
 
 func ResetTCPUDP(server string, serverPort int, method string, password string, localPort int, verbose bool) error {
-	config.Verbose = verbose
-	var key []byte
-	if client == nil {
-		return errors.New("client is nil")
-	}
-	if server == "" || password == "" {
-		return errors.New("server, password can not be empty")
-	}
-	if serverPort <= 0 || serverPort > 65535 {
-		return errors.New("server port must be between 0 and 65535")
-	}
-	if localPort <= 0 || localPort > 65535 {
-		return errors.New("local port must be between 0 and 65535")
-	}
-
-	var err error
-	addr := fmt.Sprintf("%s:%d", server, serverPort)
-	cipher := method
-
-	ciph, err := core.PickCipher(cipher, key, password)
-	if err != nil {
-		log.Print(err)
-		return err
-	}
-	socks.UDPEnabled = true
-	tcpConnecter.ServerAddr = addr
-	stat.Reset()
-	tcpConnecter.Stat = stat
-	upgradePC := func(pc net.PacketConn) net.PacketConn {
-		spc := ciph.PacketConn(pc)
-		newPC := freconn.UpgradePacketConn(spc)
-		newPC.EnableStat(stat)
-		return newPC
-	}
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return err
-	}
-	client.Reset(tcpConnecter, ciph.StreamConn, udpAddr, &UDPConnecter{}, upgradePC)
-	return nil
+	return defaultProxy.Reset(server, serverPort, method, password, localPort, verbose)
 }
 
 // StopTCPUDP 停止SS
-func StopTCPUDP() (err error) {
-	stat.Reset()
-	if client != nil {
-		logf("Stop shadowsocks on TCP")
-		err = client.Stop()
-	}
-	return
-}
+func StopTCPUDP() error { return defaultProxy.Stop() }
 
 // StartWebsocket 启动SSW
 func StartWebsocket(server, URL, username string, serverPort int, method string, password string, localPort int, verbose bool) error {
-	config.Verbose = verbose
-	var key []byte
-	if server == "" || URL == "" || username == "" || password == "" {
-		return errors.New("server, URL, username, password can not be empty")
-	}
-	if serverPort <= 0 || serverPort > 65535 {
-		return errors.New("server port must be between 0 and 65535")
-	}
-	if localPort <= 0 || localPort > 65535 {
-		return errors.New("local port must be between 0 and 65535")
-	}
-
-	addr := fmt.Sprintf("%s:%d", server, serverPort)
-	cipher := method
-	var err error
-	ciph, err := core.PickCipher(cipher, key, password)
-	if err != nil {
-		log.Print(err)
-		return err
-	}
-	socks.UDPEnabled = true
-	localAddr := fmt.Sprintf("%s:%d", "0.0.0.0", localPort)
-	client = NewClient(config.MaxConnCount, config.UDPBufSize, config.UDPTimeout)
-	stat.Reset()
-	connecter := &WSConnecter{
-		ServerAddr: addr,
-		URL:        URL,
-		Username:   username,
-		Stat:       stat,
-	}
-	connecter.SetTimeout(config.WSTimeout)
-	logf("Start shadowsocks on websocket, server: %s", connecter.ServerAddr)
-	err = client.StartsocksConnLocal(localAddr, connecter, ciph.StreamConn)
-	if err != nil {
-		return err
-	}
-	upgradePC := func(pc net.PacketConn) net.PacketConn {
-		spc := ciph.PacketConn(pc)
-		newPC := freconn.UpgradePacketConn(spc)
-		newPC.EnableStat(stat)
-		return newPC
-	}
-	wsAddr := websocket.WSAddr{
-		URL: url.URL{Scheme: "ws", Host: connecter.ServerAddr, Path: connecter.URL},
-	}
-	err = client.udpSocksLocal(localAddr, &wsAddr, connecter, upgradePC)
-	if err != nil {
-		return err
-	}
-	return nil
+	return defaultProxy.StartWebsocket(server, URL, username, serverPort, method, password, localPort, verbose)
 }
 
 // StopWebsocket 停止SSW
-func StopWebsocket() error {
-	stat.Reset()
-	var err error
-	if client != nil {
-		logf("Stop shadowsocks on websocket")
-		err = client.Stop()
-		if err != nil {
-			logf("Stop shadowsocks on websocket connction failed:%s", err)
-		}
-	}
-	return err
-}
-
-var mc *mpxConnecter
-
-func StartWebsocketMpx(server, URL, username string, serverPort int, method string, password string, localPort int, connCount int, verbose bool) (err error) {
-	config.Verbose = verbose
-	if !verbose {
-		mpx.Verbose(false)
-	}
-	if server == "" || URL == "" || username == "" || password == "" {
-		return errors.New("server, URL, username, password can not be empty")
-	}
-	if serverPort <= 0 || serverPort > 65535 {
-		return errors.New("server port must be between 0 and 65535")
-	}
-	if localPort <= 0 || localPort > 65535 {
-		return errors.New("local port must be between 0 and 65535")
-	}
+func StopWebsocket() error { return defaultProxy.Stop() }
 
-	if connCount <= 0 {
-		connCount = 2
-	}
-	var key []byte
-	addr := fmt.Sprintf("%s:%d", server, serverPort)
-	cipher := method
-	ciph, err := core.PickCipher(cipher, key, password)
-	if err != nil {
-		logf(err.Error())
-		return
-	}
-	socks.UDPEnabled = true
-	localAddr := fmt.Sprintf("%s:%d", "0.0.0.0", localPort)
-	client = NewClient(config.MaxConnCount, config.UDPBufSize, config.UDPTimeout)
-	stat.Reset()
-	connecter := &WSConnecter{
-		ServerAddr: addr,
-		URL:        URL,
-		Username:   username,
-		Stat:       stat,
-	}
-	connecter.SetTimeout(config.WSTimeout)
-	mc, err = NewMpxConnecter(connecter, connCount)
-	if err != nil {
-		logf("Mpx first connect failed: %s", err)
-		err = ERR_MPXFirstConnectionFail
-		// mc.Close()
-		// return err
-	}
-	logf("Start shadowsocks on websocket mpx, server: %s", connecter.ServerAddr)
-	err = client.StartsocksConnLocal(localAddr, mc, ciph.StreamConn)
-	if err != nil {
-		return
-	}
-	upgradePC := func(pc net.PacketConn) net.PacketConn {
-		spc := ciph.PacketConn(pc)
-		newPC := freconn.UpgradePacketConn(spc)
-		newPC.EnableStat(stat)
-		return newPC
-	}
-	wsAddr := websocket.WSAddr{
-		URL: url.URL{Scheme: "ws", Host: connecter.ServerAddr, Path: connecter.URL},
-	}
-	err = client.udpSocksLocal(localAddr, &wsAddr, connecter, upgradePC)
-	if err != nil {
-		return
-	}
-	return
+func StartWebsocketMpx(server, URL, username string, serverPort int, method string, password string, localPort int, connCount int, verbose bool) error {
+	return defaultProxy.StartWebsocketMpx(server, URL, username, serverPort, method, password, localPort, connCount, verbose)
 }
 
-func StopWebsocketMpx() error {
-	stat.Reset()
-	if client != nil {
-		logf("Stop shadowsocks on websocket mpx")
-		client.Stop()
-	}
-	if mc != nil {
-		mc.Close()
-	}
-
-	return errors.New("SS client is nil")
-}
+func StopWebsocketMpx() error { return defaultProxy.Stop() }
 
 // StatReset 重置（清零）统计数据
 // 一般情况不需要手动重置，在启动和停止的时候会自动清零
-func StatReset() {
-	stat.Reset()
-}
+func StatReset() { defaultProxy.StatReset() }
 
 // BandwidthInfo 表示一组带宽数据
 type BandwidthInfo struct {
@@ -436,36 +194,46 @@ func (b *BandwidthInfo) GetTx() int64 { return b.TX }
 // GetTimestamp 获取上次计算带宽的时间戳
 func (b *BandwidthInfo) GetTimestamp() int64 { return b.Timestamp }
 
-// Bandwidth1 返回最近1s的带宽(bit/s)
-func Bandwidth1() *BandwidthInfo {
-	if stat == nil {
-		return &BandwidthInfo{}
+// BandwidthList 是一组带宽数据, 按时间排序
+type BandwidthList struct {
+	l []*BandwidthInfo
+}
+
+func newBandwidthList(stat *freconn.Stat) *BandwidthList {
+	h := stat.History()
+	l := &BandwidthList{l: make([]*BandwidthInfo, len(h))}
+	for i, s := range h {
+		l.l[i] = &BandwidthInfo{RX: int64(s.Rx), TX: int64(s.Tx), Timestamp: s.Time.Unix()}
 	}
-	r, t, time := stat.Bandwidth1()
-	return &BandwidthInfo{RX: int64(r), TX: int64(t), Timestamp: time.Unix()}
+	return l
 }
 
+// Len 返回数据个数
+func (l *BandwidthList) Len() int { return len(l.l) }
+
+// Get 返回第i个数据
+func (l *BandwidthList) Get(i int) *BandwidthInfo { return l.l[i] }
+
+// Bandwidth1 返回最近1s的带宽(bit/s)
+func Bandwidth1() *BandwidthInfo { return defaultProxy.Bandwidth1() }
+
 // Bandwidth10 返回最近10s的带宽(bit/s)
-func Bandwidth10() *BandwidthInfo {
-	if stat == nil {
-		return &BandwidthInfo{}
-	}
-	r, t, time := stat.Bandwidth10()
+func Bandwidth10() *BandwidthInfo { return defaultProxy.Bandwidth10() }
+
+// BandwidthHistory 返回最近10分钟每秒的带宽(bit/s)
+func BandwidthHistory() *BandwidthList { return defaultProxy.BandwidthHistory() }
+
+// GlobalBandwidth1 返回所有Proxy最近1s的带宽(bit/s)
+func GlobalBandwidth1() *BandwidthInfo {
+	r, t, time := globalStat.Bandwidth1()
 	return &BandwidthInfo{RX: int64(r), TX: int64(t), Timestamp: time.Unix()}
 }
 
+// GlobalBandwidthHistory 返回所有Proxy最近10分钟每秒的带宽(bit/s)
+func GlobalBandwidthHistory() *BandwidthList { return newBandwidthList(globalStat) }
+
 // GetRx 返回已经接收的流量总数(bit)
-func GetRx() int64 {
-	if stat == nil {
-		return 0
-	}
-	return int64(stat.Rx)
-}
+func GetRx() int64 { return defaultProxy.GetRx() }
 
 // GetTx 返回已经发出的流量总数(bit)
-func GetTx() int64 {
-	if stat == nil {
-		return 0
-	}
-	return int64(stat.Tx)
-}
+func GetTx() int64 { return defaultProxy.GetTx() }
@@ -2,6 +2,8 @@ package shadowsocks2
 
 import (
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/fregie/mpx"
 )
@@ -27,3 +29,38 @@ func (m *mpxConnecter) ServerHost() string {
 	}
 	return m.Addr().String()
 }
+
+// poolDialer 为mpx连接池建立连接, 并报告连接池中的连接数
+type poolDialer struct {
+	mpx.Dialer
+	count  int32
+	total  int
+	server string
+	events *eventSink
+}
+
+func (d *poolDialer) Dial() (net.Conn, error) {
+	c, err := d.Dialer.Dial()
+	if err != nil {
+		d.events.emit(&Event{Type: EventServerError, Server: d.server, Message: err.Error()})
+		return nil, err
+	}
+	d.changed(1)
+	return &poolConn{Conn: c, d: d}, nil
+}
+
+func (d *poolDialer) changed(delta int32) {
+	n := atomic.AddInt32(&d.count, delta)
+	d.events.emit(&Event{Type: EventMpxPool, Server: d.server, Count: int(n), Total: d.total})
+}
+
+type poolConn struct {
+	net.Conn
+	d    *poolDialer
+	once sync.Once
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(func() { c.d.changed(-1) })
+	return c.Conn.Close()
+}
@@ -21,31 +21,32 @@ const (
 const udpBufSize = 64 * 1024
 
 // Listen on laddr for UDP packets, encrypt and send to server to reach target.
-func udpLocal(laddr string, server net.Addr, target string, connecter PcConnecter, shadow func(net.PacketConn) net.PacketConn) {
+func (p *Proxy) udpLocal(laddr string, server net.Addr, target string, connecter PcConnecter, shadow func(net.PacketConn) net.PacketConn) {
 	var err error
 	tgt := socks.ParseAddr(target)
 	if tgt == nil {
 		err = fmt.Errorf("invalid target address: %q", target)
-		logf("UDP target address error: %v", err)
+		p.logf("UDP target address error: %v", err)
 		return
 	}
 
 	c, err := net.ListenPacket("udp", laddr)
 	if err != nil {
-		logf("UDP local listen error: %v", err)
+		p.logf("UDP local listen error: %v", err)
 		return
 	}
 	defer c.Close()
 
 	nm := newNATmap(10 * time.Second)
+	nm.log = p.logf
 	buf := make([]byte, udpBufSize)
 	copy(buf, tgt)
 
-	logf("UDP tunnel %s <-> %s <-> %s", laddr, server, target)
+	p.logf("UDP tunnel %s <-> %s <-> %s", laddr, server, target)
 	for {
 		n, raddr, err := c.ReadFrom(buf[len(tgt):])
 		if err != nil {
-			logf("UDP local read error: %v", err)
+			p.logf("UDP local read error: %v", err)
 			continue
 		}
 
@@ -53,7 +54,7 @@ func udpLocal(laddr string, server net.Addr, target string, connecter PcConnecte
 		if pc == nil {
 			pc, err = connecter.DialPacketConn(&net.UDPAddr{})
 			if err != nil {
-				logf("UDP local listen error: %v", err)
+				p.logf("UDP local listen error: %v", err)
 				continue
 			}
 
@@ -61,10 +62,10 @@ func udpLocal(laddr string, server net.Addr, target string, connecter PcConnecte
 			nm.Add(raddr, c, pc, relayClient)
 		}
 
-		logf("%s <-> %s <-> %s", pc.LocalAddr().String(), server.String(), tgt.String())
+		p.logf("%s <-> %s <-> %s", pc.LocalAddr().String(), server.String(), tgt.String())
 		_, err = pc.WriteTo(buf[:len(tgt)+n], server)
 		if err != nil {
-			logf("UDP local write error: %v", err)
+			p.logf("UDP local write error: %v", err)
 			continue
 		}
 	}
@@ -80,7 +81,7 @@ func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
 	defer c.Close()
 	c = shadow(c)
 
-	nm := newNATmap(config.UDPTimeout)
+	nm := newNATmap(defaultProxy.config.UDPTimeout)
 	buf := make([]byte, udpBufSize)
 
 	logf("listening UDP on %s", addr)
@@ -129,6 +130,7 @@ type natmap struct {
 	sync.RWMutex
 	m       map[string]net.PacketConn
 	timeout time.Duration
+	log     logFunc
 }
 
 func newNATmap(timeout time.Duration) *natmap {
@@ -167,7 +169,7 @@ func (m *natmap) Add(peer net.Addr, dst, src net.PacketConn, role mode) {
 	m.Set(peer.String(), src)
 
 	go func() {
-		timedCopy(dst, peer, src, m.timeout, role)
+		timedCopy(dst, peer, src, m.timeout, role, m.log)
 		if pc := m.Del(peer.String()); pc != nil {
 			pc.Close()
 		}
@@ -175,14 +177,14 @@ func (m *natmap) Add(peer net.Addr, dst, src net.PacketConn, role mode) {
 }
 
 // copy from src to dst at target with read timeout
-func timedCopy(dst net.PacketConn, target net.Addr, src net.PacketConn, timeout time.Duration, role mode) error {
+func timedCopy(dst net.PacketConn, target net.Addr, src net.PacketConn, timeout time.Duration, role mode, log logFunc) error {
 	buf := make([]byte, udpBufSize)
 
 	for {
 		src.SetReadDeadline(time.Now().Add(timeout))
 		n, raddr, err := src.ReadFrom(buf)
 		if err != nil {
-			logf("readfrom err:%s", err)
+			log.printf("readfrom err:%s", err)
 			return err
 		}
 
@@ -194,9 +196,9 @@ func timedCopy(dst net.PacketConn, target net.Addr, src net.PacketConn, timeout
 			_, err = dst.WriteTo(buf[:len(srcAddr)+n], target)
 		case relayClient: // client -> user: strip original packet source
 			srcAddr := socks.SplitAddr(buf[:n])
-			logf("write to %s", target.String())
+			log.printf("write to %s", target.String())
 			_, err = dst.WriteTo(buf[len(srcAddr):n], target)
-		case socksClient: // client -> socks5 program: just set RSV and FRAG = 0
+		case socksClient: // client -> socks5 program: just set RSV and FRAG = 0, replies are never fragmented
 			// srcAddr := socks.ParseAddr(raddr.String())
 			// copy(buf[len(srcAddr):], buf[:n])
 			// copy(buf, srcAddr)
@@ -0,0 +1,574 @@
+package shadowsocks2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fregie/mpx"
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/freconn"
+	"github.com/shadowsocks/go-shadowsocks2/websocket"
+)
+
+// Proxy 是一个本地SOCKS5/HTTP代理实例, 拥有独立的配置、统计、日志和生命周期,
+// 多个实例可以同时运行. 包级函数操作一个默认实例
+type Proxy struct {
+	droppedEvents uint64 // 原子操作, 须64位对齐
+	config        ssConfig
+	stat          *freconn.Stat
+	logWriter     io.WriteCloser
+	logger        *log.Logger
+	client        *Client
+	mc            *mpxConnecter
+	tcpConnecter  *TCPConnecter
+	events        *eventSink
+	limit         *rateLimit
+}
+
+// NewProxy 创建一个使用默认配置的Proxy, 不再使用时调用 Close
+func NewProxy() *Proxy {
+	limit := newRateLimit()
+	return &Proxy{
+		config: ssConfig{
+			Verbose:    true,
+			UDPTimeout: 10 * time.Second,
+			UDPBufSize: 64 * 1024,
+			WSTimeout:  10 * time.Second,
+		},
+		stat:         globalStat.NewChild(),
+		logWriter:    os.Stdout,
+		logger:       log.New(os.Stdout, "[shadowsocks]", log.LstdFlags),
+		tcpConnecter: &TCPConnecter{limit: limit},
+		events:       &eventSink{},
+		limit:        limit,
+	}
+}
+
+func (p *Proxy) logf(f string, v ...interface{}) {
+	if p.config.Verbose {
+		p.logger.Printf(f, v...)
+	}
+}
+
+// logFunc 输出日志, 为nil时输出到默认实例的日志
+type logFunc func(f string, v ...interface{})
+
+func (l logFunc) printf(f string, v ...interface{}) {
+	if l == nil {
+		logf(f, v...)
+		return
+	}
+	l(f, v...)
+}
+
+// SetEventHandler 设置接收事件的宿主, 为nil时不再发送事件
+// 事件异步投递, 宿主处理过慢时新的事件被丢弃. 可在运行中调用:
+// 原来的宿主仍会收到已排队的事件, 此后的事件投递给新的宿主
+func (p *Proxy) SetEventHandler(h EventHandler) {
+	var q *eventQueue
+	if h != nil {
+		q = newEventQueue(h, &p.droppedEvents)
+	}
+	p.events.set(q)
+}
+
+// DroppedEvents 返回因宿主处理过慢而丢弃的事件数
+func (p *Proxy) DroppedEvents() int64 {
+	return int64(atomic.LoadUint64(&p.droppedEvents))
+}
+
+// SetRateLimit 限制此Proxy的下行和上行带宽(bit/s), TCP和UDP共用, 0 为不限制
+// burst 为允许的突发(bit), 0 为一秒的流量. 运行时调整立即生效, 超出的UDP包被丢弃
+func (p *Proxy) SetRateLimit(download, upload, burst int64) {
+	p.limit.down.SetRate(download, burst)
+	p.limit.up.SetRate(upload, burst)
+}
+
+// SetConnRateLimit 限制每个TCP连接的下行和上行带宽(bit/s), 参数同 SetRateLimit
+// 使用mpx时限制的是每个websocket连接
+func (p *Proxy) SetConnRateLimit(download, upload, burst int64) {
+	p.limit.connDown.SetRate(download, burst)
+	p.limit.connUp.SetRate(upload, burst)
+}
+
+// SetWSTimeout 设置websocket timeout，单位 ms, 默认 10s
+func (p *Proxy) SetWSTimeout(timeout int) {
+	if timeout > 0 {
+		p.config.WSTimeout = time.Duration(timeout) * time.Millisecond
+	}
+}
+
+// SetWSTLS 设置websocket是否使用TLS (wss://)
+// serverName 为SNI, 为空时使用服务器地址; rootCAs 为PEM格式的信任根证书, 为空时使用系统证书;
+// pinnedSHA256 为逗号分隔的证书公钥(SubjectPublicKeyInfo) SHA-256 的base64; insecure 跳过证书验证, 仅用于测试
+func (p *Proxy) SetWSTLS(enable bool, serverName, rootCAs, pinnedSHA256 string, insecure bool) error {
+	if !enable {
+		p.config.WSTLS = nil
+		return nil
+	}
+	opts := websocket.TLSOptions{
+		ServerName: serverName,
+		RootCAs:    []byte(rootCAs),
+		Insecure:   insecure,
+	}
+	if pinnedSHA256 != "" {
+		opts.PinnedSHA256 = strings.Split(pinnedSHA256, ",")
+	}
+	cfg, err := opts.ClientConfig()
+	if err != nil {
+		return err
+	}
+	p.config.WSTLS = cfg
+	return nil
+}
+
+// SetLogOut 设定日志输出到哪个文件
+func (p *Proxy) SetLogOut(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	p.logWriter = f
+	p.logger.SetOutput(p.logWriter)
+	return nil
+}
+
+// FinishLog 停止记录日志，关闭对应文件
+func (p *Proxy) FinishLog() error {
+	if p.logWriter != nil {
+		return p.logWriter.Close()
+	}
+	return errors.New("log writter is nil")
+}
+
+// SetSocksAuth 设置本地SOCKS5代理的用户名和密码 (RFC 1929), 用户名为空时不需要认证
+// 在启动之前调用
+func (p *Proxy) SetSocksAuth(username, password string) error {
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("username and password must not exceed 255 bytes")
+	}
+	p.config.SocksUser = username
+	p.config.SocksPass = password
+	return nil
+}
+
+// SetSocksReply 设置是否在服务器连上目标之后才回复SOCKS客户端, 并支持BIND命令
+// 服务器需为本程序, 在启动之前调用
+func (p *Proxy) SetSocksReply(enable bool) {
+	p.config.SocksReply = enable
+}
+
+// SetMaxConnCount 设置最大并发连接数
+func (p *Proxy) SetMaxConnCount(maxConnCount int) {
+	if maxConnCount < 0 {
+		maxConnCount = 0
+	}
+	p.config.MaxConnCount = maxConnCount
+}
+
+// SetConnWait 设置连接数达到上限时新连接排队等待的时间, 单位 ms, 超时的连接被拒绝
+// 0 (默认) 为不排队, 驱逐最久没有收发数据的连接. 在启动之前调用
+func (p *Proxy) SetConnWait(timeout int) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	p.config.ConnWait = time.Duration(timeout) * time.Millisecond
+}
+
+// EvictedConns 返回因连接数达到上限而被驱逐的连接数
+func (p *Proxy) EvictedConns() int64 {
+	if p.client == nil || p.client.admission == nil {
+		return 0
+	}
+	return int64(atomic.LoadUint64(&p.client.admission.evicted))
+}
+
+// RejectedConns 返回排队超时而被拒绝的连接数
+func (p *Proxy) RejectedConns() int64 {
+	if p.client == nil || p.client.admission == nil {
+		return 0
+	}
+	return int64(atomic.LoadUint64(&p.client.admission.rejected))
+}
+
+// SetLocalIP 设置连接服务器(TCP)时使用的本地IP
+func (p *Proxy) SetLocalIP(ip string) error {
+	TCPAddr, err := net.ResolveTCPAddr("tcp4", ip+":0")
+	if err != nil {
+		p.logf("local addr failed: %s", err)
+		return err
+	}
+	p.tcpConnecter.localTCPAddr = TCPAddr
+	return nil
+}
+
+// StartUDPTunnel 启动UDP隧道, tunnel 为 本地地址=目标地址, 阻塞运行
+func (p *Proxy) StartUDPTunnel(server string, serverPort int, method string, password string, tunnel string) error {
+	p.config.Verbose = true
+	var key []byte
+	addr := fmt.Sprintf("%s:%d", server, serverPort)
+	cipher := method
+	ciph, err := core.PickCipher(cipher, key, password)
+	if err != nil {
+		p.logger.Print(err)
+		return err
+	}
+	t := strings.Split(tunnel, "=")
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		p.logger.Print(err)
+		return err
+	}
+	p.udpLocal(t[0], udpAddr, t[1], &UDPConnecter{}, ciph.PacketConn)
+	return nil
+}
+
+// StartUDPWSTunnel 启动基于websocket的UDP隧道, tunnel 为 本地地址=目标地址, 阻塞运行
+func (p *Proxy) StartUDPWSTunnel(server string, serverPort int, method, URL, username string, password string, tunnel string) error {
+	p.config.Verbose = true
+	addr := fmt.Sprintf("%s:%d", server, serverPort)
+	connecter := &WSConnecter{
+		ServerAddr: addr,
+		URL:        URL,
+		Username:   username,
+		Stat:       p.stat,
+		TLSConfig:  p.config.WSTLS,
+		log:        p.logf,
+		limit:      p.limit,
+	}
+	var key []byte
+	ciph, err := core.PickCipher(method, key, password)
+	if err != nil {
+		p.logger.Print(err)
+		return err
+	}
+	t := strings.Split(tunnel, "=")
+	p.udpLocal(t[0], connecter.Addr(), t[1], connecter, ciph.PacketConn)
+	return nil
+}
+
+// StartTCPTunnel 启动TCP隧道, tunnel 为 本地地址=目标地址, 阻塞运行
+func (p *Proxy) StartTCPTunnel(server string, serverPort int, method string, password string, tunnel string) error {
+	p.config.Verbose = true
+	var key []byte
+	addr := fmt.Sprintf("%s:%d", server, serverPort)
+	cipher := method
+	ciph, err := core.PickCipher(cipher, key, password)
+	if err != nil {
+		p.logger.Print(err)
+		return err
+	}
+	t := strings.Split(tunnel, "=")
+	p.tcpTun(t[0], addr, t[1], ciph.StreamConn)
+	return nil
+}
+
+// newClient 按当前配置创建Client
+func (p *Proxy) newClient() *Client {
+	c := NewClient(p.config.MaxConnCount, p.config.UDPBufSize, p.config.UDPTimeout)
+	c.ConnWait = p.config.ConnWait
+	c.log = p.logf
+	c.events = p.events
+	c.SetSocksAuth(p.config.SocksUser, p.config.SocksPass)
+	c.socksReply = p.config.SocksReply
+	c.socksUDP = true // 本地代理同时转发UDP
+	return c
+}
+
+// upgradePC 返回加密并统计UDP流量的函数
+func (p *Proxy) upgradePC(ciph core.Cipher) shadowUpgradePacketConn {
+	return func(pc net.PacketConn) net.PacketConn {
+		spc := ciph.PacketConn(pc)
+		newPC := freconn.UpgradePacketConn(spc)
+		newPC.EnableStat(p.stat)
+		p.limit.packetConn(newPC)
+		return newPC
+	}
+}
+
+// StartTCPUDP 启动SS(TCP和UDP)
+func (p *Proxy) StartTCPUDP(server string, serverPort int, method string, password string, localPort int, verbose bool, outboundID int) error {
+	p.config.Verbose = verbose
+	var key []byte
+	if server == "" || password == "" {
+		return errors.New("server, password can not be empty")
+	}
+	if serverPort <= 0 || serverPort > 65535 {
+		return errors.New("server port must be between 0 and 65535")
+	}
+	if localPort <= 0 || localPort > 65535 {
+		return errors.New("local port must be between 0 and 65535")
+	}
+
+	var err error
+	addr := fmt.Sprintf("%s:%d", server, serverPort)
+	cipher := method
+
+	ciph, err := core.PickCipher(cipher, key, password)
+	if err != nil {
+		p.logger.Print(err)
+		return err
+	}
+
+	localAddr := fmt.Sprintf("%s:%d", "0.0.0.0", localPort)
+	p.client = p.newClient()
+	p.client.outboundID = outboundID
+	p.client.transport, p.client.pcTransport = "tcp", "udp"
+	p.tcpConnecter.ServerAddr = addr
+	p.stat.Reset()
+	p.tcpConnecter.Stat = p.stat
+
+	p.logf("Start shadowsocks on TCP, server: %s", p.tcpConnecter.ServerAddr)
+	err = p.client.StartsocksConnLocal(localAddr, p.tcpConnecter, ciph.StreamConn)
+	if err != nil {
+		return err
+	}
+	p.logf("Start shadowsocks on UDP, server: %s", p.tcpConnecter.ServerAddr)
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	err = p.client.udpSocksLocal(localAddr, udpAddr, &UDPConnecter{}, p.upgradePC(ciph))
+	if err != nil {
+		return err
+	}
+	p.events.emit(&Event{Type: EventStarted, Addr: localAddr, Server: addr})
+	return nil
+}
+
+// StartTCPUDPURL 以ss:// URL (SIP002或旧式base64格式) 启动SS(TCP和UDP)
+func (p *Proxy) StartTCPUDPURL(ssURL string, localPort int, verbose bool, outboundID int) error {
+	server, serverPort, u, err := parseURL(ssURL)
+	if err != nil {
+		return err
+	}
+	return p.StartTCPUDP(server, serverPort, u.Cipher, u.Password, localPort, verbose, outboundID)
+}
+
+// Reset 在不停止本地代理的情况下切换到另一个服务器(TCP和UDP)
+func (p *Proxy) Reset(server string, serverPort int, method string, password string, localPort int, verbose bool) error {
+	p.config.Verbose = verbose
+	var key []byte
+	if p.client == nil {
+		return errors.New("client is nil")
+	}
+	if server == "" || password == "" {
+		return errors.New("server, password can not be empty")
+	}
+	if serverPort <= 0 || serverPort > 65535 {
+		return errors.New("server port must be between 0 and 65535")
+	}
+	if localPort <= 0 || localPort > 65535 {
+		return errors.New("local port must be between 0 and 65535")
+	}
+
+	var err error
+	addr := fmt.Sprintf("%s:%d", server, serverPort)
+	cipher := method
+
+	ciph, err := core.PickCipher(cipher, key, password)
+	if err != nil {
+		p.logger.Print(err)
+		return err
+	}
+	p.tcpConnecter.ServerAddr = addr
+	p.stat.Reset()
+	p.tcpConnecter.Stat = p.stat
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	p.client.Reset(p.tcpConnecter, ciph.StreamConn, udpAddr, &UDPConnecter{}, p.upgradePC(ciph))
+	return nil
+}
+
+// StartWebsocket 启动SSW
+func (p *Proxy) StartWebsocket(server, URL, username string, serverPort int, method string, password string, localPort int, verbose bool) error {
+	p.config.Verbose = verbose
+	var key []byte
+	if server == "" || URL == "" || username == "" || password == "" {
+		return errors.New("server, URL, username, password can not be empty")
+	}
+	if serverPort <= 0 || serverPort > 65535 {
+		return errors.New("server port must be between 0 and 65535")
+	}
+	if localPort <= 0 || localPort > 65535 {
+		return errors.New("local port must be between 0 and 65535")
+	}
+
+	addr := fmt.Sprintf("%s:%d", server, serverPort)
+	cipher := method
+	var err error
+	ciph, err := core.PickCipher(cipher, key, password)
+	if err != nil {
+		p.logger.Print(err)
+		return err
+	}
+	localAddr := fmt.Sprintf("%s:%d", "0.0.0.0", localPort)
+	p.client = p.newClient()
+	p.client.transport, p.client.pcTransport = "ws", "ws"
+	p.stat.Reset()
+	connecter := &WSConnecter{
+		ServerAddr: addr,
+		URL:        URL,
+		Username:   username,
+		Stat:       p.stat,
+		TLSConfig:  p.config.WSTLS,
+		log:        p.logf,
+		limit:      p.limit,
+	}
+	connecter.SetTimeout(p.config.WSTimeout)
+	p.logf("Start shadowsocks on websocket, server: %s", connecter.ServerAddr)
+	err = p.client.StartsocksConnLocal(localAddr, connecter, ciph.StreamConn)
+	if err != nil {
+		return err
+	}
+	err = p.client.udpSocksLocal(localAddr, connecter.Addr(), connecter, p.upgradePC(ciph))
+	if err != nil {
+		return err
+	}
+	p.events.emit(&Event{Type: EventStarted, Addr: localAddr, Server: addr})
+	return nil
+}
+
+// StartWebsocketMpx 启动多路复用的SSW, connCount 为websocket连接数
+func (p *Proxy) StartWebsocketMpx(server, URL, username string, serverPort int, method string, password string, localPort int, connCount int, verbose bool) (err error) {
+	p.config.Verbose = verbose
+	if !verbose {
+		mpx.Verbose(false)
+	}
+	if server == "" || URL == "" || username == "" || password == "" {
+		return errors.New("server, URL, username, password can not be empty")
+	}
+	if serverPort <= 0 || serverPort > 65535 {
+		return errors.New("server port must be between 0 and 65535")
+	}
+	if localPort <= 0 || localPort > 65535 {
+		return errors.New("local port must be between 0 and 65535")
+	}
+
+	if connCount <= 0 {
+		connCount = 2
+	}
+	var key []byte
+	addr := fmt.Sprintf("%s:%d", server, serverPort)
+	cipher := method
+	ciph, err := core.PickCipher(cipher, key, password)
+	if err != nil {
+		p.logf(err.Error())
+		return
+	}
+	localAddr := fmt.Sprintf("%s:%d", "0.0.0.0", localPort)
+	p.client = p.newClient()
+	p.client.transport, p.client.pcTransport = "mpx", "ws"
+	p.stat.Reset()
+	connecter := &WSConnecter{
+		ServerAddr: addr,
+		URL:        URL,
+		Username:   username,
+		Stat:       p.stat,
+		TLSConfig:  p.config.WSTLS,
+		log:        p.logf,
+		limit:      p.limit,
+	}
+	connecter.SetTimeout(p.config.WSTimeout)
+	dialer := &poolDialer{Dialer: connecter, total: connCount, server: addr, events: p.events}
+	p.mc, err = NewMpxConnecter(dialer, connCount)
+	if err != nil {
+		p.logf("Mpx first connect failed: %s", err)
+		err = ERR_MPXFirstConnectionFail
+	}
+	p.logf("Start shadowsocks on websocket mpx, server: %s", connecter.ServerAddr)
+	err = p.client.StartsocksConnLocal(localAddr, p.mc, ciph.StreamConn)
+	if err != nil {
+		return
+	}
+	err = p.client.udpSocksLocal(localAddr, connecter.Addr(), connecter, p.upgradePC(ciph))
+	if err != nil {
+		return
+	}
+	p.events.emit(&Event{Type: EventStarted, Addr: localAddr, Server: addr})
+	return
+}
+
+// Stop 停止SS, 无论以何种方式启动
+func (p *Proxy) Stop() (err error) {
+	p.stat.Reset()
+	if p.client != nil {
+		p.logf("Stop shadowsocks")
+		err = p.client.Stop()
+		if err != nil {
+			p.logf("Stop shadowsocks failed: %s", err)
+		}
+		p.events.emit(&Event{Type: EventStopped})
+	}
+	if p.mc != nil {
+		p.mc.Close()
+		p.mc = nil
+	}
+	return
+}
+
+// Close 停止代理并释放它的统计和事件队列, 之后不能再使用此Proxy
+func (p *Proxy) Close() error {
+	err := p.Stop()
+	p.stat.Close()
+	p.events.set(nil)
+	return err
+}
+
+// Sessions 返回活动的TCP连接和UDP会话
+func (p *Proxy) Sessions() *SessionList {
+	if p.client == nil {
+		return &SessionList{}
+	}
+	return &SessionList{s: p.client.Sessions()}
+}
+
+// CloseSession 关闭ID为id的TCP连接或UDP会话, 不存在时返回false
+func (p *Proxy) CloseSession(id int64) bool {
+	if p.client == nil {
+		return false
+	}
+	return p.client.CloseSession(id)
+}
+
+// StatReset 重置（清零）统计数据
+// 一般情况不需要手动重置，在启动和停止的时候会自动清零
+func (p *Proxy) StatReset() {
+	p.stat.Reset()
+}
+
+// Bandwidth1 返回最近1s的带宽(bit/s)
+func (p *Proxy) Bandwidth1() *BandwidthInfo {
+	r, t, time := p.stat.Bandwidth1()
+	return &BandwidthInfo{RX: int64(r), TX: int64(t), Timestamp: time.Unix()}
+}
+
+// Bandwidth10 返回最近10s的带宽(bit/s)
+func (p *Proxy) Bandwidth10() *BandwidthInfo {
+	r, t, time := p.stat.Bandwidth10()
+	return &BandwidthInfo{RX: int64(r), TX: int64(t), Timestamp: time.Unix()}
+}
+
+// BandwidthHistory 返回最近10分钟每秒的带宽(bit/s), 用于绘制图表
+func (p *Proxy) BandwidthHistory() *BandwidthList {
+	return newBandwidthList(p.stat)
+}
+
+// GetRx 返回已经接收的流量总数(bit)
+func (p *Proxy) GetRx() int64 {
+	return int64(p.stat.Rx())
+}
+
+// GetTx 返回已经发出的流量总数(bit)
+func (p *Proxy) GetTx() int64 {
+	return int64(p.stat.Tx())
+}
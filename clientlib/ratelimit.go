@@ -0,0 +1,41 @@
+package shadowsocks2
+
+import (
+	"github.com/shadowsocks/go-shadowsocks2/freconn"
+)
+
+// rateLimit 限制一个Proxy的带宽(TCP和UDP共用)以及它的每个TCP连接的带宽, 运行时可调整
+type rateLimit struct {
+	down, up         *freconn.Limiter
+	connDown, connUp *freconn.ConnLimiter
+}
+
+func newRateLimit() *rateLimit {
+	return &rateLimit{
+		down:     &freconn.Limiter{},
+		up:       &freconn.Limiter{},
+		connDown: &freconn.ConnLimiter{},
+		connUp:   &freconn.ConnLimiter{},
+	}
+}
+
+// globalLimit 限制所有Proxy的带宽
+var globalLimit = newRateLimit()
+
+// conn 限制到服务器的TCP连接c
+func (r *rateLimit) conn(c *freconn.Conn) {
+	if r == nil {
+		return
+	}
+	c.EnableRatelimit(
+		freconn.Limiters{globalLimit.down, r.down, r.connDown.Limiter()},
+		freconn.Limiters{globalLimit.up, r.up, r.connUp.Limiter()})
+}
+
+// packetConn 限制到服务器的UDP, 超出的包被丢弃
+func (r *rateLimit) packetConn(pc *freconn.PacketConn) {
+	if r == nil {
+		return
+	}
+	pc.EnableRatelimit(freconn.Limiters{globalLimit.down, r.down}, freconn.Limiters{globalLimit.up, r.up})
+}
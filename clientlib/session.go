@@ -0,0 +1,174 @@
+package shadowsocks2
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/freconn"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Session 是一个TCP连接或UDP会话的快照
+type Session struct {
+	ID        int64
+	Network   string // "tcp" 或 "udp"
+	Transport string // 到服务器的传输方式: "tcp", "udp", "ws" 或 "mpx"
+	Source    string // 本地客户端地址
+	Target    string // UDP会话为最近一个包的目标
+	Start     int64  // 开始时间, Unix毫秒
+	LastSeen  int64  // 最后活动时间, Unix毫秒
+	Rx        int64  // 从目标收到的字节数
+	Tx        int64  // 发往目标的字节数
+	RxRate    int64  // 最近1s与服务器之间的下行带宽(bit/s), 仅不经mpx的TCP连接
+	TxRate    int64  // 最近1s与服务器之间的上行带宽(bit/s)
+}
+
+// SessionList 是会话列表, 按ID排序
+type SessionList struct {
+	s []*Session
+}
+
+// Len 返回会话数
+func (l *SessionList) Len() int { return len(l.s) }
+
+// Get 返回第i个会话
+func (l *SessionList) Get(i int) *Session { return l.s[i] }
+
+// session 记录一个活动的连接或UDP会话
+type session struct {
+	rx, tx, lastSeen int64 // atomic, first for 64-bit alignment
+	id               int64
+	network          string
+	transport        string
+	source           string
+	start            time.Time
+	closer           io.Closer
+
+	mu     sync.Mutex
+	target socks.Addr
+	stat   *freconn.Stat // of the connection to the server
+}
+
+func (s *session) setTarget(tgt socks.Addr) {
+	s.mu.Lock()
+	s.target = append(s.target[:0], tgt...)
+	s.mu.Unlock()
+}
+
+func (s *session) setStat(stat *freconn.Stat) {
+	s.mu.Lock()
+	s.stat = stat
+	s.mu.Unlock()
+}
+
+func (s *session) add(n *int64, bytes int) {
+	atomic.AddInt64(n, int64(bytes))
+	atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+}
+
+func (s *session) snapshot() *Session {
+	s.mu.Lock()
+	tgt, stat := s.target.String(), s.stat
+	s.mu.Unlock()
+	var r, t uint64
+	if stat != nil {
+		r, t, _ = stat.Bandwidth1()
+	}
+	return &Session{
+		ID:        s.id,
+		Network:   s.network,
+		Transport: s.transport,
+		Source:    s.source,
+		Target:    tgt,
+		Start:     s.start.UnixNano() / int64(time.Millisecond),
+		LastSeen:  atomic.LoadInt64(&s.lastSeen) / int64(time.Millisecond),
+		Rx:        atomic.LoadInt64(&s.rx),
+		Tx:        atomic.LoadInt64(&s.tx),
+		RxRate:    int64(r),
+		TxRate:    int64(t),
+	}
+}
+
+func newSession(id int64, network, transport string, source net.Addr) *session {
+	now := time.Now()
+	return &session{
+		lastSeen:  now.UnixNano(),
+		id:        id,
+		network:   network,
+		transport: transport,
+		source:    source.String(),
+		start:     now,
+	}
+}
+
+// track 登记会话, 以 closer 关闭
+func (c *Client) track(s *session, closer io.Closer) {
+	s.closer = closer
+	c.sessions.Store(s.id, s)
+}
+
+func (c *Client) untrack(s *session) { c.sessions.Delete(s.id) }
+
+// Sessions 返回活动的TCP连接和UDP会话
+func (c *Client) Sessions() []*Session {
+	var l []*Session
+	c.sessions.Range(func(_, v interface{}) bool {
+		l = append(l, v.(*session).snapshot())
+		return true
+	})
+	sort.Slice(l, func(i, j int) bool { return l[i].ID < l[j].ID })
+	return l
+}
+
+// CloseSession 关闭ID为id的会话, 不存在时返回false
+func (c *Client) CloseSession(id int64) bool {
+	v, ok := c.sessions.Load(id)
+	if !ok {
+		return false
+	}
+	v.(*session).closer.Close()
+	return true
+}
+
+// sessionConn 统计本地TCP连接的流量
+type sessionConn struct {
+	net.Conn
+	s *session
+}
+
+func (c *sessionConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.s.add(&c.s.tx, n)
+	return n, err
+}
+
+func (c *sessionConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.s.add(&c.s.rx, n)
+	return n, err
+}
+
+// sessionPacketConn 是UDP会话到服务器的PacketConn, 关闭时结束会话
+type sessionPacketConn struct {
+	net.PacketConn
+	s    *session
+	c    *Client
+	once sync.Once
+}
+
+func (pc *sessionPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := pc.PacketConn.ReadFrom(b)
+	if err == nil {
+		pc.s.add(&pc.s.rx, n-len(socks.SplitAddr(b[:n])))
+	}
+	return n, addr, err
+}
+
+func (pc *sessionPacketConn) Close() error {
+	pc.once.Do(func() { pc.c.untrack(pc.s) })
+	return pc.PacketConn.Close()
+}
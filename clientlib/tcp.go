@@ -11,6 +11,7 @@ type TCPConnecter struct {
 	ServerAddr   string
 	Stat         *freconn.Stat
 	localTCPAddr *net.TCPAddr
+	limit        *rateLimit
 }
 
 func (tc *TCPConnecter) Connect() (net.Conn, error) {
@@ -29,7 +30,8 @@ func (tc *TCPConnecter) Connect() (net.Conn, error) {
 		return c, err
 	}
 	newConn := freconn.UpgradeConn(c)
-	newConn.EnableStat(tc.Stat)
+	newConn.EnableConnStat(tc.Stat)
+	tc.limit.conn(newConn)
 	return newConn, nil
 }
 
@@ -38,28 +40,28 @@ func (tc *TCPConnecter) ServerHost() string {
 }
 
 // Create a TCP tunnel from addr to target via server.
-func tcpTun(addr, server, target string, shadow func(net.Conn) net.Conn) {
+func (p *Proxy) tcpTun(addr, server, target string, shadow func(net.Conn) net.Conn) {
 	tgt := socks.ParseAddr(target)
 	if tgt == nil {
-		logf("invalid target address %q", target)
+		p.logf("invalid target address %q", target)
 		return
 	}
-	logf("TCP tunnel %s <-> %s <-> %s", addr, server, target)
-	tcpLocal(addr, server, shadow, func(net.Conn) (socks.Addr, error) { return tgt, nil })
+	p.logf("TCP tunnel %s <-> %s <-> %s", addr, server, target)
+	p.tcpLocal(addr, server, shadow, func(net.Conn) (socks.Addr, error) { return tgt, nil })
 }
 
 // Listen on addr and proxy to server to reach target from getAddr.
-func tcpLocal(addr, server string, shadow func(net.Conn) net.Conn, getAddr func(net.Conn) (socks.Addr, error)) {
+func (p *Proxy) tcpLocal(addr, server string, shadow func(net.Conn) net.Conn, getAddr func(net.Conn) (socks.Addr, error)) {
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		logf("failed to listen on %s: %v", addr, err)
+		p.logf("failed to listen on %s: %v", addr, err)
 		return
 	}
 
 	for {
 		c, err := l.Accept()
 		if err != nil {
-			logf("failed to accept: %s", err)
+			p.logf("failed to accept: %s", err)
 			continue
 		}
 
@@ -78,18 +80,18 @@ func tcpLocal(addr, server string, shadow func(net.Conn) net.Conn, getAddr func(
 						if err, ok := err.(net.Error); ok && err.Timeout() {
 							continue
 						}
-						logf("UDP Associate End.")
+						p.logf("UDP Associate End.")
 						return
 					}
 				}
 
-				logf("failed to get target address: %v", err)
+				p.logf("failed to get target address: %v", err)
 				return
 			}
 
 			rc, err := net.Dial("tcp", server)
 			if err != nil {
-				logf("failed to connect to server %v: %v", server, err)
+				p.logf("failed to connect to server %v: %v", server, err)
 				return
 			}
 			defer rc.Close()
@@ -97,17 +99,17 @@ func tcpLocal(addr, server string, shadow func(net.Conn) net.Conn, getAddr func(
 			rc = shadow(rc)
 
 			if _, err = rc.Write(tgt); err != nil {
-				logf("failed to send target address: %v", err)
+				p.logf("failed to send target address: %v", err)
 				return
 			}
 
-			logf("proxy %s <-> %s <-> %s", c.RemoteAddr(), server, tgt)
+			p.logf("proxy %s <-> %s <-> %s", c.RemoteAddr(), server, tgt)
 			_, _, err = relay(rc, c)
 			if err != nil {
 				if err, ok := err.(net.Error); ok && err.Timeout() {
 					return // ignore i/o timeout
 				}
-				logf("relay error: %v", err)
+				p.logf("relay error: %v", err)
 			}
 		}()
 	}
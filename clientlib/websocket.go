@@ -1,6 +1,7 @@
 package shadowsocks2
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
 	"net/url"
@@ -18,9 +19,14 @@ type WSConnecter struct {
 	URL        string
 	Username   string
 	Stat       *freconn.Stat
+	TLSConfig  *tls.Config // wss:// if not nil
 	dailer     *websocket.Dialer
+	log        logFunc
+	limit      *rateLimit
 }
 
+func (ws *WSConnecter) logf(f string, v ...interface{}) { ws.log.printf(f, v...) }
+
 func (ws *WSConnecter) SetTimeout(timeout time.Duration) {
 	if ws.dailer == nil {
 		ws.dailer = &websocket.Dialer{
@@ -31,23 +37,38 @@ func (ws *WSConnecter) SetTimeout(timeout time.Duration) {
 	}
 }
 
-func (ws *WSConnecter) Connect() (net.Conn, error) {
+func (ws *WSConnecter) dialer() *websocket.Dialer {
 	if ws.dailer == nil {
 		ws.dailer = &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
 	}
-	u := url.URL{Scheme: "ws", Host: ws.ServerAddr, Path: ws.URL}
-	logf("dial to %s\n", u.String())
+	ws.dailer.TLSClientConfig = ws.TLSConfig
+	return ws.dailer
+}
+
+// Addr returns the ws:// or wss:// URL of the server.
+func (ws *WSConnecter) Addr() *ssw.WSAddr {
+	scheme := "ws"
+	if ws.TLSConfig != nil {
+		scheme = "wss"
+	}
+	return &ssw.WSAddr{URL: url.URL{Scheme: scheme, Host: ws.ServerAddr, Path: ws.URL}}
+}
+
+func (ws *WSConnecter) Connect() (net.Conn, error) {
+	u := ws.Addr()
+	ws.logf("dial to %s\n", u.String())
 	header := http.Header{
 		"Shadowsocks-Username": []string{ws.Username},
 		"Shadowsocks-Type":     []string{"connection"},
 	}
-	wc, _, err := ws.dailer.Dial(u.String(), header)
+	wc, _, err := ws.dialer().Dial(u.String(), header)
 	if err != nil {
-		logf("websocket dail failed: %s", err)
+		ws.logf("websocket dail failed: %s", err)
 		return nil, err
 	}
 	newConn := freconn.UpgradeConn(wc.UnderlyingConn())
-	newConn.EnableStat(ws.Stat)
+	newConn.EnableConnStat(ws.Stat)
+	ws.limit.conn(newConn)
 	return newConn, nil
 }
 
@@ -57,7 +78,8 @@ func (ws *WSConnecter) Dial() (net.Conn, error) {
 
 func (ws *WSConnecter) DialPacketConn(localAddr net.Addr) (net.PacketConn, error) {
 	pc := ssw.NewWSPacketConn(localAddr, ws.Username)
-	pc.SetWSTimeout(ws.dailer.HandshakeTimeout)
+	pc.SetWSTimeout(ws.dialer().HandshakeTimeout)
+	pc.SetTLSConfig(ws.TLSConfig)
 	return pc, nil
 }
 
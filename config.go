@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// fileConfig is what the shadowsocks2 command runs. It is read from the file
+// given by -config, or assembled from flags otherwise.
+type fileConfig struct {
+	Log          logConfig      `json:"log" yaml:"log"`
+	UDPTimeout   duration       `json:"udp_timeout" yaml:"udp_timeout"`
+	DrainTimeout duration       `json:"drain_timeout" yaml:"drain_timeout"` // for connections to finish on shutdown
+	Buffers      bufferConfig   `json:"buffers" yaml:"buffers"`
+	ReplayFilter replayConfig   `json:"replay_filter" yaml:"replay_filter"`
+	RateLimit    rateConfig     `json:"rate_limit" yaml:"rate_limit"` // of all users of all servers
+	Metrics      string         `json:"metrics" yaml:"metrics"`       // address serving /metrics, if set
+	Manager      managerConfig  `json:"manager" yaml:"manager"`
+	Servers      []serverConfig `json:"servers" yaml:"servers"`
+	Clients      []clientConfig `json:"clients" yaml:"clients"`
+}
+
+// managerConfig enables the ss-manager API on Listen, a UDP host:port or a
+// unix datagram socket path. Servers are added with Cipher unless the
+// request gives a method. The API has no authentication, so a UDP address
+// must be a loopback one unless AllowRemote is set.
+type managerConfig struct {
+	Listen       string   `json:"listen" yaml:"listen"`
+	Cipher       string   `json:"cipher" yaml:"cipher"`
+	AllowRemote  bool     `json:"allow_remote" yaml:"allow_remote"`
+	Proxy        string   `json:"proxy" yaml:"proxy"` // and the rest as for servers, applied to the servers added
+	Fallback     string   `json:"fallback" yaml:"fallback"`
+	ProbeTimeout duration `json:"probe_timeout" yaml:"probe_timeout"`
+
+	limitConfig `yaml:",inline"` // of the user of each server added
+}
+
+type logConfig struct {
+	Verbose bool   `json:"verbose" yaml:"verbose"`
+	File    string `json:"file" yaml:"file"` // append to this file instead of stderr
+}
+
+// bufferConfig holds the sizes passed to core.SetAeadPayloadSize,
+// core.SetPacketConnBufferSize and core.SetStreamBufferSize. Zero keeps the default.
+type bufferConfig struct {
+	AEADPayloadSize uint `json:"aead_payload_size" yaml:"aead_payload_size"`
+	PacketConnSize  uint `json:"packet_conn_size" yaml:"packet_conn_size"`
+	StreamSize      uint `json:"stream_size" yaml:"stream_size"`
+}
+
+type replayConfig struct {
+	Disabled bool    `json:"disabled" yaml:"disabled"`
+	Capacity int     `json:"capacity" yaml:"capacity"` // salts per Bloom filter, 1e6 if zero
+	FPR      float64 `json:"fpr" yaml:"fpr"`           // false positive rate, 1e-6 if zero
+}
+
+// rateConfig caps a bandwidth in bit/s, 0 for unlimited, with bursts of
+// Burst bits, one second of the rate if 0.
+type rateConfig struct {
+	Download int64 `json:"download" yaml:"download"` // to users
+	Upload   int64 `json:"upload" yaml:"upload"`     // from users
+	Burst    int64 `json:"burst" yaml:"burst"`
+}
+
+func (rc rateConfig) validate(field string) error {
+	if rc.Download < 0 || rc.Upload < 0 || rc.Burst < 0 {
+		return errField(field, "download, upload and burst must not be negative")
+	}
+	return nil
+}
+
+// limitConfig caps the bandwidth of a user, TCP and UDP together, and of
+// each of its TCP connections.
+type limitConfig struct {
+	RateLimit     rateConfig `json:"rate_limit" yaml:"rate_limit"`
+	ConnRateLimit rateConfig `json:"conn_rate_limit" yaml:"conn_rate_limit"`
+}
+
+func (lc *limitConfig) validate(field string) error {
+	if err := lc.RateLimit.validate(field + ".rate_limit"); err != nil {
+		return err
+	}
+	return lc.ConnRateLimit.validate(field + ".conn_rate_limit")
+}
+
+// cipherConfig selects a cipher and its key. Key is base64url-encoded and
+// derived from Password if empty.
+type cipherConfig struct {
+	Cipher   string `json:"cipher" yaml:"cipher"`
+	Key      string `json:"key" yaml:"key"`
+	Password string `json:"password" yaml:"password"`
+}
+
+// pluginConfig selects a SIP003 plugin carrying TCP traffic to or from the server.
+type pluginConfig struct {
+	Plugin     string `json:"plugin" yaml:"plugin"`
+	PluginOpts string `json:"plugin_opts" yaml:"plugin_opts"`
+}
+
+type serverConfig struct {
+	Listen       string `json:"listen" yaml:"listen"` // address, or ws:// or wss:// URL for WebSocket clients
+	cipherConfig `yaml:",inline"`
+	RetiringKeys []retiringKeyConfig `json:"retiring_keys" yaml:"retiring_keys"` // of the single user
+	pluginConfig `yaml:",inline"`
+	Users        []userConfig `json:"users" yaml:"users"`                 // instead of a single cipher
+	TLSCert      string       `json:"tls_cert" yaml:"tls_cert"`           // PEM certificate file of a wss:// server
+	TLSKey       string       `json:"tls_key" yaml:"tls_key"`             // PEM private key file of a wss:// server
+	Proxy        string       `json:"proxy" yaml:"proxy"`                 // socks5:// URL of an upstream proxy to reach targets through
+	Fallback     string       `json:"fallback" yaml:"fallback"`           // address getting the raw bytes of connections failing authentication
+	ProbeTimeout duration     `json:"probe_timeout" yaml:"probe_timeout"` // or reading them until a random time up to this
+
+	limitConfig `yaml:",inline"` // of the single user if no users are listed
+}
+
+type clientConfig struct {
+	Server       string `json:"server" yaml:"server"`
+	cipherConfig `yaml:",inline"`
+	pluginConfig `yaml:",inline"`
+	Socks        string         `json:"socks" yaml:"socks"`
+	SocksUser    string         `json:"socks_username" yaml:"socks_username"` // require authentication if set
+	SocksPass    string         `json:"socks_password" yaml:"socks_password"`
+	SocksReply   bool           `json:"socks_reply" yaml:"socks_reply"` // reply once the server reached the target, allowing BIND
+	UDPSocks     bool           `json:"udp_socks" yaml:"udp_socks"`
+	Redir        string         `json:"redir" yaml:"redir"`
+	Redir6       string         `json:"redir6" yaml:"redir6"`
+	TCPTunnels   []tunnelConfig `json:"tcp_tunnels" yaml:"tcp_tunnels"`
+	UDPTunnels   []tunnelConfig `json:"udp_tunnels" yaml:"udp_tunnels"`
+}
+
+type tunnelConfig struct {
+	Listen string `json:"listen" yaml:"listen"`
+	Target string `json:"target" yaml:"target"`
+}
+
+// duration is a time.Duration written as a string such as "5m30s".
+type duration time.Duration
+
+func (d *duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5m\", got %s", b)
+	}
+	return d.set(s)
+}
+
+func (d *duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	return d.set(s)
+}
+
+// fieldError points at the offending field of a configuration.
+type fieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *fieldError) Error() string { return e.Field + ": " + e.Err.Error() }
+
+func errField(field, format string, v ...interface{}) error {
+	return &fieldError{Field: field, Err: fmt.Errorf(format, v...)}
+}
+
+// loadConfig reads a configuration from a JSON file, or a YAML file if the
+// name ends with .yaml or .yml. Unknown fields are errors.
+func loadConfig(path string) (*fileConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &fileConfig{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			offset := dec.InputOffset()
+			switch err := err.(type) {
+			case *json.SyntaxError:
+				offset = err.Offset
+			case *json.UnmarshalTypeError:
+				offset = err.Offset
+			}
+			line := 1 + bytes.Count(b[:offset], []byte("\n"))
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// validate checks cfg and fills in defaults.
+func (cfg *fileConfig) validate() error {
+	if len(cfg.Servers) == 0 && len(cfg.Clients) == 0 && cfg.Manager.Listen == "" {
+		return errors.New("no servers, clients or manager")
+	}
+	if cfg.UDPTimeout < 0 {
+		return errField("udp_timeout", "must not be negative")
+	}
+	if cfg.UDPTimeout == 0 {
+		cfg.UDPTimeout = duration(5 * time.Minute)
+	}
+	if cfg.DrainTimeout < 0 {
+		return errField("drain_timeout", "must not be negative")
+	}
+	if cfg.DrainTimeout == 0 {
+		cfg.DrainTimeout = duration(5 * time.Second)
+	}
+	if n := cfg.Buffers.AEADPayloadSize; n > 0x3FFF || n&(n+1) != 0 {
+		return errField("buffers.aead_payload_size", "%d is not one less than a power of two up to 16383", n)
+	}
+	if n := cfg.Buffers.PacketConnSize; n > 0 && n < 1500 {
+		return errField("buffers.packet_conn_size", "%d is smaller than 1500", n)
+	}
+	if r := cfg.ReplayFilter; r.Capacity < 0 || r.FPR < 0 || r.FPR >= 1 {
+		return errField("replay_filter", "capacity must not be negative and fpr must be in [0, 1)")
+	}
+	if err := cfg.RateLimit.validate("rate_limit"); err != nil {
+		return err
+	}
+	if cfg.Metrics != "" {
+		if err := checkAddr("metrics", cfg.Metrics); err != nil {
+			return err
+		}
+	}
+	if cfg.Manager.Listen != "" {
+		if cfg.Manager.Cipher == "" {
+			cfg.Manager.Cipher = "AEAD_CHACHA20_POLY1305"
+		}
+		if _, err := core.RandomPassword(cfg.Manager.Cipher); err != nil {
+			return errField("manager.cipher", "%v", err)
+		}
+		if host, _, err := net.SplitHostPort(cfg.Manager.Listen); err == nil && !cfg.Manager.AllowRemote && !isLoopback(host) {
+			return errField("manager.listen", "%s is reachable from other hosts, set allow_remote to allow it", cfg.Manager.Listen)
+		}
+		if _, err := newOutbound(cfg.Manager.Proxy); err != nil {
+			return errField("manager.proxy", "%v", err)
+		}
+		if cfg.Manager.Fallback != "" {
+			if err := checkAddr("manager.fallback", cfg.Manager.Fallback); err != nil {
+				return err
+			}
+		}
+		if cfg.Manager.ProbeTimeout < 0 {
+			return errField("manager.probe_timeout", "must not be negative")
+		}
+		if err := cfg.Manager.limitConfig.validate("manager"); err != nil {
+			return err
+		}
+	}
+
+	for i := range cfg.Servers {
+		if err := cfg.Servers[i].validate(fmt.Sprintf("servers[%d]", i)); err != nil {
+			return err
+		}
+	}
+	for i := range cfg.Clients {
+		if err := cfg.Clients[i].validate(fmt.Sprintf("clients[%d]", i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isLoopback reports whether host is a loopback IP address or localhost.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func checkAddr(field, addr string) error {
+	if addr == "" {
+		return errField(field, "missing address")
+	}
+	if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+		return errField(field, "invalid address %q, want host:port", addr)
+	}
+	return nil
+}
+
+func (c *cipherConfig) validate(field string) error {
+	if c.Cipher == "" {
+		return errField(field+".cipher", "missing cipher")
+	}
+	if _, err := c.pick(); err != nil {
+		if c.Key != "" {
+			return errField(field+".key", "%v", err)
+		}
+		return errField(field+".cipher", "%v", err)
+	}
+	return nil
+}
+
+func (c *cipherConfig) pick() (core.Cipher, error) {
+	var key []byte
+	if c.Key != "" {
+		k, err := base64.URLEncoding.DecodeString(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+	}
+	return core.PickCipher(c.Cipher, key, c.Password)
+}
+
+func (pc *pluginConfig) validate(field string) error {
+	if pc.Plugin == "" {
+		if pc.PluginOpts != "" {
+			return errField(field+".plugin_opts", "requires plugin")
+		}
+		return nil
+	}
+	if _, err := exec.LookPath(pc.Plugin); err != nil {
+		return errField(field+".plugin", "%v", err)
+	}
+	return nil
+}
+
+func (sc *serverConfig) validate(field string) error {
+	if isWebSocket(sc.Listen) {
+		u, err := url.Parse(sc.Listen)
+		if err != nil {
+			return errField(field+".listen", "%v", err)
+		}
+		if err := checkAddr(field+".listen", u.Host); err != nil {
+			return err
+		}
+		if sc.Plugin != "" {
+			return errField(field+".plugin", "not supported by WebSocket servers")
+		}
+		if sc.Fallback != "" || sc.ProbeTimeout != 0 {
+			return errField(field, "fallback and probe_timeout are not supported by WebSocket servers")
+		}
+		if u.Scheme == "wss" {
+			if sc.TLSCert == "" || sc.TLSKey == "" {
+				return errField(field, "tls_cert and tls_key are required by wss://")
+			}
+			if _, err := tls.LoadX509KeyPair(sc.TLSCert, sc.TLSKey); err != nil {
+				return errField(field+".tls_cert", "%v", err)
+			}
+		}
+	} else if err := checkAddr(field+".listen", sc.Listen); err != nil {
+		return err
+	} else if sc.TLSCert != "" || sc.TLSKey != "" {
+		return errField(field, "tls_cert and tls_key require a wss:// listen URL")
+	}
+	if err := sc.pluginConfig.validate(field); err != nil {
+		return err
+	}
+	if _, err := newOutbound(sc.Proxy); err != nil {
+		return errField(field+".proxy", "%v", err)
+	}
+	if sc.Fallback != "" {
+		if err := checkAddr(field+".fallback", sc.Fallback); err != nil {
+			return err
+		}
+	}
+	if sc.ProbeTimeout < 0 {
+		return errField(field+".probe_timeout", "must not be negative")
+	}
+	if err := sc.limitConfig.validate(field); err != nil {
+		return err
+	}
+	if len(sc.Users) == 0 {
+		if err := sc.cipherConfig.validate(field); err != nil {
+			return err
+		}
+		u, err := sc.userConfigs()[0].newUser()
+		if err == nil {
+			_, err = newUserTable([]*user{u})
+		}
+		if err != nil {
+			return errField(field+".retiring_keys", "%v", err)
+		}
+		return nil
+	}
+	if sc.Cipher != "" || sc.Key != "" || sc.Password != "" || sc.RetiringKeys != nil || sc.limitConfig != (limitConfig{}) {
+		return errField(field, "cipher, key, password, retiring keys and rate limits must be given per user when users are listed")
+	}
+	for i := range sc.Users {
+		f := fmt.Sprintf("%s.users[%d]", field, i)
+		if err := sc.Users[i].limitConfig.validate(f); err != nil {
+			return err
+		}
+		if _, err := sc.Users[i].newUser(); err != nil {
+			return errField(f, "%v", err)
+		}
+	}
+	users, err := sc.users()
+	if err != nil {
+		return err
+	}
+	if _, err := newUserTable(users); err != nil {
+		return errField(field+".users", "%v", err)
+	}
+	return nil
+}
+
+// isWebSocket reports whether listen is a ws:// or wss:// URL rather than an address.
+func isWebSocket(listen string) bool {
+	return strings.HasPrefix(listen, "ws://") || strings.HasPrefix(listen, "wss://")
+}
+
+// userConfigs returns the users of sc, or its single user if none are listed.
+func (sc *serverConfig) userConfigs() []userConfig {
+	if len(sc.Users) == 0 {
+		return []userConfig{{Cipher: sc.Cipher, Key: sc.Key, Password: sc.Password, RetiringKeys: sc.RetiringKeys,
+			limitConfig: sc.limitConfig}}
+	}
+	return sc.Users
+}
+
+// users returns the users of sc, or a single anonymous user if none are listed.
+func (sc *serverConfig) users() ([]*user, error) {
+	var users []*user
+	for _, uc := range sc.userConfigs() {
+		u, err := uc.newUser()
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func (cc *clientConfig) validate(field string) error {
+	if err := checkAddr(field+".server", cc.Server); err != nil {
+		return err
+	}
+	if err := cc.cipherConfig.validate(field); err != nil {
+		return err
+	}
+	if err := cc.pluginConfig.validate(field); err != nil {
+		return err
+	}
+	if cc.Socks == "" && cc.Redir == "" && cc.Redir6 == "" && len(cc.TCPTunnels) == 0 && len(cc.UDPTunnels) == 0 {
+		return errField(field, "no socks, redir or tunnel listeners")
+	}
+	if cc.UDPSocks && cc.Socks == "" {
+		return errField(field+".udp_socks", "requires socks")
+	}
+	if cc.SocksUser == "" && cc.SocksPass != "" {
+		return errField(field+".socks_password", "requires socks_username")
+	}
+	if len(cc.SocksUser) > 255 || len(cc.SocksPass) > 255 {
+		return errField(field, "socks_username and socks_password must not exceed 255 bytes")
+	}
+	for _, l := range []struct{ name, addr string }{{"socks", cc.Socks}, {"redir", cc.Redir}, {"redir6", cc.Redir6}} {
+		if l.addr != "" {
+			if err := checkAddr(field+"."+l.name, l.addr); err != nil {
+				return err
+			}
+		}
+	}
+	for name, tuns := range map[string][]tunnelConfig{"tcp_tunnels": cc.TCPTunnels, "udp_tunnels": cc.UDPTunnels} {
+		for i, tun := range tuns {
+			f := fmt.Sprintf("%s.%s[%d]", field, name, i)
+			if err := checkAddr(f+".listen", tun.Listen); err != nil {
+				return err
+			}
+			if socks.ParseAddr(tun.Target) == nil {
+				return errField(f+".target", "invalid address %q, want host:port", tun.Target)
+			}
+		}
+	}
+	return nil
+}
+
+// parseTunnels parses tunnels in the form of laddr1=raddr1,laddr2=raddr2,...
+func parseTunnels(s string) ([]tunnelConfig, error) {
+	var tuns []tunnelConfig
+	for _, tun := range strings.Split(s, ",") {
+		p := strings.Split(tun, "=")
+		if len(p) != 2 {
+			return nil, fmt.Errorf("invalid tunnel %q, want laddr=raddr", tun)
+		}
+		tuns = append(tuns, tunnelConfig{Listen: p[0], Target: p[1]})
+	}
+	return tuns, nil
+}
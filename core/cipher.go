@@ -2,7 +2,10 @@ package core
 
 import (
 	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
+	"io"
 	"net"
 	"sort"
 	"strings"
@@ -24,11 +27,51 @@ func SetPacketConnBufferSize(size uint) {
 	shadowaead.SetPacketConnBufSize(size)
 }
 
+// SetReplayFilter makes AEAD connections reject salts already seen by f. A nil f disables the check.
+func SetReplayFilter(f *shadowaead.ReplayFilter) {
+	shadowaead.SetReplayFilter(f)
+}
+
 type Cipher interface {
 	StreamConnCipher
 	PacketConnCipher
 }
 
+// TrialCipher is a Cipher that can tell whether a stream or packet was
+// encrypted with its key, so a server can find out which of several keys a
+// client uses. Packets are tried by reading them through PacketConn.
+type TrialCipher interface {
+	Cipher
+	// StreamHeaderSize returns the number of leading bytes of a stream needed by TryStream.
+	StreamHeaderSize() int
+	// TryStream reports whether the leading bytes of a stream are authentic under the key.
+	TryStream(hdr []byte) bool
+}
+
+// ServerCipher is a Cipher whose server end differs from its client end.
+// StreamConn and PacketConn of a ServerCipher make client ends.
+type ServerCipher interface {
+	Cipher
+	ServerStreamConn(net.Conn) net.Conn
+	ServerPacketConn(net.PacketConn) net.PacketConn
+}
+
+// ServerStreamConn wraps c with ciph as the server end.
+func ServerStreamConn(ciph Cipher, c net.Conn) net.Conn {
+	if sc, ok := ciph.(ServerCipher); ok {
+		return sc.ServerStreamConn(c)
+	}
+	return ciph.StreamConn(c)
+}
+
+// ServerPacketConn wraps c with ciph as the server end.
+func ServerPacketConn(ciph Cipher, c net.PacketConn) net.PacketConn {
+	if sc, ok := ciph.(ServerCipher); ok {
+		return sc.ServerPacketConn(c)
+	}
+	return ciph.PacketConn(c)
+}
+
 type StreamConnCipher interface {
 	StreamConn(net.Conn) net.Conn
 }
@@ -45,6 +88,10 @@ const (
 	aeadAes192Gcm        = "AEAD_AES_192_GCM"
 	aeadAes256Gcm        = "AEAD_AES_256_GCM"
 	aeadChacha20Poly1305 = "AEAD_CHACHA20_POLY1305"
+
+	aead2022Blake3Aes128Gcm        = "2022-BLAKE3-AES-128-GCM"
+	aead2022Blake3Aes256Gcm        = "2022-BLAKE3-AES-256-GCM"
+	aead2022Blake3Chacha20Poly1305 = "2022-BLAKE3-CHACHA20-POLY1305"
 )
 
 // List of AEAD ciphers: key size in bytes and constructor
@@ -58,6 +105,16 @@ var aeadList = map[string]struct {
 	aeadChacha20Poly1305: {32, shadowaead.Chacha20Poly1305},
 }
 
+// List of AEAD ciphers of the 2022 edition (SIP022): key size in bytes and constructor
+var aead2022List = map[string]struct {
+	KeySize int
+	New     func([]byte) (shadowaead.Cipher2022, error)
+}{
+	aead2022Blake3Aes128Gcm:        {16, shadowaead.Blake3AESGCM},
+	aead2022Blake3Aes256Gcm:        {32, shadowaead.Blake3AESGCM},
+	aead2022Blake3Chacha20Poly1305: {32, shadowaead.Blake3Chacha20Poly1305},
+}
+
 // List of stream ciphers: key size in bytes and constructor
 var streamList = map[string]struct {
 	KeySize int
@@ -80,6 +137,9 @@ func ListCipher() []string {
 	for k := range aeadList {
 		l = append(l, k)
 	}
+	for k := range aead2022List {
+		l = append(l, k)
+	}
 	for k := range streamList {
 		l = append(l, k)
 	}
@@ -88,20 +148,26 @@ func ListCipher() []string {
 }
 
 // PickCipher returns a Cipher of the given name. Derive key from password if given key is empty.
+// Ciphers of the 2022 edition take no key derivation: the password is the base64-encoded key.
 func PickCipher(name string, key []byte, password string) (Cipher, error) {
-	name = strings.ToUpper(name)
-
-	switch name {
-	case "DUMMY":
+	name = canonicalName(name)
+	if name == "DUMMY" {
 		return &dummy{}, nil
-	case "CHACHA20-IETF-POLY1305":
-		name = aeadChacha20Poly1305
-	case "AES-128-GCM":
-		name = aeadAes128Gcm
-	case "AES-192-GCM":
-		name = aeadAes192Gcm
-	case "AES-256-GCM":
-		name = aeadAes256Gcm
+	}
+
+	if choice, ok := aead2022List[name]; ok {
+		if len(key) == 0 {
+			k, err := base64.StdEncoding.DecodeString(password)
+			if err != nil {
+				return nil, err
+			}
+			key = k
+		}
+		if len(key) != choice.KeySize {
+			return nil, shadowaead.KeySizeError(choice.KeySize)
+		}
+		aead, err := choice.New(key)
+		return &aead2022Cipher{aead}, err
 	}
 
 	if choice, ok := aeadList[name]; ok {
@@ -129,6 +195,46 @@ func PickCipher(name string, key []byte, password string) (Cipher, error) {
 	return nil, ErrCipherNotSupported
 }
 
+// RandomPassword returns a random password as strong as the key of the named
+// cipher. For ciphers of the 2022 edition it is the base64-encoded key.
+func RandomPassword(name string) (string, error) {
+	name = canonicalName(name)
+	var size int
+	if choice, ok := aead2022List[name]; ok {
+		size = choice.KeySize
+	} else if choice, ok := aeadList[name]; ok {
+		size = choice.KeySize
+	} else if choice, ok := streamList[name]; ok {
+		size = choice.KeySize
+	} else {
+		return "", ErrCipherNotSupported
+	}
+	key := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	if _, ok := aead2022List[name]; ok {
+		return base64.StdEncoding.EncodeToString(key), nil
+	}
+	return base64.URLEncoding.EncodeToString(key), nil
+}
+
+// canonicalName maps a cipher name and its aliases to the name used in the cipher lists.
+func canonicalName(name string) string {
+	name = strings.ToUpper(name)
+	switch name {
+	case "CHACHA20-IETF-POLY1305":
+		return aeadChacha20Poly1305
+	case "AES-128-GCM":
+		return aeadAes128Gcm
+	case "AES-192-GCM":
+		return aeadAes192Gcm
+	case "AES-256-GCM":
+		return aeadAes256Gcm
+	}
+	return name
+}
+
 type aeadCipher struct{ shadowaead.Cipher }
 
 func (aead *aeadCipher) StreamConn(c net.Conn) net.Conn { return shadowaead.NewConn(c, aead) }
@@ -136,6 +242,29 @@ func (aead *aeadCipher) PacketConn(c net.PacketConn) net.PacketConn {
 	return shadowaead.NewPacketConn(c, aead)
 }
 
+func (aead *aeadCipher) StreamHeaderSize() int     { return shadowaead.StreamHeaderSize(aead) }
+func (aead *aeadCipher) TryStream(hdr []byte) bool { return shadowaead.TryStream(aead, hdr) }
+
+type aead2022Cipher struct{ shadowaead.Cipher2022 }
+
+func (aead *aead2022Cipher) StreamConn(c net.Conn) net.Conn {
+	return shadowaead.NewConn2022(c, aead.Cipher2022)
+}
+func (aead *aead2022Cipher) PacketConn(c net.PacketConn) net.PacketConn {
+	return shadowaead.NewPacketConn2022(c, aead.Cipher2022)
+}
+func (aead *aead2022Cipher) ServerStreamConn(c net.Conn) net.Conn {
+	return shadowaead.NewServerConn2022(c, aead.Cipher2022)
+}
+func (aead *aead2022Cipher) ServerPacketConn(c net.PacketConn) net.PacketConn {
+	return shadowaead.NewServerPacketConn2022(c, aead.Cipher2022)
+}
+
+func (aead *aead2022Cipher) StreamHeaderSize() int { return shadowaead.StreamHeaderSize2022(aead) }
+func (aead *aead2022Cipher) TryStream(hdr []byte) bool {
+	return shadowaead.TryStream2022(aead, hdr)
+}
+
 type streamCipher struct{ shadowstream.Cipher }
 
 func (ciph *streamCipher) StreamConn(c net.Conn) net.Conn { return shadowstream.NewConn(c, ciph) }
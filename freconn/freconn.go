@@ -2,8 +2,6 @@ package freconn
 
 import (
 	"net"
-
-	"github.com/juju/ratelimit"
 )
 
 const (
@@ -13,10 +11,11 @@ const (
 
 type Conn struct {
 	net.Conn
-	Flag     int
-	TxBucket *ratelimit.Bucket
-	RxBucket *ratelimit.Bucket
+	Flag    int
+	RxLimit Limiters // waited on after reading
+	TxLimit Limiters // waited on before writing
 	*Stat
+	ownStat bool // Stat is closed with the connection
 }
 
 func haveFlag(flag, have int) bool {
@@ -35,13 +34,30 @@ func (c *Conn) EnableStat(stat *Stat) {
 	c.Flag = c.Flag | FlagStat
 }
 
+// connHistory is the number of samples kept for a connection by
+// EnableConnStat, enough for Bandwidth10 at the default interval.
+const connHistory = 11
+
+// EnableConnStat counts the traffic of the connection in a child of
+// parent, closed with the connection.
+func (c *Conn) EnableConnStat(parent *Stat) {
+	c.EnableStat(parent.NewChildHistory(connHistory))
+	c.ownStat = true
+}
+
+// EnableRatelimit limits the bandwidth of reading to rx and of writing to tx.
+func (c *Conn) EnableRatelimit(rx, tx Limiters) {
+	c.RxLimit, c.TxLimit = rx, tx
+	c.Flag = c.Flag | FlagRatelimit
+}
+
 func (c *Conn) Read(b []byte) (int, error) {
 	n, err := c.Conn.Read(b)
 	if err != nil {
 		return n, err
 	}
-	if haveFlag(c.Flag, FlagRatelimit) && c.RxBucket != nil {
-		c.RxBucket.Wait(int64(n * 8))
+	if haveFlag(c.Flag, FlagRatelimit) {
+		c.RxLimit.Wait(int64(n * 8))
 	}
 	if haveFlag(c.Flag, FlagStat) && c.Stat != nil {
 		c.Stat.AddRx(uint64(n) * 8)
@@ -50,8 +66,8 @@ func (c *Conn) Read(b []byte) (int, error) {
 }
 
 func (c *Conn) Write(b []byte) (int, error) {
-	if haveFlag(c.Flag, FlagRatelimit) && c.TxBucket != nil {
-		c.TxBucket.Wait(int64(len(b) * 8))
+	if haveFlag(c.Flag, FlagRatelimit) {
+		c.TxLimit.Wait(int64(len(b) * 8))
 	}
 	n, err := c.Conn.Write(b)
 	if err != nil {
@@ -64,15 +80,19 @@ func (c *Conn) Write(b []byte) (int, error) {
 }
 
 func (c *Conn) Close() error {
+	if c.ownStat {
+		c.Stat.Close()
+	}
 	return c.Conn.Close()
 }
 
+// PacketConn drops packets beyond its limits.
 type PacketConn struct {
 	net.PacketConn
-	Flag     int
-	TxBucket *ratelimit.Bucket
-	RxBucket *ratelimit.Bucket
-	Stat     *Stat
+	Flag    int
+	RxLimit Limiters
+	TxLimit Limiters
+	Stat    *Stat
 }
 
 func UpgradePacketConn(pc net.PacketConn) *PacketConn {
@@ -84,14 +104,20 @@ func (c *PacketConn) EnableStat(stat *Stat) {
 	c.Flag = c.Flag | FlagStat
 }
 
+// EnableRatelimit limits the bandwidth of reading to rx and of writing to tx.
+func (c *PacketConn) EnableRatelimit(rx, tx Limiters) {
+	c.RxLimit, c.TxLimit = rx, tx
+	c.Flag = c.Flag | FlagRatelimit
+}
+
 func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	n, a, err := c.PacketConn.ReadFrom(b)
+	for err == nil && haveFlag(c.Flag, FlagRatelimit) && !c.RxLimit.Allow(int64(n*8)) {
+		n, a, err = c.PacketConn.ReadFrom(b)
+	}
 	if err != nil {
 		return n, a, err
 	}
-	if haveFlag(c.Flag, FlagRatelimit) && c.RxBucket != nil {
-		c.RxBucket.Wait(int64(n * 8))
-	}
 	if haveFlag(c.Flag, FlagStat) && c.Stat != nil {
 		c.Stat.AddRx(uint64(n) * 8)
 	}
@@ -100,8 +126,8 @@ func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
 }
 
 func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
-	if haveFlag(c.Flag, FlagRatelimit) && c.TxBucket != nil {
-		c.TxBucket.Wait(int64(len(b) * 8))
+	if haveFlag(c.Flag, FlagRatelimit) && !c.TxLimit.Allow(int64(len(b)*8)) {
+		return len(b), nil // dropped as by the network
 	}
 	n, err := c.PacketConn.WriteTo(b, addr)
 	if err != nil {
@@ -0,0 +1,160 @@
+package freconn
+
+import (
+	"sync/atomic"
+
+	"github.com/juju/ratelimit"
+)
+
+// Limiter caps a bandwidth in bit/s. The rate can be changed while the
+// Limiter is in use, and a nil Limiter or one without rate does not limit.
+// Streams wait for the bandwidth while packets beyond it are dropped, so a
+// Limiter can be shared by TCP and UDP.
+type Limiter struct {
+	v      atomic.Value // limit
+	follow *ConnLimiter // whose rate to take, if not nil
+}
+
+type limit struct {
+	rate, burst int64
+	bucket      *ratelimit.Bucket // nil for no limit
+}
+
+// newLimit returns a limit without bucket, rate and burst as in SetRate.
+func newLimit(rate, burst int64) limit {
+	if rate <= 0 {
+		return limit{}
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return limit{rate: rate, burst: burst}
+}
+
+// NewLimiter returns a Limiter of rate bit/s with burst bits, see SetRate.
+func NewLimiter(rate, burst int64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate, burst)
+	return l
+}
+
+// SetRate sets the rate in bit/s and the burst in bits, one second of the
+// rate if not positive. A rate not positive removes the limit. The bits
+// available are kept, up to the new burst.
+func (l *Limiter) SetRate(rate, burst int64) {
+	l.store(newLimit(rate, burst))
+}
+
+// store makes lim the limit of l, its bucket filled as much as the bucket
+// it replaces so that changing the rate grants no extra burst.
+func (l *Limiter) store(lim limit) {
+	if lim.rate > 0 {
+		lim.bucket = ratelimit.NewBucketWithRate(float64(lim.rate), lim.burst)
+		if old, _ := l.v.Load().(limit); old.bucket != nil {
+			if avail := old.bucket.Available(); avail < lim.burst {
+				lim.bucket.Take(lim.burst - avail)
+			}
+		}
+	}
+	l.v.Store(lim)
+}
+
+// Rate returns the rate and burst, 0 if there is no limit.
+func (l *Limiter) Rate() (rate, burst int64) {
+	lim := l.load()
+	return lim.rate, lim.burst
+}
+
+func (l *Limiter) load() limit {
+	if l == nil {
+		return limit{}
+	}
+	lim, _ := l.v.Load().(limit)
+	if l.follow != nil {
+		if t := l.follow.load(); t.rate != lim.rate || t.burst != lim.burst {
+			l.store(t)
+			lim, _ = l.v.Load().(limit)
+		}
+	}
+	return lim
+}
+
+// Wait blocks until bits are within the limit.
+func (l *Limiter) Wait(bits int64) {
+	if b := l.load().bucket; b != nil {
+		b.Wait(bits)
+	}
+}
+
+// Limiters are applied together, each of them nil or not.
+type Limiters []*Limiter
+
+// Wait waits on every Limiter.
+func (ls Limiters) Wait(bits int64) {
+	for _, l := range ls {
+		l.Wait(bits)
+	}
+}
+
+// Allow reports whether bits are within every Limiter, taking them only
+// if so. Bits beyond the burst are allowed by a full Limiter, which then
+// takes the time of the excess to refill.
+func (ls Limiters) Allow(bits int64) bool {
+	for _, l := range ls {
+		if b := l.load().bucket; b != nil {
+			if avail := b.Available(); avail < bits && avail < b.Capacity() {
+				return false
+			}
+		}
+	}
+	for _, l := range ls {
+		if b := l.load().bucket; b != nil {
+			b.Take(bits)
+		}
+	}
+	return true
+}
+
+// ConnLimiter gives each connection a Limiter of its own with the rate of
+// the ConnLimiter, which can be changed for all of them at once. A nil
+// ConnLimiter does not limit.
+type ConnLimiter struct {
+	v atomic.Value // limit without bucket
+}
+
+// NewConnLimiter returns a ConnLimiter of rate bit/s with burst bits, see
+// Limiter.SetRate.
+func NewConnLimiter(rate, burst int64) *ConnLimiter {
+	cl := &ConnLimiter{}
+	cl.SetRate(rate, burst)
+	return cl
+}
+
+// SetRate sets the rate as Limiter.SetRate for every connection.
+func (cl *ConnLimiter) SetRate(rate, burst int64) {
+	cl.v.Store(newLimit(rate, burst))
+}
+
+// Rate returns the rate and burst, 0 if there is no limit.
+func (cl *ConnLimiter) Rate() (rate, burst int64) {
+	lim := cl.load()
+	return lim.rate, lim.burst
+}
+
+func (cl *ConnLimiter) load() limit {
+	if cl == nil {
+		return limit{}
+	}
+	lim, _ := cl.v.Load().(limit)
+	return lim
+}
+
+// Limiter returns a new Limiter for a connection.
+func (cl *ConnLimiter) Limiter() *Limiter {
+	if cl == nil {
+		return nil
+	}
+	l := &Limiter{follow: cl}
+	l.store(cl.load())
+	return l
+}
@@ -0,0 +1,88 @@
+package freconn
+
+import "testing"
+
+func TestLimitersAllow(t *testing.T) {
+	tests := []struct {
+		name        string
+		rate, burst int64
+		bits        []int64
+		want        []bool
+	}{
+		{"within burst", 8000, 10000, []int64{6000, 6000, 4000}, []bool{true, false, true}},
+		{"beyond burst when full", 8000, 1000, []int64{12000, 8}, []bool{true, false}},
+		{"beyond burst when not full", 8000, 1000, []int64{500, 1500}, []bool{true, false}},
+		{"no limit", 0, 0, []int64{1 << 40}, []bool{true}},
+	}
+	for _, tt := range tests {
+		ls := Limiters{nil, NewLimiter(tt.rate, tt.burst)}
+		for i, bits := range tt.bits {
+			if got := ls.Allow(bits); got != tt.want[i] {
+				t.Errorf("%s: Allow(%d) #%d = %v, want %v", tt.name, bits, i, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestLimitersAllowAll(t *testing.T) {
+	a, b := NewLimiter(8000, 10000), NewLimiter(8000, 5000)
+	a.Wait(8000)
+	ls := Limiters{a, b}
+	if ls.Allow(3000) {
+		t.Fatal("allowed bits beyond what a has")
+	}
+	if avail := b.load().bucket.Available(); avail != 5000 {
+		t.Errorf("%d bits available in b after a refused, want 5000", avail)
+	}
+	if !ls.Allow(1000) {
+		t.Fatal("bits within every Limiter not allowed")
+	}
+	if avail := b.load().bucket.Available(); avail > 4000 {
+		t.Errorf("%d bits available in b, want at most 4000", avail)
+	}
+}
+
+func TestSetRateKeepsFillLevel(t *testing.T) {
+	tests := []struct {
+		name              string
+		burst, take, next int64 // burst before, bits taken, burst after
+		allow             int64
+		want              bool
+	}{
+		{"empty stays empty", 8000, 8000, 16000, 1000, false},
+		{"partly filled", 8000, 4000, 16000, 4000, true},
+		{"partly filled, no more", 8000, 4000, 16000, 4500, false},
+		{"clipped to the new burst", 8000, 0, 2000, 2000, true},
+	}
+	for _, tt := range tests {
+		l := NewLimiter(8000, tt.burst)
+		l.Wait(tt.take)
+		l.SetRate(16000, tt.next)
+		if got := (Limiters{l}).Allow(tt.allow); got != tt.want {
+			t.Errorf("%s: Allow(%d) = %v, want %v", tt.name, tt.allow, got, tt.want)
+		}
+		if rate, burst := l.Rate(); rate != 16000 || burst != tt.next {
+			t.Errorf("%s: Rate() = %d, %d", tt.name, rate, burst)
+		}
+	}
+
+	// Without a limit before, the bucket starts full.
+	l := NewLimiter(0, 0)
+	l.SetRate(8000, 8000)
+	if !(Limiters{l}).Allow(8000) {
+		t.Error("new limit not full")
+	}
+}
+
+func TestConnLimiterKeepsFillLevel(t *testing.T) {
+	cl := NewConnLimiter(8000, 8000)
+	l := cl.Limiter()
+	l.Wait(8000)
+	cl.SetRate(16000, 16000)
+	if (Limiters{l}).Allow(1000) {
+		t.Error("connection got a full bucket when the rate changed")
+	}
+	if rate, _ := l.Rate(); rate != 16000 {
+		t.Errorf("connection rate is %d, want 16000", rate)
+	}
+}
@@ -1,109 +1,250 @@
 package freconn
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Default sampling of NewStat: every second, keeping 10 minutes.
+const (
+	DefaultInterval = time.Second
+	DefaultHistory  = 600
+)
+
+// Stat counts bits received and sent, and samples the totals at a fixed
+// interval into a ring buffer to compute bandwidth over sliding windows.
+// Counts added to a child Stat are also added to its parents. It is safe
+// for concurrent use.
 type Stat struct {
-	Rx   uint64
-	Tx   uint64
-	in1  statStatus
-	in10 statStatus
+	rx, tx   uint64 // atomic, first for 64-bit alignment
+	parent   *Stat
+	interval time.Duration
+	done     chan struct{} // nil for children, sampled by the root
+
+	mu       sync.Mutex
+	samples  []sample // ring buffer
+	next     int      // where the next sample goes
+	count    int
+	children map[*Stat]struct{}
+	closed   bool
 }
 
-type statStatus struct {
-	t           time.Time
-	rx          uint64
-	tx          uint64
-	bandwidthRx uint64
-	bandwidthTx uint64
+type sample struct {
+	t      time.Time
+	rx, tx uint64
 }
 
-func (s *statStatus) Reset() {
-	s.t = time.Now()
-	s.rx = 0
-	s.tx = 0
-	s.bandwidthRx = 0
-	s.bandwidthTx = 0
+// Sample is the bandwidth in bit/s over the interval ending at Time.
+type Sample struct {
+	Time   time.Time
+	Rx, Tx uint64
 }
 
+// NewStat returns a Stat sampling every DefaultInterval, keeping
+// DefaultHistory samples.
 func NewStat() *Stat {
-	s := &Stat{
-		Rx: 0,
-		Tx: 0,
-		in1: statStatus{
-			t:           time.Now(),
-			rx:          0,
-			tx:          0,
-			bandwidthRx: 0,
-			bandwidthTx: 0,
-		},
-		in10: statStatus{
-			t:           time.Now(),
-			rx:          0,
-			tx:          0,
-			bandwidthRx: 0,
-			bandwidthTx: 0,
-		},
-	}
-	go s.RunBandwidthIn1()
-	go s.RunBandwidthIn10()
+	return NewStatHistory(DefaultInterval, DefaultHistory)
+}
+
+// NewStatHistory returns a Stat sampling every interval and keeping n
+// samples, so bandwidth is known over windows up to (n-1)*interval. Close
+// stops sampling.
+func NewStatHistory(interval time.Duration, n int) *Stat {
+	if n < 2 {
+		n = 2
+	}
+	s := newStat(nil, interval, n)
+	s.done = make(chan struct{})
+	go s.run()
+	return s
+}
 
+func newStat(parent *Stat, interval time.Duration, n int) *Stat {
+	s := &Stat{
+		parent:   parent,
+		interval: interval,
+		samples:  make([]sample, n),
+		children: make(map[*Stat]struct{}),
+	}
+	s.record(time.Now())
 	return s
 }
 
-func (s *Stat) RunBandwidthIn1() {
-	ticker := time.NewTicker(time.Second)
-	for range ticker.C {
-		s.in1.bandwidthRx = s.Rx - s.in1.rx
-		s.in1.bandwidthTx = s.Tx - s.in1.tx
-		s.in1.rx = s.Rx
-		s.in1.tx = s.Tx
-		s.in1.t = time.Now()
+// NewChild returns a Stat with the same sampling whose counts are also
+// added to s, e.g. for a server. Close it when done.
+func (s *Stat) NewChild() *Stat {
+	return s.NewChildHistory(len(s.samples))
+}
+
+// NewChildHistory is like NewChild but keeps n samples, e.g. a few for a
+// connection.
+func (s *Stat) NewChildHistory(n int) *Stat {
+	if n < 2 {
+		n = 2
+	}
+	c := newStat(s, s.interval, n)
+	s.mu.Lock()
+	if !s.closed {
+		s.children[c] = struct{}{}
+	}
+	s.mu.Unlock()
+	return c
+}
+
+func (s *Stat) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case t := <-ticker.C:
+			s.sampleAll(t)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// sampleAll samples s and all its descendants.
+func (s *Stat) sampleAll(t time.Time) {
+	s.record(t)
+	s.mu.Lock()
+	children := make([]*Stat, 0, len(s.children))
+	for c := range s.children {
+		children = append(children, c)
+	}
+	s.mu.Unlock()
+	for _, c := range children {
+		c.sampleAll(t)
+	}
+}
 
-		// log.Printf("[1s]RX: %dbps", s.in1.bandwidthRx)
-		// log.Printf("[1s]TX: %dbps", s.in1.bandwidthTx)
+func (s *Stat) record(t time.Time) {
+	s.mu.Lock()
+	if s.closed { // sampling may race with Close
+		s.mu.Unlock()
+		return
+	}
+	s.samples[s.next] = sample{t: t, rx: s.Rx(), tx: s.Tx()}
+	s.next = (s.next + 1) % len(s.samples)
+	if s.count < len(s.samples) {
+		s.count++
 	}
+	s.mu.Unlock()
 }
 
-func (s *Stat) RunBandwidthIn10() {
-	ticker := time.NewTicker(10 * time.Second)
-	for range ticker.C {
-		s.in10.bandwidthRx = (s.Rx - s.in10.rx) / 10
-		s.in10.bandwidthTx = (s.Tx - s.in10.tx) / 10
-		s.in10.rx = s.Rx
-		s.in10.tx = s.Tx
-		s.in10.t = time.Now()
-		// log.Printf("[10s]RX: %dbps", s.in10.bandwidthRx)
-		// log.Printf("[10s]TX: %dbps", s.in10.bandwidthTx)
+// at returns the i-th latest sample, 0 being the latest. Must hold s.mu.
+func (s *Stat) at(i int) sample {
+	return s.samples[(s.next-1-i+2*len(s.samples))%len(s.samples)]
+}
+
+// Close stops sampling and detaches s from its parent. Counts added after
+// are still added to the parents.
+func (s *Stat) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	children := s.children
+	s.children = nil
+	s.mu.Unlock()
+	for c := range children {
+		c.Close()
+	}
+	if s.done != nil {
+		close(s.done)
+	}
+	if p := s.parent; p != nil {
+		p.mu.Lock()
+		delete(p.children, s)
+		p.mu.Unlock()
 	}
 }
 
+// Rx returns the number of bits received.
+func (s *Stat) Rx() uint64 { return atomic.LoadUint64(&s.rx) }
+
+// Tx returns the number of bits sent.
+func (s *Stat) Tx() uint64 { return atomic.LoadUint64(&s.tx) }
+
 func (s *Stat) AddRx(len uint64) {
-	s.Rx += len
+	for ; s != nil; s = s.parent {
+		atomic.AddUint64(&s.rx, len)
+	}
 }
 
 func (s *Stat) AddTx(len uint64) {
-	s.Tx += len
+	for ; s != nil; s = s.parent {
+		atomic.AddUint64(&s.tx, len)
+	}
 }
 
-func (s *Stat) Bandwidth1() (r, t uint64, lastTime time.Time) {
-	r = s.in1.bandwidthRx
-	t = s.in1.bandwidthTx
-	lastTime = s.in1.t
+// Bandwidth returns the bandwidth in bit/s over the window, rounded up to
+// a multiple of the interval and limited by the history, ending at the
+// latest sample taken at lastTime.
+func (s *Stat) Bandwidth(window time.Duration) (r, t uint64, lastTime time.Time) {
+	n := int((window + s.interval - 1) / s.interval)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > s.count-1 {
+		n = s.count - 1
+	}
+	last := s.at(0)
+	if n < 1 {
+		return 0, 0, last.t
+	}
+	r, t = perSecond(s.at(n), last)
+	return r, t, last.t
+}
+
+// perSecond returns the rates between two samples.
+func perSecond(first, last sample) (r, t uint64) {
+	d := last.t.Sub(first.t).Seconds()
+	if d <= 0 {
+		return 0, 0
+	}
+	if last.rx >= first.rx {
+		r = uint64(float64(last.rx-first.rx) / d)
+	}
+	if last.tx >= first.tx {
+		t = uint64(float64(last.tx-first.tx) / d)
+	}
 	return
 }
 
+// Bandwidth1 returns the bandwidth over the last second.
+func (s *Stat) Bandwidth1() (r, t uint64, lastTime time.Time) {
+	return s.Bandwidth(time.Second)
+}
+
+// Bandwidth10 returns the bandwidth over the last 10 seconds.
 func (s *Stat) Bandwidth10() (r, t uint64, lastTime time.Time) {
-	r = s.in10.bandwidthRx
-	t = s.in10.bandwidthTx
-	lastTime = s.in10.t
-	return
+	return s.Bandwidth(10 * time.Second)
+}
+
+// History returns the bandwidth of each interval in the history, oldest
+// first, e.g. to draw a graph.
+func (s *Stat) History() []Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := make([]Sample, 0, s.count)
+	for i := s.count - 2; i >= 0; i-- {
+		last := s.at(i)
+		r, t := perSecond(s.at(i+1), last)
+		h = append(h, Sample{Time: last.t, Rx: r, Tx: t})
+	}
+	return h
 }
 
+// Reset zeroes the counts of s, but not of its parents, and clears the
+// history.
 func (s *Stat) Reset() {
-	s.Rx = 0
-	s.Tx = 0
-	s.in1.Reset()
-	s.in10.Reset()
+	s.mu.Lock()
+	atomic.StoreUint64(&s.rx, 0)
+	atomic.StoreUint64(&s.tx, 0)
+	s.next, s.count = 0, 0
+	s.mu.Unlock()
+	s.record(time.Now())
 }
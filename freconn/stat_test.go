@@ -0,0 +1,167 @@
+package freconn
+
+import (
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// sampledStat returns a Stat keeping n samples every second, sampled by
+// hand: rates[i] bit/s are received, and twice as much sent, in the i-th
+// second after t0.
+func sampledStat(n int, rates []uint64) *Stat {
+	s := newStat(nil, time.Second, n)
+	s.next, s.count = 0, 0
+	s.record(t0)
+	for i, r := range rates {
+		s.AddRx(r)
+		s.AddTx(2 * r)
+		s.record(t0.Add(time.Duration(i+1) * time.Second))
+	}
+	return s
+}
+
+func TestStatBandwidth(t *testing.T) {
+	// The ring of 5 samples keeps the last 4 seconds: 300, 400, 500 and 600.
+	s := sampledStat(5, []uint64{100, 200, 300, 400, 500, 600})
+	tests := []struct {
+		window time.Duration
+		rx     uint64
+	}{
+		{0, 0},
+		{time.Second, 600},
+		{1500 * time.Millisecond, 550}, // rounded up to 2s
+		{2 * time.Second, 550},
+		{3 * time.Second, 500},
+		{4 * time.Second, 450},
+		{time.Minute, 450}, // limited by the history
+	}
+	for _, tt := range tests {
+		r, tx, last := s.Bandwidth(tt.window)
+		if r != tt.rx || tx != 2*tt.rx {
+			t.Errorf("Bandwidth(%v) = %d, %d, want %d, %d", tt.window, r, tx, tt.rx, 2*tt.rx)
+		}
+		if want := t0.Add(6 * time.Second); !last.Equal(want) {
+			t.Errorf("Bandwidth(%v) ends at %v, want %v", tt.window, last, want)
+		}
+	}
+	if s.Rx() != 2100 || s.Tx() != 4200 {
+		t.Errorf("counts are %d, %d, want 2100, 4200", s.Rx(), s.Tx())
+	}
+}
+
+func TestStatHistory(t *testing.T) {
+	tests := []struct {
+		n     int
+		rates []uint64
+		want  []uint64
+	}{
+		{5, nil, []uint64{}},
+		{5, []uint64{100}, []uint64{100}},
+		{5, []uint64{100, 200, 300, 400}, []uint64{100, 200, 300, 400}},
+		{5, []uint64{100, 200, 300, 400, 500, 600}, []uint64{300, 400, 500, 600}},
+		{2, []uint64{100, 200, 300}, []uint64{300}},
+	}
+	for _, tt := range tests {
+		h := sampledStat(tt.n, tt.rates).History()
+		if len(h) != len(tt.want) {
+			t.Errorf("%d samples of %v: got %d intervals, want %d", tt.n, tt.rates, len(h), len(tt.want))
+			continue
+		}
+		for i, smp := range h {
+			at := t0.Add(time.Duration(len(tt.rates)-len(h)+i+1) * time.Second)
+			if smp.Rx != tt.want[i] || smp.Tx != 2*tt.want[i] || !smp.Time.Equal(at) {
+				t.Errorf("%d samples of %v: interval %d is %+v, want %d at %v", tt.n, tt.rates, i, smp, tt.want[i], at)
+			}
+		}
+	}
+}
+
+func TestStatReset(t *testing.T) {
+	parent := sampledStat(5, nil)
+	s := parent.NewChild()
+	s.AddRx(100)
+	s.AddTx(200)
+	s.record(time.Now().Add(time.Second))
+	s.Reset()
+	if s.Rx() != 0 || s.Tx() != 0 {
+		t.Errorf("counts are %d, %d after Reset", s.Rx(), s.Tx())
+	}
+	if h := s.History(); len(h) != 0 {
+		t.Errorf("History() = %v after Reset", h)
+	}
+	if r, tx, _ := s.Bandwidth(time.Minute); r != 0 || tx != 0 {
+		t.Errorf("Bandwidth() = %d, %d after Reset", r, tx)
+	}
+	if parent.Rx() != 100 || parent.Tx() != 200 {
+		t.Errorf("parent counts are %d, %d after Reset of a child, want 100, 200", parent.Rx(), parent.Tx())
+	}
+}
+
+func TestStatChildHistory(t *testing.T) {
+	parent := newStat(nil, time.Second, DefaultHistory)
+	tests := []struct {
+		child *Stat
+		n     int
+	}{
+		{parent.NewChild(), DefaultHistory},
+		{parent.NewChildHistory(11), 11},
+		{parent.NewChildHistory(0), 2},
+	}
+	for _, tt := range tests {
+		if n := len(tt.child.samples); n != tt.n {
+			t.Errorf("child keeps %d samples, want %d", n, tt.n)
+		}
+	}
+	c := UpgradeConn(nil)
+	c.EnableConnStat(parent)
+	if n := len(c.Stat.samples); n != connHistory {
+		t.Errorf("connection keeps %d samples, want %d", n, connHistory)
+	}
+}
+
+func TestStatClose(t *testing.T) {
+	const interval = 5 * time.Millisecond
+	s := NewStatHistory(interval, 1000)
+	child := s.NewChild()
+	closed := s.NewChild()
+	closed.Close()
+
+	time.Sleep(20 * interval)
+	s.mu.Lock()
+	sampled := s.count
+	s.mu.Unlock()
+	if sampled < 5 {
+		t.Fatalf("%d samples taken in %v every %v", sampled, 20*interval, interval)
+	}
+	if got := len(child.History()); got < sampled-2 {
+		t.Errorf("child has %d intervals, want about %d like its parent", got, sampled-1)
+	}
+	if got := len(closed.History()); got != 0 {
+		t.Errorf("closed child has %d intervals, want 0", got)
+	}
+	closed.AddRx(8)
+	if s.Rx() != 8 {
+		t.Errorf("parent counted %d bits added to a closed child, want 8", s.Rx())
+	}
+
+	s.Close()
+	s.Close() // no-op
+	s.mu.Lock()
+	sampled = s.count
+	s.mu.Unlock()
+	n := len(child.History())
+	time.Sleep(10 * interval)
+	s.mu.Lock()
+	if s.count != sampled {
+		t.Errorf("sampled %d times after Close", s.count-sampled)
+	}
+	s.mu.Unlock()
+	if len(child.History()) != n {
+		t.Error("child sampled after its parent was closed")
+	}
+	if s.children != nil {
+		t.Error("closed Stat still has children")
+	}
+}
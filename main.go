@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -15,7 +16,9 @@ import (
 	"time"
 
 	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/shadowsocks/go-shadowsocks2/ssurl"
 )
 
 var config struct {
@@ -34,143 +37,405 @@ func logf(f string, v ...interface{}) {
 func main() {
 
 	var flags struct {
-		Client    string
-		Server    string
-		Cipher    string
-		Key       string
-		Password  string
-		Keygen    int
-		Socks     string
-		RedirTCP  string
-		RedirTCP6 string
-		TCPTun    string
-		UDPTun    string
-		UDPSocks  bool
+		Client     string
+		Server     string
+		Cipher     string
+		Key        string
+		Password   string
+		Keygen     int
+		GenURL     string
+		Socks      string
+		RedirTCP   string
+		RedirTCP6  string
+		TCPTun     string
+		UDPTun     string
+		UDPSocks   bool
+		ReplayCap  int
+		ReplayFPR  float64
+		Users      string
+		Config     string
+		Plugin     string
+		PluginOpts string
+		TLSCert    string
+		TLSKey     string
+		Proxy      string
+		Fallback   string
+		ProbeTime  time.Duration
+		SocksUser  string
+		SocksPass  string
+		SocksReply bool
+		Download   int64
+		Upload     int64
+		Metrics    string
+		Manager    string
+		MgrRemote  bool
+		Drain      time.Duration
 	}
 
+	flag.StringVar(&flags.Config, "config", "", "JSON or YAML configuration file, instead of the flags below")
 	flag.BoolVar(&config.Verbose, "verbose", false, "verbose mode")
 	flag.StringVar(&flags.Cipher, "cipher", "AEAD_CHACHA20_POLY1305", "available ciphers: "+strings.Join(core.ListCipher(), " "))
 	flag.StringVar(&flags.Key, "key", "", "base64url-encoded key (derive from password if empty)")
-	flag.IntVar(&flags.Keygen, "keygen", 0, "generate a base64url-encoded random key of given length in byte")
+	flag.IntVar(&flags.Keygen, "keygen", 0, "generate a base64url-encoded random key of given length in byte, or with -cipher a random password for it (a base64-encoded key for 2022 ciphers)")
+	flag.StringVar(&flags.GenURL, "genurl", "", "print an ss:// URL of the server at this address with -cipher and -password (random if empty)")
 	flag.StringVar(&flags.Password, "password", "", "password")
-	flag.StringVar(&flags.Server, "s", "", "server listen address or url")
+	flag.StringVar(&flags.Server, "s", "", "server listen address or url, or ws:// or wss://host:port/path for WebSocket clients")
 	flag.StringVar(&flags.Client, "c", "", "client connect address or url")
+	flag.StringVar(&flags.Plugin, "plugin", "", "SIP003 plugin carrying TCP traffic between client and server, e.g. obfs-local or obfs-server")
+	flag.StringVar(&flags.PluginOpts, "plugin-opts", "", "options passed to the plugin, e.g. obfs=http")
 	flag.StringVar(&flags.Socks, "socks", "", "(client-only) SOCKS listen address")
+	flag.StringVar(&flags.SocksUser, "socksuser", "", "(client-only) require SOCKS clients to authenticate with this username")
+	flag.StringVar(&flags.SocksPass, "sockspass", "", "(client-only) password of -socksuser")
+	flag.BoolVar(&flags.SocksReply, "socksreply", false, "(client-only) reply to SOCKS clients once the server reached the target, and allow BIND; requires a server of this program")
 	flag.BoolVar(&flags.UDPSocks, "u", false, "(client-only) Enable UDP support for SOCKS")
 	flag.StringVar(&flags.RedirTCP, "redir", "", "(client-only) redirect TCP from this address")
 	flag.StringVar(&flags.RedirTCP6, "redir6", "", "(client-only) redirect TCP IPv6 from this address")
 	flag.StringVar(&flags.TCPTun, "tcptun", "", "(client-only) TCP tunnel (laddr1=raddr1,laddr2=raddr2,...)")
 	flag.StringVar(&flags.UDPTun, "udptun", "", "(client-only) UDP tunnel (laddr1=raddr1,laddr2=raddr2,...)")
 	flag.DurationVar(&config.UDPTimeout, "udptimeout", 5*time.Minute, "UDP tunnel timeout")
+	flag.DurationVar(&flags.Drain, "drain", 5*time.Second, "time for connections to finish on shutdown before they are closed")
+	flag.StringVar(&flags.TLSCert, "tls-cert", "", "(server-only) PEM certificate file of a wss:// server")
+	flag.StringVar(&flags.TLSKey, "tls-key", "", "(server-only) PEM private key file of a wss:// server")
+	flag.StringVar(&flags.Proxy, "proxy", "", "(server-only) reach targets through this upstream SOCKS5 proxy, socks5://[username:password@]host:port")
+	flag.StringVar(&flags.Fallback, "fallback", "", "(server-only) forward connections failing authentication to this address, e.g. a local web server")
+	flag.DurationVar(&flags.ProbeTime, "probe-timeout", 0, "(server-only) otherwise read connections failing authentication until a random time up to this, instead of closing them at once")
+	flag.StringVar(&flags.Manager, "manager", "", "(server-only) serve the ss-manager API on this UDP address or unix socket path, adding servers with -cipher, -proxy, -fallback and -probe-timeout")
+	flag.BoolVar(&flags.MgrRemote, "manager-allow-remote", false, "(server-only) allow -manager on a UDP address other than loopback, letting other hosts add servers")
+	flag.StringVar(&flags.Users, "users", "", "(server-only) JSON file of users with their own ciphers and keys on the same port")
+	flag.IntVar(&flags.ReplayCap, "replaycap", 1e6, "(server-only) salts remembered by each Bloom filter of the replay filter, 0 to disable")
+	flag.Float64Var(&flags.ReplayFPR, "replayfpr", 1e-6, "(server-only) false positive rate of the replay filter")
+	flag.Int64Var(&flags.Download, "download", 0, "(server-only) limit the bandwidth to all users in bit/s, 0 for unlimited")
+	flag.Int64Var(&flags.Upload, "upload", 0, "(server-only) limit the bandwidth from all users in bit/s, 0 for unlimited")
+	flag.StringVar(&flags.Metrics, "metrics", "", "serve Prometheus metrics at http://this address/metrics")
 	flag.Parse()
 
 	if flags.Keygen > 0 {
+		cipherSet := false
+		flag.Visit(func(f *flag.Flag) { cipherSet = cipherSet || f.Name == "cipher" })
+		if cipherSet {
+			pw, err := core.RandomPassword(flags.Cipher)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(pw)
+			return
+		}
 		key := make([]byte, flags.Keygen)
 		io.ReadFull(rand.Reader, key)
 		fmt.Println(base64.URLEncoding.EncodeToString(key))
 		return
 	}
 
-	if flags.Client == "" && flags.Server == "" {
-		flag.Usage()
+	if flags.GenURL != "" {
+		u := &ssurl.URL{
+			Cipher:     flags.Cipher,
+			Password:   flags.Password,
+			Host:       flags.GenURL,
+			Plugin:     flags.Plugin,
+			PluginOpts: flags.PluginOpts,
+		}
+		if u.Password == "" {
+			var err error
+			if u.Password, err = core.RandomPassword(u.Cipher); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if _, err := core.PickCipher(u.Cipher, nil, u.Password); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(u)
 		return
 	}
 
-	var key []byte
-	if flags.Key != "" {
-		k, err := base64.URLEncoding.DecodeString(flags.Key)
-		if err != nil {
+	var cfg *fileConfig
+	if flags.Config != "" {
+		var err error
+		if cfg, err = loadConfig(flags.Config); err != nil {
 			log.Fatal(err)
 		}
-		key = k
-	}
+	} else {
+		if flags.Client == "" && flags.Server == "" && flags.Manager == "" {
+			flag.Usage()
+			return
+		}
 
-	if flags.Client != "" { // client mode
-		addr := flags.Client
-		cipher := flags.Cipher
-		password := flags.Password
-		var err error
+		cfg = &fileConfig{
+			UDPTimeout:   duration(config.UDPTimeout),
+			DrainTimeout: duration(flags.Drain),
+			ReplayFilter: replayConfig{Disabled: flags.ReplayCap <= 0, Capacity: flags.ReplayCap, FPR: flags.ReplayFPR},
+			RateLimit:    rateConfig{Download: flags.Download, Upload: flags.Upload},
+			Metrics:      flags.Metrics,
+			Manager: managerConfig{Listen: flags.Manager, Cipher: flags.Cipher, AllowRemote: flags.MgrRemote,
+				Proxy: flags.Proxy, Fallback: flags.Fallback, ProbeTimeout: duration(flags.ProbeTime)},
+		}
+		cc := cipherConfig{Cipher: flags.Cipher, Key: flags.Key, Password: flags.Password}
+		pc := pluginConfig{Plugin: flags.Plugin, PluginOpts: flags.PluginOpts}
 
-		if strings.HasPrefix(addr, "ss://") {
-			addr, cipher, password, err = parseURL(addr)
-			if err != nil {
-				log.Fatal(err)
+		if flags.Client != "" { // client mode
+			client := clientConfig{
+				Server:       flags.Client,
+				cipherConfig: cc,
+				pluginConfig: pc,
+				Socks:        flags.Socks,
+				SocksUser:    flags.SocksUser,
+				SocksPass:    flags.SocksPass,
+				SocksReply:   flags.SocksReply,
+				UDPSocks:     flags.UDPSocks,
+				Redir:        flags.RedirTCP,
+				Redir6:       flags.RedirTCP6,
+			}
+			if strings.HasPrefix(flags.Client, "ss://") {
+				var err error
+				if client.Server, client.cipherConfig, err = parseURL(flags.Client, &client.pluginConfig); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if flags.UDPTun != "" {
+				tuns, err := parseTunnels(flags.UDPTun)
+				if err != nil {
+					log.Fatal(err)
+				}
+				client.UDPTunnels = tuns
+			}
+			if flags.TCPTun != "" {
+				tuns, err := parseTunnels(flags.TCPTun)
+				if err != nil {
+					log.Fatal(err)
+				}
+				client.TCPTunnels = tuns
 			}
+			cfg.Clients = append(cfg.Clients, client)
 		}
 
-		ciph, err := core.PickCipher(cipher, key, password)
-		if err != nil {
+		if flags.Server != "" { // server mode
+			server := serverConfig{
+				Listen:       flags.Server,
+				cipherConfig: cc,
+				pluginConfig: pc,
+				TLSCert:      flags.TLSCert,
+				TLSKey:       flags.TLSKey,
+				Proxy:        flags.Proxy,
+				Fallback:     flags.Fallback,
+				ProbeTimeout: duration(flags.ProbeTime),
+			}
+			if strings.HasPrefix(flags.Server, "ss://") {
+				var err error
+				if server.Listen, server.cipherConfig, err = parseURL(flags.Server, &server.pluginConfig); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if flags.Users != "" {
+				users, err := loadUsers(flags.Users)
+				if err != nil {
+					log.Fatal(err)
+				}
+				server.cipherConfig = cipherConfig{}
+				server.Users = users
+			}
+			cfg.Servers = append(cfg.Servers, server)
+		}
+
+		if err := cfg.validate(); err != nil {
 			log.Fatal(err)
 		}
+	}
 
-		if flags.UDPTun != "" {
-			for _, tun := range strings.Split(flags.UDPTun, ",") {
-				p := strings.Split(tun, "=")
-				go udpLocal(p[0], addr, p[1], ciph.PacketConn)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := start(ctx, cfg); err != nil {
+		stopPlugins()
+		log.Fatal(err)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := <-sigCh; sig == syscall.SIGHUP; sig = <-sigCh {
+		if flags.Config == "" {
+			logf("no configuration file to reload")
+			continue
+		}
+		logf("reloading %s", flags.Config)
+		cfg = reload(flags.Config, cfg)
+	}
+	cancel()
+	drain, stop := context.WithTimeout(context.Background(), time.Duration(cfg.DrainTimeout))
+	go func() {
+		for sig := range sigCh {
+			if sig != syscall.SIGHUP { // a second signal closes the connections at once
+				stop()
+				return
 			}
 		}
+	}()
+	logf("shutting down, draining %d connections", activeConns.len())
+	drained, killed := activeConns.drain(drain)
+	stop()
+	logf("%d connections drained, %d closed", drained, killed)
+	stopPlugins()
+}
 
-		if flags.TCPTun != "" {
-			for _, tun := range strings.Split(flags.TCPTun, ",") {
-				p := strings.Split(tun, "=")
-				go tcpTun(p[0], addr, p[1], ciph.StreamConn)
-			}
+// start applies the settings of cfg and starts its clients and servers,
+// which stop once ctx is done.
+func start(ctx context.Context, cfg *fileConfig) error {
+	config.Verbose = config.Verbose || cfg.Log.Verbose
+	config.UDPTimeout = time.Duration(cfg.UDPTimeout)
+	if cfg.Log.File != "" {
+		f, err := os.OpenFile(cfg.Log.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
 		}
+		logger.SetOutput(f)
+	}
 
-		if flags.Socks != "" {
-			socks.UDPEnabled = flags.UDPSocks
-			go socksLocal(flags.Socks, addr, ciph.StreamConn)
-			if flags.UDPSocks {
-				go udpSocksLocal(flags.Socks, addr, ciph.PacketConn)
-			}
+	if cfg.Metrics != "" {
+		if err := serveMetrics(ctx, cfg.Metrics); err != nil {
+			return err
+		}
+	}
+
+	if n := cfg.Buffers.AEADPayloadSize; n > 0 {
+		core.SetAeadPayloadSize(n)
+	}
+	if n := cfg.Buffers.PacketConnSize; n > 0 {
+		core.SetPacketConnBufferSize(n)
+	}
+	if n := cfg.Buffers.StreamSize; n > 0 {
+		core.SetStreamBufferSize(n)
+	}
+
+	running.ctx = ctx
+	running.servers = make(map[string]*serverUnit)
+	for _, cc := range cfg.Clients {
+		cu, err := runClient(ctx, cc)
+		if err != nil {
+			return err
 		}
+		running.clients = append(running.clients, cu)
+	}
 
-		if flags.RedirTCP != "" {
-			go redirLocal(flags.RedirTCP, addr, ciph.StreamConn)
+	servers := len(cfg.Servers) > 0 || cfg.Manager.Listen != ""
+	if servers && !cfg.ReplayFilter.Disabled {
+		rf := shadowaead.NewReplayFilter(cfg.ReplayFilter.Capacity, cfg.ReplayFilter.FPR)
+		core.SetReplayFilter(rf)
+		go logReplays(rf, time.Minute)
+	}
+	globalLimit.set(cfg.RateLimit)
+	for _, sc := range cfg.Servers {
+		su, err := runServer(ctx, sc)
+		if err != nil {
+			return err
 		}
+		running.servers[sc.Listen] = su
+	}
+	if cfg.Manager.Listen != "" {
+		if err := startManager(ctx, cfg.Manager); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		if flags.RedirTCP6 != "" {
-			go redir6Local(flags.RedirTCP6, addr, ciph.StreamConn)
+// startClient starts the listeners of cc, which stop with u.
+func startClient(u *unit, cc clientConfig) error {
+	ciph, err := cc.pick()
+	if err != nil {
+		return err
+	}
+	addr, udpAddr := cc.Server, cc.Server
+	if cc.Plugin != "" { // TCP goes through the plugin, UDP directly to the server
+		if addr, err = u.startPlugin(cc.Plugin, cc.PluginOpts, cc.Server); err != nil {
+			return err
 		}
 	}
 
-	if flags.Server != "" { // server mode
-		addr := flags.Server
-		cipher := flags.Cipher
-		password := flags.Password
-		var err error
+	for _, tun := range cc.UDPTunnels {
+		tun := tun
+		u.listen(func() { udpLocal(u.ctx, tun.Listen, udpAddr, tun.Target, ciph.PacketConn) })
+	}
 
-		if strings.HasPrefix(addr, "ss://") {
-			addr, cipher, password, err = parseURL(addr)
+	for _, tun := range cc.TCPTunnels {
+		tun := tun
+		u.listen(func() { tcpTun(u.ctx, tun.Listen, addr, tun.Target, ciph.StreamConn) })
+	}
+
+	if cc.Socks != "" {
+		var auth socks.Auth
+		var udpClients *socks.UDPClients
+		if cc.SocksUser != "" {
+			auth = socks.UserPassAuth(cc.SocksUser, cc.SocksPass)
+			udpClients = socks.NewUDPClients()
+		}
+		u.listen(func() {
+			socksLocal(u.ctx, cc.Socks, addr, ciph.StreamConn, auth, cc.UDPSocks, udpClients, cc.SocksReply)
+		})
+		if cc.UDPSocks {
+			u.listen(func() { udpSocksLocal(u.ctx, cc.Socks, udpAddr, ciph.PacketConn, udpClients) })
+		}
+	}
+
+	if cc.Redir != "" {
+		u.listen(func() { redirLocal(u.ctx, cc.Redir, addr, ciph.StreamConn) })
+	}
+
+	if cc.Redir6 != "" {
+		u.listen(func() { redir6Local(u.ctx, cc.Redir6, addr, ciph.StreamConn) })
+	}
+	return nil
+}
+
+// startServer starts the listeners of sc serving ut, which stop with u.
+func startServer(u *unit, sc serverConfig, ut *userTable) error {
+	out, err := newOutbound(sc.Proxy)
+	if err != nil {
+		return err
+	}
+	metrics.addServer(sc.Listen, ut)
+
+	if isWebSocket(sc.Listen) {
+		var tlsConfig *tls.Config
+		if sc.TLSCert != "" {
+			cert, err := tls.LoadX509KeyPair(sc.TLSCert, sc.TLSKey)
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
+			tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 		}
+		u.listen(func() { wsRemote(u.ctx, sc.Listen, tlsConfig, ut, out) })
+		return nil
+	}
 
-		ciph, err := core.PickCipher(cipher, key, password)
-		if err != nil {
-			log.Fatal(err)
+	addr := sc.Listen
+	if sc.Plugin != "" { // the plugin listens on sc.Listen for TCP and passes it on to addr
+		if addr, err = u.startPlugin(sc.Plugin, sc.PluginOpts, sc.Listen); err != nil {
+			return err
 		}
-
-		go udpRemote(addr, ciph.PacketConn)
-		go tcpRemote(addr, ciph.StreamConn)
 	}
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	u.listen(func() { udpRemote(u.ctx, sc.Listen, ut, out) })
+	probe := probeDefense{sc.Fallback, time.Duration(sc.ProbeTimeout)}
+	u.listen(func() { tcpRemote(u.ctx, addr, ut, out, probe) })
+	return nil
 }
 
-func parseURL(s string) (addr, cipher, password string, err error) {
-	u, err := url.Parse(s)
+// logReplays logs the counters of rf every interval if replays were rejected since last time.
+func logReplays(rf *shadowaead.ReplayFilter, interval time.Duration) {
+	var last uint64
+	for range time.Tick(interval) {
+		if n := rf.Replayed(); n != last {
+			logf("replay filter: %d salts checked, %d replays rejected", rf.Checked(), n)
+			last = n
+		}
+	}
+}
+
+// parseURL returns the address and cipher of an ss:// URL. The plugin of
+// the URL, if any, replaces pc.
+func parseURL(s string, pc *pluginConfig) (addr string, cc cipherConfig, err error) {
+	u, err := ssurl.Parse(s)
 	if err != nil {
 		return
 	}
-
-	addr = u.Host
-	if u.User != nil {
-		cipher = u.User.Username()
-		password, _ = u.User.Password()
+	if u.Plugin != "" {
+		*pc = pluginConfig{Plugin: u.Plugin, PluginOpts: u.PluginOpts}
 	}
-	return
+	return u.Host, cipherConfig{Cipher: u.Cipher, Password: u.Password}, nil
 }
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manager serves the manager protocol of shadowsocks-libev on a UDP or unix
+// datagram socket. "add: {...}" starts a server on a port and "remove: {...}"
+// stops it and closes its connections, both answered with "ok" or "err", and
+// "ping" is answered with the traffic of every port in bytes as
+// `stat: {"8001":1234}`. Servers given otherwise are not affected.
+type manager struct {
+	ctx   context.Context
+	pc    net.PacketConn
+	cfg   managerConfig // of the servers added, with cfg.Cipher unless requests give a method
+	out   outbound
+	probe probeDefense
+
+	sync.Mutex
+	servers map[int]*managedServer
+}
+
+type managedServer struct {
+	users *userTable
+	tcp   net.Listener
+	udp   net.PacketConn
+	stop  context.CancelFunc
+	conns *connSet
+}
+
+// managerRequest is the argument of add and remove.
+type managerRequest struct {
+	ServerPort json.Number `json:"server_port"`
+	Password   string      `json:"password"`
+	Method     string      `json:"method"`
+}
+
+// startManager serves the manager protocol on cfg.Listen, a host:port for
+// UDP or the path of a unix datagram socket, until ctx is done.
+func startManager(ctx context.Context, cfg managerConfig) error {
+	addr, network := cfg.Listen, "udp"
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		network = "unixgram"
+		os.Remove(addr) // left by a previous run
+	}
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return err
+	}
+	m, err := newManager(ctx, pc, cfg)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	closeWhenDone(ctx, pc)
+	logf("manager listening on %s", addr)
+	go m.serve()
+	return nil
+}
+
+// newManager returns a manager answering requests read from pc.
+func newManager(ctx context.Context, pc net.PacketConn, cfg managerConfig) (*manager, error) {
+	out, err := newOutbound(cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	return &manager{ctx: ctx, pc: pc, cfg: cfg, out: out, probe: probeDefense{cfg.Fallback, time.Duration(cfg.ProbeTimeout)},
+		servers: make(map[int]*managedServer)}, nil
+}
+
+func (m *manager) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := m.pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			if m.ctx.Err() == nil {
+				logf("manager: %v", err)
+			}
+			return
+		}
+		reply := m.handle(string(buf[:n]))
+		if _, err := m.pc.WriteTo([]byte(reply), addr); err != nil {
+			logf("manager: failed to reply to %v: %v", addr, err)
+		}
+	}
+}
+
+// handle returns the reply to req.
+func (m *manager) handle(req string) string {
+	req = strings.TrimRight(req, "\x00\r\n ")
+	cmd, arg := req, ""
+	if i := strings.IndexByte(req, ':'); i >= 0 {
+		cmd, arg = req[:i], req[i+1:]
+	}
+	switch cmd = strings.TrimSpace(cmd); cmd {
+	case "ping":
+		return "stat: " + m.stat()
+	case "add", "remove":
+		var r managerRequest
+		if err := json.Unmarshal([]byte(arg), &r); err != nil {
+			logf("manager: invalid %s request %q: %v", cmd, arg, err)
+			return "err"
+		}
+		port, err := strconv.Atoi(string(r.ServerPort))
+		if err != nil || port <= 0 || port > 65535 {
+			logf("manager: invalid server_port %q", r.ServerPort)
+			return "err"
+		}
+		if cmd == "add" {
+			err = m.add(port, r.Method, r.Password)
+		} else {
+			err = m.remove(port)
+		}
+		if err != nil {
+			logf("manager: failed to %s port %d: %v", cmd, port, err)
+			return "err"
+		}
+		return "ok"
+	}
+	logf("manager: unknown request %q", req)
+	return "err"
+}
+
+// add starts a server on port with the cipher method and password.
+func (m *manager) add(port int, method, password string) error {
+	if password == "" {
+		return errors.New("missing password")
+	}
+	if method == "" {
+		method = m.cfg.Cipher
+	}
+	uc := userConfig{Cipher: method, Password: password, limitConfig: m.cfg.limitConfig}
+	u, err := uc.newUser()
+	if err != nil {
+		return err
+	}
+	users, err := newUserTable([]*user{u})
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.servers[port] != nil {
+		return errors.New("port already added")
+	}
+	addr := fmt.Sprintf(":%d", port)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	ctx, stop := context.WithCancel(m.ctx)
+	closeWhenDone(ctx, l)
+	closeWhenDone(ctx, pc)
+	s := &managedServer{users: users, tcp: l, udp: pc, stop: stop, conns: newConnSet()}
+	m.servers[port] = s
+	metrics.addServer(addr, users)
+	go tcpServe(s.conns.listener(activeConns.listener(l)), users, m.out, m.probe)
+	go udpServe(users.PacketConn(pc), 0, m.out)
+	logf("manager: added port %d", port)
+	return nil
+}
+
+// remove stops the server on port and closes its connections.
+func (m *manager) remove(port int) error {
+	m.Lock()
+	s := m.servers[port]
+	delete(m.servers, port)
+	m.Unlock()
+	if s == nil {
+		return errors.New("no such port")
+	}
+	s.stop()
+	s.tcp.Close() // now, not to accept any more
+	s.udp.Close()
+	n := s.conns.closeAll()
+	metrics.removeServer(s.users)
+	logf("manager: removed port %d, closed %d connections", port, n)
+	return nil
+}
+
+// stat returns the traffic of every port as a JSON object.
+func (m *manager) stat() string {
+	m.Lock()
+	traffic := make(map[string]uint64, len(m.servers))
+	for port, s := range m.servers {
+		rx, tx := s.users.list()[0].Traffic()
+		traffic[strconv.Itoa(port)] = rx + tx
+	}
+	m.Unlock()
+	b, _ := json.Marshal(traffic)
+	return string(b)
+}
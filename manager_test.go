@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func TestManagerListen(t *testing.T) {
+	tests := []struct {
+		listen string
+		remote bool
+		ok     bool
+	}{
+		{"127.0.0.1:6001", false, true},
+		{"[::1]:6001", false, true},
+		{"localhost:6001", false, true},
+		{"/tmp/manager.sock", false, true},
+		{":6001", false, false},
+		{"0.0.0.0:6001", false, false},
+		{"192.0.2.1:6001", false, false},
+		{"0.0.0.0:6001", true, true},
+	}
+	for _, tt := range tests {
+		cfg := &fileConfig{Manager: managerConfig{Listen: tt.listen, AllowRemote: tt.remote}}
+		if err := cfg.validate(); (err == nil) != tt.ok {
+			t.Errorf("manager on %s, allow_remote %v: got error %v, want ok %v", tt.listen, tt.remote, err, tt.ok)
+		}
+	}
+}
+
+// udpEcho echoes UDP packets until closed.
+func udpEcho(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestManagerRemoveClosesUDP(t *testing.T) {
+	defer func(d time.Duration) { config.UDPTimeout = d }(config.UDPTimeout)
+	config.UDPTimeout = time.Minute
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	m, err := newManager(context.Background(), nil, managerConfig{Cipher: "AEAD_CHACHA20_POLY1305"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	req := fmt.Sprintf(`{"server_port": %d, "password": "secret"}`, port)
+	if reply := m.handle("add: " + req); reply != "ok" {
+		t.Fatalf("add replied %q", reply)
+	}
+	u := m.servers[port].users.list()[0]
+
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	cpc := ciph.PacketConn(pc)
+	tgt := socks.ParseAddr(echo.LocalAddr().String())
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	if _, err := cpc.WriteTo(append(append([]byte{}, tgt...), "ping"...), server); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	n, _, err := cpc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(append([]byte{}, tgt...), "ping"...); !bytes.Equal(buf[:n], want) {
+		t.Fatalf("got %q, want %q", buf[:n], want)
+	}
+	if n := atomic.LoadInt64(&u.udp); n != 1 {
+		t.Fatalf("%d UDP sessions, want 1", n)
+	}
+	if reply := m.handle("ping"); !strings.Contains(reply, fmt.Sprintf(`"%d":`, port)) {
+		t.Errorf("ping replied %q without port %d", reply, port)
+	}
+
+	if reply := m.handle("remove: " + req); reply != "ok" {
+		t.Fatalf("remove replied %q", reply)
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt64(&u.udp) != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("UDP session still open after the port was removed")
+		}
+	}
+	if reply := m.handle("remove: " + req); reply != "err" {
+		t.Errorf("removing the port again replied %q", reply)
+	}
+}
+
+func TestManagerServerOptions(t *testing.T) {
+	fallback, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fallback.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		c, err := fallback.Accept()
+		if err != nil {
+			close(got)
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 100)
+		n, _ := io.ReadFull(c, b)
+		got <- b[:n]
+	}()
+
+	cfg := managerConfig{Cipher: "AEAD_CHACHA20_POLY1305", Fallback: fallback.Addr().String()}
+	cfg.RateLimit.Download = 8000
+	m, err := newManager(context.Background(), nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	req := fmt.Sprintf(`{"server_port": %d, "password": "secret"}`, port)
+	if reply := m.handle("add: " + req); reply != "ok" {
+		t.Fatalf("add replied %q", reply)
+	}
+	defer m.handle("remove: " + req)
+	if r, _ := m.servers[port].users.list()[0].limit.down.Rate(); r != 8000 {
+		t.Errorf("the user of the port is limited to %d bit/s, want 8000", r)
+	}
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	probe := make([]byte, 100)
+	rand.Read(probe)
+	c.Write(probe)
+	select {
+	case b := <-got:
+		if !bytes.Equal(b, probe) {
+			t.Errorf("the fallback got %d bytes differing from the %d sent", len(b), len(probe))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the probe was not forwarded to the fallback")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dialBuckets are the upper bounds in seconds of the dial latency histograms.
+var dialBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts durations into dialBuckets. It is safe for concurrent use.
+type histogram struct {
+	sum    uint64   // nanoseconds, atomic, first for 64-bit alignment
+	counts []uint64 // per bucket, the last one for +Inf
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(dialBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(dialBuckets, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+// clientMetrics are the metrics of the clients of a server.
+type clientMetrics struct {
+	rx, tx    uint64 // bytes from and to the server, first for 64-bit alignment
+	dialFails uint64
+	conns     int64 // active TCP connections
+	udp       int64 // active UDP NAT entries
+	dial      *histogram
+}
+
+// conn counts c as active and its traffic, until Close.
+func (m *clientMetrics) conn(c net.Conn) net.Conn {
+	atomic.AddInt64(&m.conns, 1)
+	return &meteredConn{Conn: c, rx: &m.rx, tx: &m.tx, active: &m.conns}
+}
+
+// packetConn counts pc as a NAT entry and its traffic, until Close.
+func (m *clientMetrics) packetConn(pc net.PacketConn) net.PacketConn {
+	atomic.AddInt64(&m.udp, 1)
+	return &meteredPacketConn{PacketConn: pc, rx: &m.rx, tx: &m.tx, active: &m.udp}
+}
+
+// dialServer dials the server timing it.
+func (m *clientMetrics) dialServer(server string) (net.Conn, error) {
+	start := time.Now()
+	c, err := net.Dial("tcp", server)
+	if err != nil {
+		atomic.AddUint64(&m.dialFails, 1)
+		return nil, err
+	}
+	m.dial.observe(time.Since(start))
+	return c, nil
+}
+
+// registry holds everything exposed by the metrics listener.
+type registry struct {
+	targetDialFails uint64 // atomic, first for 64-bit alignment
+	targetDial      *histogram
+
+	sync.Mutex
+	servers []metricsServer
+	clients map[string]*clientMetrics
+}
+
+type metricsServer struct {
+	listen string
+	users  *userTable
+}
+
+var metrics = &registry{targetDial: newHistogram(), clients: make(map[string]*clientMetrics)}
+
+func (r *registry) addServer(listen string, users *userTable) {
+	r.Lock()
+	defer r.Unlock()
+	r.servers = append(r.servers, metricsServer{listen, users})
+}
+
+func (r *registry) removeServer(users *userTable) {
+	r.Lock()
+	defer r.Unlock()
+	for i, s := range r.servers {
+		if s.users == users {
+			r.servers = append(r.servers[:i], r.servers[i+1:]...)
+			return
+		}
+	}
+}
+
+// client returns the metrics of the clients of server.
+func (r *registry) client(server string) *clientMetrics {
+	r.Lock()
+	defer r.Unlock()
+	m := r.clients[server]
+	if m == nil {
+		m = &clientMetrics{dial: newHistogram()}
+		r.clients[server] = m
+	}
+	return m
+}
+
+// dialTarget dials addr through out timing it.
+func (r *registry) dialTarget(out outbound, addr string) (net.Conn, error) {
+	start := time.Now()
+	c, err := out.Dial("tcp", addr)
+	if err != nil {
+		atomic.AddUint64(&r.targetDialFails, 1)
+		return nil, err
+	}
+	r.targetDial.observe(time.Since(start))
+	return c, nil
+}
+
+// serveMetrics serves the metrics at /metrics of addr until ctx is done.
+func serveMetrics(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	closeWhenDone(ctx, l)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	logf("serving metrics on http://%s/metrics", l.Addr())
+	go func() {
+		if err := http.Serve(l, mux); err != nil && ctx.Err() == nil {
+			logf("failed to serve metrics: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (r *registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	r.write(bw)
+	bw.Flush()
+}
+
+// write writes the metrics in the Prometheus text format.
+func (r *registry) write(w io.Writer) {
+	r.Lock()
+	servers := append([]metricsServer(nil), r.servers...)
+	names := make([]string, 0, len(r.clients))
+	for s := range r.clients {
+		names = append(names, s)
+	}
+	sort.Strings(names)
+	clients := make([]*clientMetrics, len(names))
+	for i, s := range names {
+		clients[i] = r.clients[s]
+	}
+	r.Unlock()
+
+	e := &encoder{w: w}
+	perUser := func(name, typ, help string, value func(u *user) float64) {
+		if len(servers) == 0 {
+			return
+		}
+		e.family(name, typ, help)
+		for _, s := range servers {
+			for _, u := range s.users.list() {
+				e.sample(name, value(u), "server", s.listen, "user", u.Name)
+			}
+		}
+	}
+	perUser("shadowsocks_server_tcp_connections", "gauge", "Active TCP connections of users.",
+		func(u *user) float64 { return float64(atomic.LoadInt64(&u.conns)) })
+	perUser("shadowsocks_server_udp_sessions", "gauge", "Active UDP NAT entries of users.",
+		func(u *user) float64 { return float64(atomic.LoadInt64(&u.udp)) })
+	perUser("shadowsocks_server_received_bytes_total", "counter", "Bytes received from users.",
+		func(u *user) float64 { rx, _ := u.Traffic(); return float64(rx) })
+	perUser("shadowsocks_server_sent_bytes_total", "counter", "Bytes sent to users.",
+		func(u *user) float64 { _, tx := u.Traffic(); return float64(tx) })
+	perUser("shadowsocks_server_handshake_failures_total", "counter",
+		"Streams of users whose target address could not be read, and packets that failed to decrypt.",
+		func(u *user) float64 { return float64(atomic.LoadUint64(&u.fails)) })
+	if len(servers) > 0 {
+		name := "shadowsocks_server_key_connections_total"
+		e.family(name, "counter", "TCP connections authenticated by each key of users, primary or retiring.")
+		for _, s := range servers {
+			for _, u := range s.users.list() {
+				for _, k := range s.users.keysOf(u) {
+					e.sample(name, float64(atomic.LoadUint64(&k.streams)), "server", s.listen, "user", u.Name, "key", k.name)
+				}
+			}
+		}
+		name = "shadowsocks_server_unknown_user_total"
+		e.family(name, "counter", "Streams and packets authenticated by no user.")
+		for _, s := range servers {
+			e.sample(name, float64(atomic.LoadUint64(&s.users.unknownStreams)), "server", s.listen, "network", "tcp")
+			e.sample(name, float64(atomic.LoadUint64(&s.users.unknownPackets)), "server", s.listen, "network", "udp")
+		}
+		e.histogram("shadowsocks_server_target_dial_duration_seconds", "Time to connect to TCP targets.", r.targetDial)
+		e.family("shadowsocks_server_target_dial_failures_total", "counter", "Failed connections to TCP targets.")
+		e.sample("shadowsocks_server_target_dial_failures_total", float64(atomic.LoadUint64(&r.targetDialFails)))
+	}
+
+	perClient := func(name, typ, help string, value func(m *clientMetrics) float64) {
+		if len(names) == 0 {
+			return
+		}
+		e.family(name, typ, help)
+		for i, s := range names {
+			e.sample(name, value(clients[i]), "server", s)
+		}
+	}
+	perClient("shadowsocks_client_tcp_connections", "gauge", "Active TCP connections to the server.",
+		func(m *clientMetrics) float64 { return float64(atomic.LoadInt64(&m.conns)) })
+	perClient("shadowsocks_client_udp_sessions", "gauge", "Active UDP NAT entries to the server.",
+		func(m *clientMetrics) float64 { return float64(atomic.LoadInt64(&m.udp)) })
+	perClient("shadowsocks_client_received_bytes_total", "counter", "Bytes received from the server.",
+		func(m *clientMetrics) float64 { return float64(atomic.LoadUint64(&m.rx)) })
+	perClient("shadowsocks_client_sent_bytes_total", "counter", "Bytes sent to the server.",
+		func(m *clientMetrics) float64 { return float64(atomic.LoadUint64(&m.tx)) })
+	perClient("shadowsocks_client_dial_failures_total", "counter", "Failed connections to the server.",
+		func(m *clientMetrics) float64 { return float64(atomic.LoadUint64(&m.dialFails)) })
+	if len(names) > 0 {
+		name := "shadowsocks_client_dial_duration_seconds"
+		e.family(name, "histogram", "Time to connect to the server.")
+		for i, s := range names {
+			e.buckets(name, clients[i].dial, "server", s)
+		}
+	}
+}
+
+// encoder writes samples in the Prometheus text format.
+type encoder struct {
+	w io.Writer
+}
+
+func (e *encoder) family(name, typ, help string) {
+	fmt.Fprintf(e.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sample writes a sample with labels given as name, value pairs.
+func (e *encoder) sample(name string, v float64, labels ...string) {
+	io.WriteString(e.w, name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		sep := ","
+		if i == 0 {
+			sep = "{"
+		}
+		fmt.Fprintf(e.w, `%s%s="%s"`, sep, labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	if len(labels) > 0 {
+		io.WriteString(e.w, "}")
+	}
+	fmt.Fprintf(e.w, " %s\n", strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+func (e *encoder) histogram(name, help string, h *histogram, labels ...string) {
+	e.family(name, "histogram", help)
+	e.buckets(name, h, labels...)
+}
+
+// buckets writes the samples of h, cumulative as Prometheus wants them.
+func (e *encoder) buckets(name string, h *histogram, labels ...string) {
+	var n uint64
+	for i := range h.counts {
+		n += atomic.LoadUint64(&h.counts[i])
+		le := "+Inf"
+		if i < len(dialBuckets) {
+			le = strconv.FormatFloat(dialBuckets[i], 'g', -1, 64)
+		}
+		e.sample(name+"_bucket", float64(n), append(labels[:len(labels):len(labels)], "le", le)...)
+	}
+	e.sample(name+"_sum", time.Duration(atomic.LoadUint64(&h.sum)).Seconds(), labels...)
+	e.sample(name+"_count", float64(n), labels...)
+}
+
+// meteredConn counts its traffic into rx and tx, and decrements active once
+// closed.
+type meteredConn struct {
+	net.Conn
+	rx, tx *uint64
+	active *int64
+	once   sync.Once
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(c.rx, uint64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(c.tx, uint64(n))
+	return n, err
+}
+
+func (c *meteredConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(c.active, -1) })
+	return c.Conn.Close()
+}
+
+// meteredPacketConn is a meteredConn for packets. A nil rx and tx count
+// nothing.
+type meteredPacketConn struct {
+	net.PacketConn
+	rx, tx *uint64
+	active *int64
+	once   sync.Once
+}
+
+func (c *meteredPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if c.rx != nil {
+		atomic.AddUint64(c.rx, uint64(n))
+	}
+	return n, addr, err
+}
+
+func (c *meteredPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if c.tx != nil {
+		atomic.AddUint64(c.tx, uint64(n))
+	}
+	return n, err
+}
+
+func (c *meteredPacketConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(c.active, -1) })
+	return c.PacketConn.Close()
+}
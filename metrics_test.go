@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	alice, err := (&userConfig{Name: "alice", Cipher: "AEAD_CHACHA20_POLY1305", Password: "a",
+		RetiringKeys: []retiringKeyConfig{{Password: "old", Expires: time.Now().Add(time.Hour)}}}).newUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := (&userConfig{Name: "bo\"b\\", Cipher: "AEAD_CHACHA20_POLY1305", Password: "b"}).newUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut, err := newUserTable([]*user{alice, bob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.conns, alice.udp, alice.rx, alice.tx, alice.fails = 2, 1, 100, 200, 3
+	alice.keys[0].streams, alice.keys[1].streams = 7, 1
+	ut.unknownStreams, ut.unknownPackets = 4, 5
+
+	r := &registry{targetDial: newHistogram(), clients: make(map[string]*clientMetrics)}
+	r.addServer("127.0.0.1:8488", ut)
+	r.targetDial.observe(3 * time.Millisecond)
+	r.targetDial.observe(10 * time.Millisecond) // buckets include their upper bound
+	r.targetDial.observe(20 * time.Second)
+	r.targetDialFails = 6
+	m := r.client("example.com:8488")
+	m.conns, m.udp, m.rx, m.tx, m.dialFails = 1, 2, 10, 20, 1
+	m.dial.observe(75 * time.Millisecond)
+
+	var b bytes.Buffer
+	r.write(&b)
+	if got := b.String(); got != wantMetrics {
+		t.Errorf("got\n%s\nwant\n%s", got, wantMetrics)
+	}
+
+	b.Reset()
+	(&registry{targetDial: newHistogram(), clients: make(map[string]*clientMetrics)}).write(&b)
+	if b.Len() != 0 {
+		t.Errorf("empty registry wrote\n%s", b.String())
+	}
+}
+
+const wantMetrics = `# HELP shadowsocks_server_tcp_connections Active TCP connections of users.
+# TYPE shadowsocks_server_tcp_connections gauge
+shadowsocks_server_tcp_connections{server="127.0.0.1:8488",user="alice"} 2
+shadowsocks_server_tcp_connections{server="127.0.0.1:8488",user="bo\"b\\"} 0
+# HELP shadowsocks_server_udp_sessions Active UDP NAT entries of users.
+# TYPE shadowsocks_server_udp_sessions gauge
+shadowsocks_server_udp_sessions{server="127.0.0.1:8488",user="alice"} 1
+shadowsocks_server_udp_sessions{server="127.0.0.1:8488",user="bo\"b\\"} 0
+# HELP shadowsocks_server_received_bytes_total Bytes received from users.
+# TYPE shadowsocks_server_received_bytes_total counter
+shadowsocks_server_received_bytes_total{server="127.0.0.1:8488",user="alice"} 100
+shadowsocks_server_received_bytes_total{server="127.0.0.1:8488",user="bo\"b\\"} 0
+# HELP shadowsocks_server_sent_bytes_total Bytes sent to users.
+# TYPE shadowsocks_server_sent_bytes_total counter
+shadowsocks_server_sent_bytes_total{server="127.0.0.1:8488",user="alice"} 200
+shadowsocks_server_sent_bytes_total{server="127.0.0.1:8488",user="bo\"b\\"} 0
+# HELP shadowsocks_server_handshake_failures_total Streams of users whose target address could not be read, and packets that failed to decrypt.
+# TYPE shadowsocks_server_handshake_failures_total counter
+shadowsocks_server_handshake_failures_total{server="127.0.0.1:8488",user="alice"} 3
+shadowsocks_server_handshake_failures_total{server="127.0.0.1:8488",user="bo\"b\\"} 0
+# HELP shadowsocks_server_key_connections_total TCP connections authenticated by each key of users, primary or retiring.
+# TYPE shadowsocks_server_key_connections_total counter
+shadowsocks_server_key_connections_total{server="127.0.0.1:8488",user="alice",key="primary"} 7
+shadowsocks_server_key_connections_total{server="127.0.0.1:8488",user="alice",key="retiring-1"} 1
+shadowsocks_server_key_connections_total{server="127.0.0.1:8488",user="bo\"b\\",key="primary"} 0
+# HELP shadowsocks_server_unknown_user_total Streams and packets authenticated by no user.
+# TYPE shadowsocks_server_unknown_user_total counter
+shadowsocks_server_unknown_user_total{server="127.0.0.1:8488",network="tcp"} 4
+shadowsocks_server_unknown_user_total{server="127.0.0.1:8488",network="udp"} 5
+# HELP shadowsocks_server_target_dial_duration_seconds Time to connect to TCP targets.
+# TYPE shadowsocks_server_target_dial_duration_seconds histogram
+shadowsocks_server_target_dial_duration_seconds_bucket{le="0.005"} 1
+shadowsocks_server_target_dial_duration_seconds_bucket{le="0.01"} 2
+shadowsocks_server_target_dial_duration_seconds_bucket{le="0.025"} 2
+shadowsocks_server_target_dial_duration_seconds_bucket{le="0.05"} 2
+shadowsocks_server_target_dial_duration_seconds_bucket{le="0.1"} 2
+shadowsocks_server_target_dial_duration_seconds_bucket{le="0.25"} 2
+shadowsocks_server_target_dial_duration_seconds_bucket{le="0.5"} 2
+shadowsocks_server_target_dial_duration_seconds_bucket{le="1"} 2
+shadowsocks_server_target_dial_duration_seconds_bucket{le="2.5"} 2
+shadowsocks_server_target_dial_duration_seconds_bucket{le="5"} 2
+shadowsocks_server_target_dial_duration_seconds_bucket{le="10"} 2
+shadowsocks_server_target_dial_duration_seconds_bucket{le="+Inf"} 3
+shadowsocks_server_target_dial_duration_seconds_sum 20.013
+shadowsocks_server_target_dial_duration_seconds_count 3
+# HELP shadowsocks_server_target_dial_failures_total Failed connections to TCP targets.
+# TYPE shadowsocks_server_target_dial_failures_total counter
+shadowsocks_server_target_dial_failures_total 6
+# HELP shadowsocks_client_tcp_connections Active TCP connections to the server.
+# TYPE shadowsocks_client_tcp_connections gauge
+shadowsocks_client_tcp_connections{server="example.com:8488"} 1
+# HELP shadowsocks_client_udp_sessions Active UDP NAT entries to the server.
+# TYPE shadowsocks_client_udp_sessions gauge
+shadowsocks_client_udp_sessions{server="example.com:8488"} 2
+# HELP shadowsocks_client_received_bytes_total Bytes received from the server.
+# TYPE shadowsocks_client_received_bytes_total counter
+shadowsocks_client_received_bytes_total{server="example.com:8488"} 10
+# HELP shadowsocks_client_sent_bytes_total Bytes sent to the server.
+# TYPE shadowsocks_client_sent_bytes_total counter
+shadowsocks_client_sent_bytes_total{server="example.com:8488"} 20
+# HELP shadowsocks_client_dial_failures_total Failed connections to the server.
+# TYPE shadowsocks_client_dial_failures_total counter
+shadowsocks_client_dial_failures_total{server="example.com:8488"} 1
+# HELP shadowsocks_client_dial_duration_seconds Time to connect to the server.
+# TYPE shadowsocks_client_dial_duration_seconds histogram
+shadowsocks_client_dial_duration_seconds_bucket{server="example.com:8488",le="0.005"} 0
+shadowsocks_client_dial_duration_seconds_bucket{server="example.com:8488",le="0.01"} 0
+shadowsocks_client_dial_duration_seconds_bucket{server="example.com:8488",le="0.025"} 0
+shadowsocks_client_dial_duration_seconds_bucket{server="example.com:8488",le="0.05"} 0
+shadowsocks_client_dial_duration_seconds_bucket{server="example.com:8488",le="0.1"} 1
+shadowsocks_client_dial_duration_seconds_bucket{server="example.com:8488",le="0.25"} 1
+shadowsocks_client_dial_duration_seconds_bucket{server="example.com:8488",le="0.5"} 1
+shadowsocks_client_dial_duration_seconds_bucket{server="example.com:8488",le="1"} 1
+shadowsocks_client_dial_duration_seconds_bucket{server="example.com:8488",le="2.5"} 1
+shadowsocks_client_dial_duration_seconds_bucket{server="example.com:8488",le="5"} 1
+shadowsocks_client_dial_duration_seconds_bucket{server="example.com:8488",le="10"} 1
+shadowsocks_client_dial_duration_seconds_bucket{server="example.com:8488",le="+Inf"} 1
+shadowsocks_client_dial_duration_seconds_sum{server="example.com:8488"} 0.075
+shadowsocks_client_dial_duration_seconds_count{server="example.com:8488"} 1
+`
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// outbound connects a server to targets.
+type outbound interface {
+	Dial(network, addr string) (net.Conn, error)
+	ListenPacket(network, addr string) (net.PacketConn, error)
+}
+
+// direct connects to targets directly.
+type direct struct{}
+
+func (direct) Dial(network, addr string) (net.Conn, error) { return net.Dial(network, addr) }
+
+func (direct) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return net.ListenPacket(network, addr)
+}
+
+// newOutbound returns the outbound connecting through proxy, a
+// socks5://[username:password@]host:port URL, or directly if empty.
+func newOutbound(proxy string) (outbound, error) {
+	if proxy == "" {
+		return direct{}, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" || u.Host == "" {
+		return nil, errors.New("proxy must be a socks5:// URL")
+	}
+	d := &socks.Dialer{Proxy: u.Host}
+	if u.User != nil {
+		d.Username = u.User.Username()
+		d.Password, _ = u.User.Password()
+	}
+	return d, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	pluginStopTimeout = 5 * time.Second
+	pluginMaxBackoff  = time.Minute
+)
+
+// plugin supervises a SIP003 plugin process. The plugin carries TCP traffic
+// between its local end, where shadowsocks listens or connects, and its
+// remote end facing the network.
+type plugin struct {
+	name string
+	env  []string
+
+	sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+	exited  chan struct{} // closed when the current process exits
+}
+
+var plugins struct {
+	sync.Mutex
+	list []*plugin
+}
+
+// startPlugin starts the plugin name with opts between remote and a free
+// loopback address, which it returns. It restarts the plugin whenever it exits.
+func startPlugin(name, opts, remote string) (*plugin, string, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, "", err
+	}
+	remoteHost, remotePort, err := net.SplitHostPort(remote)
+	if err != nil {
+		return nil, "", err
+	}
+	if remoteHost == "" {
+		remoteHost = "0.0.0.0"
+	}
+	local, err := freeLoopbackAddr()
+	if err != nil {
+		return nil, "", err
+	}
+	localHost, localPort, _ := net.SplitHostPort(local)
+
+	p := &plugin{
+		name: name,
+		env: append(os.Environ(),
+			"SS_REMOTE_HOST="+remoteHost,
+			"SS_REMOTE_PORT="+remotePort,
+			"SS_LOCAL_HOST="+localHost,
+			"SS_LOCAL_PORT="+localPort,
+			"SS_PLUGIN_OPTIONS="+opts,
+		),
+	}
+	if err := p.run(); err != nil {
+		return nil, "", err
+	}
+	go p.supervise()
+
+	plugins.Lock()
+	plugins.list = append(plugins.list, p)
+	plugins.Unlock()
+	logf("plugin %s started: %s <-> %s", name, local, remote)
+	return p, local, nil
+}
+
+// freeLoopbackAddr returns a loopback TCP address nobody listens on at the moment.
+func freeLoopbackAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+func (p *plugin) run() error {
+	cmd := exec.Command(p.name)
+	cmd.Env = p.env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	p.Lock()
+	defer p.Unlock()
+	if p.stopped { // stopped while starting
+		cmd.Process.Kill()
+	}
+	p.cmd, p.exited = cmd, exited
+	return nil
+}
+
+// supervise restarts the plugin whenever it exits until it is stopped,
+// backing off exponentially while it keeps failing right after starting.
+func (p *plugin) supervise() {
+	backoff := time.Second
+	for {
+		p.Lock()
+		cmd, exited := p.cmd, p.exited
+		p.Unlock()
+		started := time.Now()
+		<-exited
+		if p.isStopped() {
+			return
+		}
+
+		if time.Since(started) > pluginMaxBackoff {
+			backoff = time.Second
+		}
+		logf("plugin %s exited (%v), restarting in %v", p.name, cmd.ProcessState, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > pluginMaxBackoff {
+			backoff = pluginMaxBackoff
+		}
+		if p.isStopped() {
+			return
+		}
+		if err := p.run(); err != nil {
+			logf("plugin %s: %v", p.name, err)
+			p.Lock()
+			p.exited = closedChan // try again after backing off
+			p.Unlock()
+		}
+	}
+}
+
+func (p *plugin) isStopped() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.stopped
+}
+
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// Stop terminates the plugin, killing it if it does not exit in time.
+func (p *plugin) Stop() {
+	p.Lock()
+	p.stopped = true
+	cmd, exited := p.cmd, p.exited
+	p.Unlock()
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		cmd.Process.Kill()
+	}
+	select {
+	case <-exited:
+	case <-time.After(pluginStopTimeout):
+		logf("plugin %s did not exit in %v, killing it", p.name, pluginStopTimeout)
+		cmd.Process.Kill()
+		<-exited
+	}
+}
+
+// stopPlugin stops p and forgets it.
+func stopPlugin(p *plugin) {
+	plugins.Lock()
+	for i, q := range plugins.list {
+		if q == p {
+			plugins.list = append(plugins.list[:i], plugins.list[i+1:]...)
+			break
+		}
+	}
+	plugins.Unlock()
+	p.Stop()
+}
+
+// stopPlugins stops all plugins started so far.
+func stopPlugins() {
+	plugins.Lock()
+	list := plugins.list
+	plugins.list = nil
+	plugins.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range list {
+		wg.Add(1)
+		go func(p *plugin) {
+			defer wg.Done()
+			p.Stop()
+		}(p)
+	}
+	wg.Wait()
+}
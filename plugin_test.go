@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+var plugintestBuild struct {
+	sync.Once
+	path string
+	err  error
+}
+
+// plugintestPath builds the plugintest stub plugin and returns its path.
+func plugintestPath(t *testing.T) string {
+	b := &plugintestBuild
+	b.Do(func() {
+		dir, err := ioutil.TempDir("", "plugintest")
+		if err != nil {
+			b.err = err
+			return
+		}
+		b.path = filepath.Join(dir, "plugintest")
+		out, err := exec.Command(filepath.Join(runtime.GOROOT(), "bin", "go"), "build", "-o", b.path, "./plugintest").CombinedOutput()
+		if err != nil {
+			b.err = err
+			os.Stderr.Write(out)
+		}
+	})
+	if b.err != nil {
+		t.Fatalf("failed to build plugintest: %v", b.err)
+	}
+	return b.path
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if b := &plugintestBuild; b.path != "" {
+		os.RemoveAll(filepath.Dir(b.path))
+	}
+	os.Exit(code)
+}
+
+// startTestPlugin starts plugintest as a server plugin with opts, returning
+// the address it forwards to and the address it listens on once it does.
+func startTestPlugin(t *testing.T, opts string) (p *plugin, local, remote string) {
+	remote, err := freeLoopbackAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, local, err = startPlugin(plugintestPath(t), "server;"+opts, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitListening(t, remote)
+	return p, local, remote
+}
+
+func waitListening(t *testing.T, addr string) {
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing listens on %s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (p *plugin) current() *exec.Cmd {
+	p.Lock()
+	defer p.Unlock()
+	return p.cmd
+}
+
+func TestStartPlugin(t *testing.T) {
+	p, local, remote := startTestPlugin(t, "xor=0x21")
+	defer stopPlugin(p)
+
+	l, err := net.Listen("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b := make([]byte, 5)
+		io.ReadFull(c, b)
+		got <- b
+		c.Write(b)
+	}()
+
+	c, err := net.Dial("tcp", remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("read %q back, want %q", b, "hello")
+	}
+	want := []byte{'h' ^ 0x21, 'e' ^ 0x21, 'l' ^ 0x21, 'l' ^ 0x21, 'o' ^ 0x21}
+	if b := <-got; string(b) != string(want) {
+		t.Errorf("local end got %x, want %x as SS_PLUGIN_OPTIONS set xor=0x21", b, want)
+	}
+}
+
+func TestPluginRestart(t *testing.T) {
+	t.Parallel()
+	p, _, remote := startTestPlugin(t, "exit=1")
+	defer stopPlugin(p)
+
+	// Each run lasts a second, after which the plugin is restarted in 1s, then 2s.
+	cmd, last := p.current(), time.Now()
+	var gaps []time.Duration
+	for deadline := time.Now().Add(15 * time.Second); len(gaps) < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("plugin restarted %d times, want 2", len(gaps))
+		}
+		if next := p.current(); next != cmd {
+			if next.Process.Pid == cmd.Process.Pid {
+				t.Fatal("restarted plugin has the same pid")
+			}
+			cmd = next
+			gaps = append(gaps, time.Since(last))
+			last = time.Now()
+		}
+	}
+	if gaps[0] < 1900*time.Millisecond || gaps[1] < 2900*time.Millisecond || gaps[1] < gaps[0]+500*time.Millisecond {
+		t.Errorf("plugin restarted after %v then %v, want the backoff to double from 1s", gaps[0], gaps[1])
+	}
+	waitListening(t, remote)
+}
+
+func TestPluginStop(t *testing.T) {
+	t.Parallel()
+	p, _, _ := startTestPlugin(t, "")
+	cmd := p.current()
+
+	start := time.Now()
+	stopPlugin(p)
+	if d := time.Since(start); d >= pluginStopTimeout {
+		t.Errorf("Stop took %v, want the plugin to exit on SIGTERM", d)
+	}
+	if !cmd.ProcessState.Success() {
+		t.Errorf("plugin exited with %v, want it to handle SIGTERM", cmd.ProcessState)
+	}
+
+	plugins.Lock()
+	for _, q := range plugins.list {
+		if q == p {
+			t.Error("stopped plugin is still listed")
+		}
+	}
+	plugins.Unlock()
+
+	time.Sleep(1500 * time.Millisecond) // longer than the first backoff
+	if p.current() != cmd {
+		t.Error("stopped plugin was restarted")
+	}
+}
+
+func TestPluginStopKills(t *testing.T) {
+	t.Parallel()
+	p, _, _ := startTestPlugin(t, "noterm")
+	cmd := p.current()
+
+	start := time.Now()
+	stopPlugin(p)
+	if d := time.Since(start); d < pluginStopTimeout {
+		t.Errorf("Stop took %v, want it to wait %v before killing", d, pluginStopTimeout)
+	}
+	if cmd.ProcessState.Success() {
+		t.Errorf("plugin exited with %v, want it killed", cmd.ProcessState)
+	}
+	if p.current() != cmd {
+		t.Error("stopped plugin was restarted")
+	}
+}
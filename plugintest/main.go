@@ -0,0 +1,104 @@
+// Command plugintest is a stub SIP003 plugin for testing plugin support. It
+// relays TCP between SS_LOCAL_HOST:SS_LOCAL_PORT and SS_REMOTE_HOST:SS_REMOTE_PORT,
+// XORing the traffic between the client and server plugins with a byte so
+// that it only works when both ends go through it.
+//
+// SS_PLUGIN_OPTIONS is a list of options separated by semicolons: "server"
+// makes it the server plugin, "xor=N" sets the byte (default 0x55),
+// "exit=S" makes it exit after S seconds to test restarts and "noterm" makes
+// it ignore SIGTERM to test killing it.
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	server, noterm := false, false
+	key := byte(0x55)
+	for _, opt := range strings.Split(os.Getenv("SS_PLUGIN_OPTIONS"), ";") {
+		kv := strings.SplitN(opt, "=", 2)
+		switch kv[0] {
+		case "server":
+			server = true
+		case "xor":
+			n, err := strconv.ParseUint(kv[1], 0, 8)
+			if err != nil {
+				log.Fatal(err)
+			}
+			key = byte(n)
+		case "exit":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil {
+				log.Fatal(err)
+			}
+			time.AfterFunc(time.Duration(n)*time.Second, func() { os.Exit(1) })
+		case "noterm":
+			noterm = true
+		}
+	}
+
+	local := net.JoinHostPort(os.Getenv("SS_LOCAL_HOST"), os.Getenv("SS_LOCAL_PORT"))
+	remote := net.JoinHostPort(os.Getenv("SS_REMOTE_HOST"), os.Getenv("SS_REMOTE_PORT"))
+	laddr, raddr := local, remote // client: shadowsocks connects to local
+	if server {
+		laddr, raddr = remote, local // server: clients connect to remote
+	}
+
+	sigs := []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	if noterm {
+		signal.Ignore(syscall.SIGTERM)
+		sigs = sigs[:1]
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, sigs...) // before listening, so that signals are handled once it listens
+	go func() {
+		log.Printf("plugintest %d: %v", os.Getpid(), <-sigCh)
+		os.Exit(0)
+	}()
+
+	l, err := net.Listen("tcp", laddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("plugintest %d: %s <-> %s", os.Getpid(), laddr, raddr)
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			defer c.Close()
+			rc, err := net.Dial("tcp", raddr)
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			defer rc.Close()
+			go io.Copy(xorWriter{rc, key}, c)
+			io.Copy(xorWriter{c, key}, rc)
+		}()
+	}
+}
+
+type xorWriter struct {
+	io.Writer
+	key byte
+}
+
+func (w xorWriter) Write(b []byte) (int, error) {
+	x := make([]byte, len(b))
+	for i := range b {
+		x[i] = b[i] ^ w.key
+	}
+	return w.Writer.Write(x)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// probeDefense is what a server does with connections failing authentication,
+// as active probes send: closing them at once tells the server apart from an
+// ordinary service. Their raw bytes are forwarded to fallback if set, or read
+// and discarded for a random time between half and all of timeout. Both
+// unset, they are closed at once.
+type probeDefense struct {
+	fallback string
+	timeout  time.Duration
+}
+
+// guard returns c, recording what is read from it until authenticated if
+// there is a fallback to replay it to.
+func (d probeDefense) guard(c net.Conn) *probeGuard {
+	return &probeGuard{Conn: c, defense: d, record: d.fallback != ""}
+}
+
+// probeGuard is a connection being authenticated. A nil probeGuard closes
+// connections failing authentication at once.
+type probeGuard struct {
+	net.Conn
+	defense probeDefense
+	record  bool
+	read    []byte // raw bytes read so far while recording
+}
+
+func (g *probeGuard) Read(b []byte) (int, error) {
+	n, err := g.Conn.Read(b)
+	if g.record {
+		g.read = append(g.read, b[:n]...)
+	}
+	return n, err
+}
+
+// pass stops recording once the connection is authenticated.
+func (g *probeGuard) pass() {
+	if g != nil {
+		g.record, g.read = false, nil
+	}
+}
+
+// fail handles the connection once its authentication failed, returning
+// when done with it.
+func (g *probeGuard) fail() {
+	if g == nil {
+		return
+	}
+	if g.defense.fallback != "" && g.forward() {
+		return
+	}
+	if t := g.defense.timeout; t > 0 {
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(t/2)+1))
+		g.SetReadDeadline(time.Now().Add(t/2 + time.Duration(n.Int64())))
+		io.Copy(ioutil.Discard, g.Conn)
+	}
+}
+
+// forward relays the connection, from its first byte, to the fallback.
+func (g *probeGuard) forward() bool {
+	rc, err := net.DialTimeout("tcp", g.defense.fallback, 5*time.Second)
+	if err != nil {
+		logf("failed to reach fallback %s: %v", g.defense.fallback, err)
+		return false
+	}
+	defer rc.Close()
+	read := g.read
+	g.record, g.read = false, nil
+	if _, err := rc.Write(read); err != nil {
+		return true
+	}
+	logf("forwarding %s to fallback %s", g.RemoteAddr(), g.defense.fallback)
+	relay(g.Conn, rc)
+	return true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveProbed serves TCP with the users of passwords and probe until the
+// returned listener is closed.
+func serveProbed(t *testing.T, probe probeDefense, passwords ...string) net.Listener {
+	var users []*user
+	for _, pw := range passwords {
+		uc := userConfig{Name: pw, Cipher: "AEAD_CHACHA20_POLY1305", Password: pw}
+		u, err := uc.newUser()
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, u)
+	}
+	ut, err := newUserTable(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tcpServe(l, ut, direct{}, probe)
+	return l
+}
+
+func TestProbeGuardForward(t *testing.T) {
+	probe := make([]byte, 300)
+	rand.Read(probe)
+	for _, passwords := range [][]string{{"a"}, {"a", "b"}} { // no identification, and trying keys
+		fallback, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(chan []byte, 1)
+		go func() {
+			c, err := fallback.Accept()
+			if err != nil {
+				close(got)
+				return
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			b := make([]byte, len(probe))
+			n, _ := io.ReadFull(c, b)
+			got <- b[:n]
+			c.Write([]byte("fallback"))
+		}()
+		l := serveProbed(t, probeDefense{fallback: fallback.Addr().String()}, passwords...)
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write(probe[:100])
+		time.Sleep(20 * time.Millisecond) // the rest arrives once authentication failed
+		c.Write(probe[100:])
+		if b := <-got; !bytes.Equal(b, probe) {
+			t.Errorf("%d users: the fallback got %d bytes differing from the %d sent", len(passwords), len(b), len(probe))
+		}
+		if reply, _ := ioutil.ReadAll(c); string(reply) != "fallback" {
+			t.Errorf("%d users: got %q back, want the reply of the fallback", len(passwords), reply)
+		}
+		c.Close()
+		l.Close()
+		fallback.Close()
+	}
+}
+
+func TestProbeGuardTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	fallback, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback.Close() // unreachable, so the timeout applies
+	l := serveProbed(t, probeDefense{fallback: fallback.Addr().String(), timeout: timeout}, "a")
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	probe := make([]byte, 100)
+	rand.Read(probe)
+	start := time.Now()
+	c.Write(probe)
+	if _, err := ioutil.ReadAll(c); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < timeout/2 || d > 2*timeout {
+		t.Errorf("closed after %v, want between %v and %v", d, timeout/2, timeout)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+)
+
+// unit is a server or client started from the configuration. Stopping it
+// closes its listeners and plugins, while the connections it accepted carry
+// on until they end.
+type unit struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listeners sync.WaitGroup
+	plugins   []*plugin
+}
+
+func newUnit(parent context.Context) *unit {
+	ctx, cancel := context.WithCancel(parent)
+	return &unit{ctx: ctx, cancel: cancel}
+}
+
+// listen runs f, a listener serving until u.ctx is done, in a goroutine.
+func (u *unit) listen(f func()) {
+	u.listeners.Add(1)
+	go func() {
+		defer u.listeners.Done()
+		f()
+	}()
+}
+
+// startPlugin starts a plugin stopped with u, see startPlugin.
+func (u *unit) startPlugin(name, opts, remote string) (string, error) {
+	p, local, err := startPlugin(name, opts, remote)
+	if err != nil {
+		return "", err
+	}
+	u.plugins = append(u.plugins, p)
+	return local, nil
+}
+
+// stop returns once the listeners and plugins of u are closed, so that
+// their addresses can be taken over.
+func (u *unit) stop() {
+	u.cancel()
+	u.listeners.Wait()
+	for _, p := range u.plugins {
+		stopPlugin(p)
+	}
+}
+
+type serverUnit struct {
+	*unit
+	cfg   serverConfig
+	users *userTable
+}
+
+func runServer(ctx context.Context, sc serverConfig) (*serverUnit, error) {
+	users, err := sc.users()
+	if err != nil {
+		return nil, err
+	}
+	ut, err := newUserTable(users)
+	if err != nil {
+		return nil, err
+	}
+	su := &serverUnit{unit: newUnit(ctx), cfg: sc, users: ut}
+	if err := startServer(su.unit, sc, ut); err != nil {
+		su.stop()
+		return nil, err
+	}
+	return su, nil
+}
+
+func (su *serverUnit) stop() {
+	su.unit.stop()
+	metrics.removeServer(su.users)
+}
+
+// setUsers replaces the users of su with those of sc for new connections.
+// Users named as before keep their counters and connections, and take their
+// new keys and rate limits at once, unless another setting of theirs changed.
+func (su *serverUnit) setUsers(sc serverConfig) error {
+	old := make(map[string]*user)
+	oldConfigs := make(map[string]userConfig)
+	users := su.users.list()
+	for i, uc := range su.cfg.userConfigs() {
+		old[uc.Name], oldConfigs[uc.Name] = users[i], uc
+	}
+	users = nil
+	rekeyed := make(map[*user][]*userKey)
+	for _, uc := range sc.userConfigs() {
+		nu, err := uc.newUser()
+		if err != nil {
+			return err
+		}
+		u := old[uc.Name]
+		if u == nil || !sameUser(oldConfigs[uc.Name], uc) {
+			users = append(users, nu)
+			continue
+		}
+		u.limit.set(uc.RateLimit)
+		u.connLimit.set(uc.ConnRateLimit)
+		if keys, changed := rekey(u, su.users.keysOf(u), nu.keys); changed {
+			rekeyed[u] = keys
+		}
+		users = append(users, u)
+	}
+	if err := su.users.set(users, rekeyed); err != nil {
+		return err
+	}
+	su.cfg = sc
+	return nil
+}
+
+// sameUser reports whether a and b differ at most in their keys and rate
+// limits.
+func sameUser(a, b userConfig) bool {
+	a.Cipher, a.Key, a.Password, a.RetiringKeys, a.limitConfig = "", "", "", nil, limitConfig{}
+	b.Cipher, b.Key, b.Password, b.RetiringKeys, b.limitConfig = "", "", "", nil, limitConfig{}
+	return reflect.DeepEqual(a, b)
+}
+
+// rekey returns the keys of u to replace old with next: those configured as
+// before are kept with their counters, the others are given to u. Reports
+// whether they differ from old.
+func rekey(u *user, old, next []*userKey) ([]*userKey, bool) {
+	changed := len(old) != len(next)
+	keys := make([]*userKey, len(next))
+	for i, k := range next {
+		k.user = u
+		for _, o := range old {
+			if o.sameKey(k) {
+				k = o
+				break
+			}
+		}
+		keys[i] = k
+		changed = changed || k != old[i]
+	}
+	return keys, changed
+}
+
+// sameListener reports whether a and b differ at most in their users.
+func sameListener(a, b serverConfig) bool {
+	a.cipherConfig, a.RetiringKeys, a.Users, a.limitConfig = cipherConfig{}, nil, nil, limitConfig{}
+	b.cipherConfig, b.RetiringKeys, b.Users, b.limitConfig = cipherConfig{}, nil, nil, limitConfig{}
+	return reflect.DeepEqual(a, b)
+}
+
+type clientUnit struct {
+	*unit
+	cfg clientConfig
+}
+
+func runClient(ctx context.Context, cc clientConfig) (*clientUnit, error) {
+	cu := &clientUnit{unit: newUnit(ctx), cfg: cc}
+	if err := startClient(cu.unit, cc); err != nil {
+		cu.stop()
+		return nil, err
+	}
+	return cu, nil
+}
+
+// running are the servers, by listen address, and the clients started from
+// the configuration. Only the main goroutine uses it.
+var running struct {
+	ctx     context.Context
+	servers map[string]*serverUnit
+	clients []*clientUnit
+}
+
+// reload applies the configuration in path in place of cfg and returns what
+// was applied: servers and clients whose configuration changed are restarted,
+// servers whose users alone changed take the new users for new connections,
+// and rate_limit and drain_timeout take effect. Connections already accepted
+// are not affected.
+func reload(path string, cfg *fileConfig) *fileConfig {
+	next, err := loadConfig(path)
+	if err != nil {
+		logf("reload: %v", err)
+		return cfg
+	}
+
+	servers := make(map[string]*serverUnit)
+	var newServers []serverConfig
+	for _, sc := range next.Servers {
+		su := running.servers[sc.Listen]
+		if su == nil || !sameListener(su.cfg, sc) {
+			newServers = append(newServers, sc)
+			continue
+		}
+		delete(running.servers, sc.Listen)
+		servers[sc.Listen] = su
+		if !reflect.DeepEqual(su.cfg, sc) {
+			if err := su.setUsers(sc); err != nil {
+				logf("reload: failed to update the users of %s: %v", sc.Listen, err)
+				continue
+			}
+			logf("reload: updated the users of %s", sc.Listen)
+		}
+	}
+	var clients []*clientUnit
+	var newClients []clientConfig
+	for _, cc := range next.Clients {
+		i := 0
+		for i < len(running.clients) && !reflect.DeepEqual(running.clients[i].cfg, cc) {
+			i++
+		}
+		if i == len(running.clients) {
+			newClients = append(newClients, cc)
+			continue
+		}
+		clients = append(clients, running.clients[i])
+		running.clients = append(running.clients[:i], running.clients[i+1:]...)
+	}
+
+	// Stop what is gone first, as what starts may take over its addresses.
+	for _, su := range running.servers {
+		su.stop()
+		logf("reload: stopped server %s", su.cfg.Listen)
+	}
+	for _, cu := range running.clients {
+		cu.stop()
+		logf("reload: stopped client of %s", cu.cfg.Server)
+	}
+	globalLimit.set(next.RateLimit)
+	for _, sc := range newServers {
+		su, err := runServer(running.ctx, sc)
+		if err != nil {
+			logf("reload: failed to start server %s: %v", sc.Listen, err)
+			continue
+		}
+		servers[sc.Listen] = su
+		logf("reload: started server %s", sc.Listen)
+	}
+	for _, cc := range newClients {
+		cu, err := runClient(running.ctx, cc)
+		if err != nil {
+			logf("reload: failed to start client of %s: %v", cc.Server, err)
+			continue
+		}
+		clients = append(clients, cu)
+		logf("reload: started client of %s", cc.Server)
+	}
+	running.servers, running.clients = servers, clients
+
+	applied := *cfg
+	applied.Servers, applied.Clients = next.Servers, next.Clients
+	applied.RateLimit, applied.DrainTimeout = next.RateLimit, next.DrainTimeout
+	if !reflect.DeepEqual(&applied, next) {
+		logf("reload: other settings take effect on restart")
+	}
+	return &applied
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func TestSameListener(t *testing.T) {
+	base := serverConfig{Listen: "127.0.0.1:8488", cipherConfig: cipherConfig{Cipher: "AEAD_CHACHA20_POLY1305", Password: "a"}}
+	tests := []struct {
+		name   string
+		change func(sc *serverConfig)
+		same   bool
+	}{
+		{"nothing", func(sc *serverConfig) {}, true},
+		{"password", func(sc *serverConfig) { sc.Password = "b" }, true},
+		{"cipher", func(sc *serverConfig) { sc.Cipher = "AEAD_AES_256_GCM" }, true},
+		{"retiring keys", func(sc *serverConfig) {
+			sc.RetiringKeys = []retiringKeyConfig{{Password: "b", Expires: time.Now()}}
+		}, true},
+		{"users", func(sc *serverConfig) { sc.Users = []userConfig{{Name: "alice", Password: "a"}} }, true},
+		{"rate limit", func(sc *serverConfig) { sc.RateLimit.Download = 1e6 }, true},
+		{"listen", func(sc *serverConfig) { sc.Listen = "127.0.0.1:8489" }, false},
+		{"plugin", func(sc *serverConfig) { sc.Plugin = "v2ray-plugin" }, false},
+		{"proxy", func(sc *serverConfig) { sc.Proxy = "socks5://127.0.0.1:1080" }, false},
+		{"fallback", func(sc *serverConfig) { sc.Fallback = "127.0.0.1:80" }, false},
+		{"probe timeout", func(sc *serverConfig) { sc.ProbeTimeout = duration(time.Second) }, false},
+	}
+	for _, tt := range tests {
+		sc := base
+		tt.change(&sc)
+		if got := sameListener(base, sc); got != tt.same {
+			t.Errorf("%s changed: sameListener() = %v, want %v", tt.name, got, tt.same)
+		}
+	}
+}
+
+func testUser(name, password string, retiring ...string) userConfig {
+	uc := userConfig{Name: name, Cipher: "AEAD_CHACHA20_POLY1305", Password: password}
+	for _, pw := range retiring {
+		uc.RetiringKeys = append(uc.RetiringKeys, retiringKeyConfig{Password: pw, Expires: time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)})
+	}
+	return uc
+}
+
+func TestSetUsers(t *testing.T) {
+	sc := serverConfig{Listen: "127.0.0.1:8488", Users: []userConfig{
+		testUser("alice", "a"), testUser("bob", "b"), testUser("carol", "c", "c0"),
+	}}
+	users, err := sc.users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut, err := newUserTable(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	su := &serverUnit{cfg: sc, users: ut}
+	alice, bob, carol := users[0], users[1], users[2]
+	alice.acquire()
+	atomic.AddUint64(&alice.rx, 100)
+	aliceKey, carolKeys := alice.keys[0], carol.keys
+
+	next := sc
+	next.Users = []userConfig{
+		testUser("alice", "a1", "a"), // rotated
+		testUser("bob", "b"),
+		testUser("carol", "c", "c0", "c1"), // one more retiring key
+		testUser("dave", "d"),
+	}
+	next.Users[0].RateLimit.Download = 8000
+	next.Users[1].MaxConns = 1
+	if err := su.setUsers(next); err != nil {
+		t.Fatal(err)
+	}
+
+	if u := ut.byName("alice"); u != alice {
+		t.Error("alice was replaced though only her keys changed")
+	} else {
+		if n := atomic.LoadInt64(&u.conns); n != 1 {
+			t.Errorf("alice has %d connections, want 1", n)
+		}
+		if rx, _ := u.Traffic(); rx != 100 {
+			t.Errorf("alice received %d bytes, want 100", rx)
+		}
+		if r, _ := u.limit.down.Rate(); r != 8000 {
+			t.Errorf("alice is limited to %d bit/s, want 8000", r)
+		}
+		keys := ut.keysOf(u)
+		if len(keys) != 2 || keys[0] == aliceKey || keys[0].user != u || keys[1].user != u {
+			t.Errorf("alice has keys %v, want two new ones of hers", keys)
+		}
+	}
+	if u := ut.byName("bob"); u == bob || u.MaxConns != 1 {
+		t.Error("bob was kept though his connection limit changed")
+	}
+	if u := ut.byName("carol"); u != carol {
+		t.Error("carol was replaced though only her keys changed")
+	} else if keys := ut.keysOf(u); len(keys) != 3 || keys[0] != carolKeys[0] || keys[1] != carolKeys[1] {
+		t.Error("keys of carol configured as before were not kept")
+	}
+	if ut.byName("dave") == nil {
+		t.Error("dave was not added")
+	}
+	if n := len(ut.keys); n != 7 {
+		t.Errorf("the table has %d keys, want 7", n)
+	}
+	if su.cfg.Users[0].Password != "a1" {
+		t.Error("the configuration of the server was not updated")
+	}
+
+	// Nothing changed: the keys are kept as they are.
+	keys := ut.keys
+	if err := su.setUsers(next); err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range ut.keys {
+		if k != keys[i] {
+			t.Errorf("key %d replaced though nothing changed", i)
+		}
+	}
+}
+
+// tcpEcho echoes TCP connections until closed.
+func tcpEcho(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+// echoThrough sends a message to the echo server at tgt through the server
+// at addr with password and reports whether it came back.
+func echoThrough(t *testing.T, addr, password, tgt string) bool {
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	sc := ciph.StreamConn(c)
+	if _, err := sc.Write(append(socks.ParseAddr(tgt), "hello"...)); err != nil {
+		return false
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(sc, buf)
+	return err == nil && string(buf) == "hello"
+}
+
+func TestReload(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	listen := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	write := func(users, extra string) {
+		cfg := fmt.Sprintf(`{"servers": [{"listen": %q, "users": [%s]%s}]}`, listen, users, extra)
+		if err := ioutil.WriteFile(path, []byte(cfg), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	running.ctx, running.servers, running.clients = ctx, make(map[string]*serverUnit), nil
+	defer func() {
+		for _, su := range running.servers {
+			su.stop()
+		}
+		running.servers = nil
+	}()
+	write(`{"name": "alice", "cipher": "AEAD_CHACHA20_POLY1305", "password": "a", "max_conns": 2}`, "")
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	su, err := runServer(ctx, cfg.Servers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	running.servers[listen] = su
+	waitListening(t, listen)
+	alice := su.users.byName("alice")
+	if !echoThrough(t, listen, "a", echo.Addr().String()) {
+		t.Fatal("no echo through the server")
+	}
+
+	// Rotating the key of alice keeps the server and alice running.
+	write(`{"name": "alice", "cipher": "AEAD_CHACHA20_POLY1305", "password": "a1", "max_conns": 2,
+		"retiring_keys": [{"password": "a", "expires": "2099-01-01T00:00:00Z"}]}`, "")
+	cfg = reload(path, cfg)
+	if running.servers[listen] != su {
+		t.Fatal("server restarted though only its users changed")
+	}
+	if su.users.byName("alice") != alice {
+		t.Error("alice replaced though only her keys changed")
+	}
+	if rx, _ := alice.Traffic(); rx == 0 {
+		t.Error("traffic of alice reset by the reload")
+	}
+	for _, pw := range []string{"a1", "a"} {
+		if !echoThrough(t, listen, pw, echo.Addr().String()) {
+			t.Errorf("no echo with password %s after the reload", pw)
+		}
+	}
+	for _, k := range su.users.keysOf(alice) {
+		if n := atomic.LoadUint64(&k.streams); n != 1 {
+			t.Errorf("key %s authenticated %d streams, want 1", k.name, n)
+		}
+	}
+
+	// Any other change restarts the server.
+	write(`{"name": "alice", "cipher": "AEAD_CHACHA20_POLY1305", "password": "a1"}`, `, "fallback": "127.0.0.1:1"`)
+	cfg = reload(path, cfg)
+	if running.servers[listen] == su {
+		t.Fatal("server kept though its fallback changed")
+	}
+	waitListening(t, listen)
+	if !echoThrough(t, listen, "a1", echo.Addr().String()) {
+		t.Error("no echo through the restarted server")
+	}
+	if cfg.Servers[0].Fallback != "127.0.0.1:1" {
+		t.Error("reload did not return the configuration applied")
+	}
+}
+
+func TestSetUsersUDPSession(t *testing.T) {
+	defer func(d time.Duration) { config.UDPTimeout = d }(config.UDPTimeout)
+	config.UDPTimeout = time.Minute
+	echo := udpEcho(t)
+	defer echo.Close()
+	tgt := socks.ParseAddr(echo.LocalAddr().String())
+
+	for _, others := range [][]userConfig{nil, {testUser("alice", "a")}} {
+		sc := serverConfig{Users: append(others, testUser("bob", "b1", "b"))}
+		users, err := sc.users()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ut, err := newUserTable(users)
+		if err != nil {
+			t.Fatal(err)
+		}
+		su := &serverUnit{cfg: sc, users: ut}
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		upc := ut.PacketConn(pc)
+		go udpServe(upc, 0, direct{})
+
+		// ping sends a packet from client with the retiring key of bob and
+		// reports whether it came back.
+		ping := func(client net.PacketConn) bool {
+			cpc := testCipher(t, "b").PacketConn(client)
+			if _, err := cpc.WriteTo(append(append([]byte{}, tgt...), "ping"...), pc.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			buf := make([]byte, 2048)
+			n, _, err := cpc.ReadFrom(buf)
+			return err == nil && string(buf[len(tgt):n]) == "ping"
+		}
+		client, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ping(client) {
+			t.Fatalf("%d users: no echo before the reload", len(sc.Users))
+		}
+
+		next := sc
+		next.Users = append(others, testUser("bob", "b1")) // the retiring key is gone
+		if err := su.setUsers(next); err != nil {
+			t.Fatal(err)
+		}
+		if !ping(client) {
+			t.Errorf("%d users: the session of the removed key ended with the reload", len(sc.Users))
+		}
+		if ping(other) {
+			t.Errorf("%d users: a new session was opened with the removed key", len(sc.Users))
+		}
+		upc.Forget(client.LocalAddr()) // as its NAT entry expires
+		if ping(client) {
+			t.Errorf("%d users: the removed key outlived the session", len(sc.Users))
+		}
+		client.Close()
+		other.Close()
+		pc.Close()
+	}
+}
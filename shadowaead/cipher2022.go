@@ -0,0 +1,77 @@
+package shadowaead
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/blake3"
+)
+
+// Cipher2022 is a Cipher of the Shadowsocks 2022 edition (SIP022). Session
+// subkeys are derived with BLAKE3, and packet-oriented connections need
+// additional primitives keyed directly by the pre-shared key.
+type Cipher2022 interface {
+	Cipher
+	// HeaderBlock returns the block cipher protecting the separate header of
+	// each packet, or nil if packets are sealed by PacketAEAD instead.
+	HeaderBlock() cipher.Block
+	// PacketAEAD returns the AEAD sealing whole packets under a random nonce,
+	// or nil if packets are sealed with session subkeys.
+	PacketAEAD() cipher.AEAD
+}
+
+const subkeyContext2022 = "shadowsocks 2022 session subkey"
+
+func blake3DeriveKey(psk, salt, outkey []byte) {
+	material := make([]byte, len(psk)+len(salt))
+	copy(material, psk)
+	copy(material[len(psk):], salt)
+	blake3.DeriveKey(outkey, subkeyContext2022, material)
+}
+
+type metaCipher2022 struct {
+	metaCipher
+	block cipher.Block
+	xaead cipher.AEAD
+}
+
+func (a *metaCipher2022) SaltSize() int { return a.KeySize() }
+func (a *metaCipher2022) Encrypter(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, a.KeySize())
+	blake3DeriveKey(a.psk, salt, subkey)
+	return a.makeAEAD(subkey)
+}
+func (a *metaCipher2022) Decrypter(salt []byte) (cipher.AEAD, error) {
+	return a.Encrypter(salt)
+}
+func (a *metaCipher2022) HeaderBlock() cipher.Block { return a.block }
+func (a *metaCipher2022) PacketAEAD() cipher.AEAD   { return a.xaead }
+
+// Blake3AESGCM creates a new Cipher2022 with a pre-shared key. len(psk) must
+// be one of 16 or 32 to select 2022-blake3-aes-128-gcm or 2022-blake3-aes-256-gcm.
+func Blake3AESGCM(psk []byte) (Cipher2022, error) {
+	switch l := len(psk); l {
+	case 16, 32:
+	default:
+		return nil, aes.KeySizeError(l)
+	}
+	blk, err := aes.NewCipher(psk)
+	if err != nil {
+		return nil, err
+	}
+	return &metaCipher2022{metaCipher: metaCipher{psk: psk, makeAEAD: aesGCM}, block: blk}, nil
+}
+
+// Blake3Chacha20Poly1305 creates a new Cipher2022 with a pre-shared key.
+// len(psk) must be 32. Packets are sealed with XChaCha20-Poly1305.
+func Blake3Chacha20Poly1305(psk []byte) (Cipher2022, error) {
+	if len(psk) != chacha20poly1305.KeySize {
+		return nil, KeySizeError(chacha20poly1305.KeySize)
+	}
+	xaead, err := chacha20poly1305.NewX(psk)
+	if err != nil {
+		return nil, err
+	}
+	return &metaCipher2022{metaCipher: metaCipher{psk: psk, makeAEAD: chacha20poly1305.New}, xaead: xaead}, nil
+}
@@ -0,0 +1,300 @@
+package shadowaead
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func seq(start byte, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = start + byte(i)
+	}
+	return b
+}
+
+// Subkeys are BLAKE3 derive_key("shadowsocks 2022 session subkey", psk || salt),
+// computed independently of lukechampine.com/blake3.
+var subkeyTests = []struct {
+	psk, salt []byte
+	subkey    string
+}{
+	{seq(0x00, 16), seq(0x80, 16), "722b3033c5d021365a8521bfb41157a3"},
+	{seq(0x00, 32), seq(0x80, 32), "11289b9d205255930f83932405c2b0a38ec32be703fe33f290ff25ffeff402f9"},
+}
+
+func TestBlake3DeriveKey(t *testing.T) {
+	for _, tt := range subkeyTests {
+		subkey := make([]byte, len(tt.psk))
+		blake3DeriveKey(tt.psk, tt.salt, subkey)
+		if got := hex.EncodeToString(subkey); got != tt.subkey {
+			t.Errorf("subkey of %d-byte psk = %s, want %s", len(tt.psk), got, tt.subkey)
+		}
+	}
+}
+
+func TestBlake3AESGCMSubkey(t *testing.T) {
+	for _, tt := range subkeyTests {
+		ciph, err := Blake3AESGCM(tt.psk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aead, err := ciph.Encrypter(tt.salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subkey, _ := hex.DecodeString(tt.subkey)
+		blk, _ := aes.NewCipher(subkey)
+		want, _ := cipher.NewGCM(blk)
+		nonce := make([]byte, aead.NonceSize())
+		if got, want := aead.Seal(nil, nonce, []byte("payload"), nil), want.Seal(nil, nonce, []byte("payload"), nil); !bytes.Equal(got, want) {
+			t.Errorf("%d-byte psk: sealed %x, want %x", len(tt.psk), got, want)
+		}
+	}
+}
+
+var ciphers2022 = []struct {
+	name string
+	new  func() (Cipher2022, error)
+}{
+	{"2022-blake3-aes-128-gcm", func() (Cipher2022, error) { return Blake3AESGCM(seq(1, 16)) }},
+	{"2022-blake3-aes-256-gcm", func() (Cipher2022, error) { return Blake3AESGCM(seq(1, 32)) }},
+	{"2022-blake3-chacha20-poly1305", func() (Cipher2022, error) { return Blake3Chacha20Poly1305(seq(1, 32)) }},
+}
+
+func TestStreamConn2022RoundTrip(t *testing.T) {
+	target := socks.ParseAddr("example.com:443")
+	request := append(append([]byte{}, target...), "request"...)
+	for _, tc := range ciphers2022 {
+		t.Run(tc.name, func(t *testing.T) {
+			ciph, err := tc.new()
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			client, server := NewConn2022(a, ciph), NewServerConn2022(b, ciph)
+
+			done := make(chan error, 1)
+			go func() {
+				buf := make([]byte, len(request))
+				if _, err := io.ReadFull(server, buf); err != nil {
+					done <- err
+					return
+				}
+				if !bytes.Equal(buf, request) {
+					t.Errorf("server read %q, want %q", buf, request)
+				}
+				_, err := server.Write([]byte("response"))
+				done <- err
+			}()
+
+			if _, err := client.Write(request); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, len("response"))
+			if _, err := io.ReadFull(client, buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != "response" {
+				t.Errorf("client read %q, want %q", buf, "response")
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestStreamConn2022NoPayload(t *testing.T) {
+	ciph, err := Blake3AESGCM(seq(1, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	client, server := NewConn2022(a, ciph), NewServerConn2022(b, ciph)
+
+	target := socks.ParseAddr("10.0.0.1:80")
+	go client.Write(target) // padded, as there is no initial payload
+	buf := make([]byte, len(target))
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, target) {
+		t.Errorf("server read %v, want %v", buf, target)
+	}
+}
+
+func TestPacketConn2022RoundTrip(t *testing.T) {
+	target := socks.ParseAddr("8.8.8.8:53")
+	for _, tc := range ciphers2022 {
+		t.Run(tc.name, func(t *testing.T) {
+			ciph, err := tc.new()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pc1, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc1.Close()
+			pc2, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc2.Close()
+			pc1.SetDeadline(time.Now().Add(5 * time.Second))
+			pc2.SetDeadline(time.Now().Add(5 * time.Second))
+			client, server := NewPacketConn2022(pc1, ciph), NewServerPacketConn2022(pc2, ciph)
+
+			buf := make([]byte, 2048)
+			for i := 0; i < 3; i++ {
+				request := append(append([]byte{}, target...), "query"...)
+				if _, err := client.WriteTo(request, pc2.LocalAddr()); err != nil {
+					t.Fatal(err)
+				}
+				n, from, err := server.ReadFrom(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf[:n], request) {
+					t.Fatalf("server read %v, want %v", buf[:n], request)
+				}
+
+				response := append(append([]byte{}, target...), "answer"...)
+				if _, err := server.WriteTo(response, from); err != nil {
+					t.Fatal(err)
+				}
+				if n, _, err = client.ReadFrom(buf); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf[:n], response) {
+					t.Fatalf("client read %v, want %v", buf[:n], response)
+				}
+			}
+		})
+	}
+}
+
+func TestPacketConn2022WrongKey(t *testing.T) {
+	for _, tc := range ciphers2022 {
+		t.Run(tc.name, func(t *testing.T) {
+			ciph, _ := tc.new()
+			psk := make([]byte, ciph.KeySize())
+			var other Cipher2022
+			if ciph.HeaderBlock() != nil {
+				other, _ = Blake3AESGCM(psk)
+			} else {
+				other, _ = Blake3Chacha20Poly1305(psk)
+			}
+			pc1, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc1.Close()
+			pc2, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc2.Close()
+			pc2.SetDeadline(time.Now().Add(5 * time.Second))
+			client, server := NewPacketConn2022(pc1, ciph), NewServerPacketConn2022(pc2, other)
+
+			request := append(socks.ParseAddr("8.8.8.8:53"), "query"...)
+			if _, err := client.WriteTo(request, pc2.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := server.ReadFrom(make([]byte, 2048)); err == nil {
+				t.Error("packet sealed with another key was accepted")
+			}
+		})
+	}
+}
+
+func TestStreamConn2022Roles(t *testing.T) {
+	ciph, err := Blake3AESGCM(seq(1, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if _, err := NewServerConn2022(a, ciph).Write([]byte("response")); err != errNoRequest {
+		t.Errorf("server writing first: got %v, want errNoRequest", err)
+	}
+
+	// A client reading first takes whatever comes for a response.
+	client, other := NewConn2022(a, ciph), NewConn2022(b, ciph)
+	go other.Write(append(socks.ParseAddr("10.0.0.1:80"), "request"...))
+	if _, err := client.Read(make([]byte, 64)); err != ErrBadHeader {
+		t.Errorf("client reading a request: got %v, want ErrBadHeader", err)
+	}
+}
+
+func TestPacketConn2022Roles(t *testing.T) {
+	ciph, err := Blake3AESGCM(seq(1, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcs := make([]net.PacketConn, 3)
+	for i := range pcs {
+		if pcs[i], err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		defer pcs[i].Close()
+		pcs[i].SetDeadline(time.Now().Add(5 * time.Second))
+	}
+	client, server := NewPacketConn2022(pcs[0], ciph), NewServerPacketConn2022(pcs[1], ciph)
+	other := NewPacketConn2022(pcs[2], ciph)
+	pkt := append(socks.ParseAddr("8.8.8.8:53"), "query"...)
+	buf := make([]byte, 2048)
+
+	if _, err := server.WriteTo(pkt, pcs[0].LocalAddr()); err != errNoSession {
+		t.Errorf("server writing to an address without a session: got %v, want errNoSession", err)
+	}
+	if _, err := other.WriteTo(pkt, pcs[0].LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.ReadFrom(buf); err != ErrBadHeader {
+		t.Errorf("client reading a client packet: got %v, want ErrBadHeader", err)
+	}
+
+	// Sessions with packets either way within udpSessionTimeout are kept.
+	for _, c := range []net.PacketConn{client, other} {
+		if _, err := c.WriteTo(pkt, pcs[1].LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := server.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sc := server.(*packetConn2022)
+	for _, s := range sc.sessions {
+		s.lastSeen = time.Now().Add(-udpSessionTimeout - time.Second)
+	}
+	if _, err := server.WriteTo(pkt, pcs[0].LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	sc.lastPrune = time.Time{}
+	sc.pruneSessions()
+	if _, ok := sc.sessions[pcs[0].LocalAddr().String()]; !ok {
+		t.Error("session replied to within the timeout was pruned")
+	}
+	if _, ok := sc.sessions[pcs[2].LocalAddr().String()]; ok {
+		t.Error("idle session was kept")
+	}
+	if n, _, err := client.ReadFrom(buf); err != nil || !bytes.Equal(buf[:n], pkt) {
+		t.Errorf("client read %q, %v, want the reply of the server", buf[:n], err)
+	}
+}
@@ -31,5 +31,17 @@ using zero nonce.
 
 In both stream-oriented and packet-oriented connections, length of nonce and tag varies
 depending on which AEAD is used. Salt should be at least 16-byte long.
+
+
+The 2022 edition (SIP022) derives session subkeys with BLAKE3 instead of HKDF-SHA1 and uses salts
+as long as the pre-shared key. A stream starts with a fixed-length header (type, timestamp and the
+length of the next record) followed by a variable-length header carrying the target address, padding
+and initial payload; a response header echoes the salt of the request. Records carry at most 0xFFFF
+bytes of payload. Headers with a timestamp more than 30 seconds away from local time are rejected.
+
+Packets of the 2022 edition carry a session ID and a packet ID. With AES-GCM they are encrypted as a
+separate header by the pre-shared key, and the rest of the packet is sealed by a subkey derived from the
+session ID. With ChaCha20-Poly1305 the whole packet is sealed by XChaCha20-Poly1305 under a random nonce.
+Packet IDs are checked against a sliding window to reject replayed packets.
 */
 package shadowaead
@@ -77,6 +77,7 @@ func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	addSalt(buf[:c.SaltSize()])
 	_, err = c.PacketConn.WriteTo(buf, addr)
 	return len(b), err
 }
@@ -91,6 +92,9 @@ func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	if err != nil {
 		return n, addr, err
 	}
+	if err := checkSalt(b[:c.SaltSize()]); err != nil { // only authentic salts are recorded
+		return n, addr, err
+	}
 	copy(b, bb)
 	return len(bb), addr, err
 }
@@ -0,0 +1,316 @@
+package shadowaead
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// ErrReplayedPacket means the packet ID of a session has been seen before or is too old.
+var ErrReplayedPacket = errors.New("replayed packet")
+
+// errNoSession means a server writes to an address without a client session.
+var errNoSession = errors.New("no session of the address")
+
+const (
+	separateHeaderSize = 8 + 8
+	xNonceSize         = 24
+	// udpSessionTimeout is how long the session of an idle peer is kept.
+	udpSessionTimeout = 5 * time.Minute
+)
+
+// udpSession pairs the local session with the session of the peer.
+type udpSession struct {
+	localID       uint64
+	localPacketID uint64
+	localAEAD     cipher.AEAD // seals packets of the local session (AES only)
+	remoteID      uint64
+	remoteAEAD    cipher.AEAD // opens packets of the remote session (AES only)
+	filter        slidingWindow
+	lastSeen      time.Time // of the last packet either way, zero until one is received
+}
+
+func (c *packetConn2022) newSession() (*udpSession, error) {
+	var id [8]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return nil, err
+	}
+	s := &udpSession{localID: binary.BigEndian.Uint64(id[:])}
+	if c.HeaderBlock() != nil {
+		aead, err := c.Encrypter(id[:])
+		if err != nil {
+			return nil, err
+		}
+		s.localAEAD = aead
+	}
+	return s, nil
+}
+
+// setRemote resets s to track the remote session id if it changed.
+func (s *udpSession) setRemote(id uint64, aead cipher.AEAD) {
+	if s.remoteID != id || s.lastSeen.IsZero() {
+		s.remoteID = id
+		s.remoteAEAD = aead
+		s.filter = slidingWindow{}
+	}
+	s.lastSeen = time.Now()
+}
+
+type packetConn2022 struct {
+	net.PacketConn
+	Cipher2022
+	sync.Mutex
+	buf       []byte                 // write buffer
+	client    *udpSession            // session of a client
+	sessions  map[string]*udpSession // sessions of a server keyed by client address, nil for a client
+	lastPrune time.Time
+}
+
+// NewPacketConn2022 wraps a net.PacketConn with a cipher of the 2022 edition
+// as a client.
+func NewPacketConn2022(c net.PacketConn, ciph Cipher2022) net.PacketConn {
+	return &packetConn2022{PacketConn: c, Cipher2022: ciph, buf: make([]byte, packetConnBufSize)}
+}
+
+// NewServerPacketConn2022 wraps a net.PacketConn with a cipher of the 2022
+// edition as a server, replying to each client in its session.
+func NewServerPacketConn2022(c net.PacketConn, ciph Cipher2022) net.PacketConn {
+	return &packetConn2022{
+		PacketConn: c,
+		Cipher2022: ciph,
+		buf:        make([]byte, packetConnBufSize),
+		sessions:   make(map[string]*udpSession),
+	}
+}
+
+// WriteTo encrypts b and write to addr using the embedded PacketConn.
+func (c *packetConn2022) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	var hdr []byte
+	var s *udpSession
+	if c.sessions != nil { // server: type, timestamp, client session ID, padding length
+		if s = c.sessions[addr.String()]; s == nil {
+			return 0, errNoSession
+		}
+		s.lastSeen = time.Now()
+		hdr = make([]byte, 1+8+8+2)
+		hdr[0] = headerTypeServer
+		putTimestamp(hdr[1:9])
+		binary.BigEndian.PutUint64(hdr[9:17], s.remoteID)
+	} else { // client: type, timestamp, padding length
+		if c.client == nil {
+			var err error
+			if c.client, err = c.newSession(); err != nil {
+				return 0, err
+			}
+		}
+		s = c.client
+		hdr = make([]byte, 1+8+2)
+		hdr[0] = headerTypeClient
+		putTimestamp(hdr[1:9])
+	}
+	packetID := s.localPacketID
+	s.localPacketID++
+
+	var pkt []byte
+	if blk := c.HeaderBlock(); blk != nil {
+		plainLen := separateHeaderSize + len(hdr) + len(b)
+		if len(c.buf) < plainLen+s.localAEAD.Overhead() {
+			return 0, io.ErrShortBuffer
+		}
+		binary.BigEndian.PutUint64(c.buf[0:8], s.localID)
+		binary.BigEndian.PutUint64(c.buf[8:16], packetID)
+		copy(c.buf[separateHeaderSize:], hdr)
+		copy(c.buf[separateHeaderSize+len(hdr):], b)
+		body := s.localAEAD.Seal(c.buf[separateHeaderSize:separateHeaderSize], c.buf[4:16], c.buf[separateHeaderSize:plainLen], nil)
+		blk.Encrypt(c.buf[:separateHeaderSize], c.buf[:separateHeaderSize])
+		pkt = c.buf[:separateHeaderSize+len(body)]
+	} else {
+		aead := c.PacketAEAD()
+		plainLen := separateHeaderSize + len(hdr) + len(b)
+		if len(c.buf) < xNonceSize+plainLen+aead.Overhead() {
+			return 0, io.ErrShortBuffer
+		}
+		if _, err := io.ReadFull(rand.Reader, c.buf[:xNonceSize]); err != nil {
+			return 0, err
+		}
+		plain := c.buf[xNonceSize : xNonceSize+plainLen]
+		binary.BigEndian.PutUint64(plain[0:8], s.localID)
+		binary.BigEndian.PutUint64(plain[8:16], packetID)
+		copy(plain[separateHeaderSize:], hdr)
+		copy(plain[separateHeaderSize+len(hdr):], b)
+		body := aead.Seal(plain[:0], c.buf[:xNonceSize], plain, nil)
+		pkt = c.buf[:xNonceSize+len(body)]
+	}
+
+	_, err := c.PacketConn.WriteTo(pkt, addr)
+	return len(b), err
+}
+
+// ReadFrom reads from the embedded PacketConn and decrypts into b.
+func (c *packetConn2022) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	var sessionID, packetID uint64
+	var aead cipher.AEAD
+	var body []byte
+	if blk := c.HeaderBlock(); blk != nil {
+		if n < separateHeaderSize {
+			return n, addr, ErrShortPacket
+		}
+		blk.Decrypt(b[:separateHeaderSize], b[:separateHeaderSize])
+		sessionID = binary.BigEndian.Uint64(b[0:8])
+		packetID = binary.BigEndian.Uint64(b[8:16])
+		aead = c.cachedAEAD(sessionID, addr)
+		if aead == nil {
+			var id [8]byte
+			binary.BigEndian.PutUint64(id[:], sessionID)
+			if aead, err = c.Decrypter(id[:]); err != nil {
+				return n, addr, err
+			}
+		}
+		if n < separateHeaderSize+aead.Overhead() {
+			return n, addr, ErrShortPacket
+		}
+		body, err = aead.Open(b[separateHeaderSize:separateHeaderSize], b[4:16], b[separateHeaderSize:n], nil)
+		if err != nil {
+			return n, addr, err
+		}
+	} else {
+		xaead := c.PacketAEAD()
+		if n < xNonceSize+separateHeaderSize+xaead.Overhead() {
+			return n, addr, ErrShortPacket
+		}
+		plain, err := xaead.Open(b[xNonceSize:xNonceSize], b[:xNonceSize], b[xNonceSize:n], nil)
+		if err != nil {
+			return n, addr, err
+		}
+		sessionID = binary.BigEndian.Uint64(plain[0:8])
+		packetID = binary.BigEndian.Uint64(plain[8:16])
+		body = plain[separateHeaderSize:]
+	}
+
+	if len(body) < 1+8 {
+		return n, addr, ErrShortPacket
+	}
+	if err := checkTimestamp(body[1:9]); err != nil {
+		return n, addr, err
+	}
+
+	var s *udpSession
+	switch {
+	case body[0] == headerTypeClient && c.sessions != nil:
+		body = body[9:]
+		s = c.sessions[addr.String()]
+		if s == nil || s.remoteID != sessionID { // a new client session gets a new server session
+			if s, err = c.newSession(); err != nil {
+				return n, addr, err
+			}
+			c.pruneSessions()
+			c.sessions[addr.String()] = s
+		}
+	case body[0] == headerTypeServer && c.sessions == nil:
+		if c.client == nil || len(body) < 1+8+8 || binary.BigEndian.Uint64(body[9:17]) != c.client.localID {
+			return n, addr, ErrBadHeader
+		}
+		body = body[17:]
+		s = c.client
+	default:
+		return n, addr, ErrBadHeader
+	}
+	s.setRemote(sessionID, aead)
+	if !s.filter.check(packetID) {
+		return n, addr, ErrReplayedPacket
+	}
+
+	if len(body) < 2 {
+		return n, addr, ErrShortPacket
+	}
+	padding := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+padding {
+		return n, addr, ErrShortPacket
+	}
+	body = body[2+padding:]
+	if socks.SplitAddr(body) == nil {
+		return n, addr, ErrBadHeader
+	}
+	return copy(b, body), addr, nil
+}
+
+// cachedAEAD returns the AEAD opening packets of session id from addr if known.
+func (c *packetConn2022) cachedAEAD(id uint64, addr net.Addr) cipher.AEAD {
+	if s := c.client; s != nil && s.remoteID == id && s.remoteAEAD != nil {
+		return s.remoteAEAD
+	}
+	if s := c.sessions[addr.String()]; s != nil && s.remoteID == id && s.remoteAEAD != nil {
+		return s.remoteAEAD
+	}
+	return nil
+}
+
+// pruneSessions drops the sessions without packets either way for longer
+// than udpSessionTimeout.
+func (c *packetConn2022) pruneSessions() {
+	if time.Since(c.lastPrune) < time.Minute {
+		return
+	}
+	c.lastPrune = time.Now()
+	for k, s := range c.sessions {
+		if time.Since(s.lastSeen) > udpSessionTimeout {
+			delete(c.sessions, k)
+		}
+	}
+}
+
+const (
+	blockBitLog = 6
+	blockBits   = 1 << blockBitLog
+	ringBlocks  = 1 << 7
+	windowSize  = (ringBlocks - 1) * blockBits
+	blockMask   = ringBlocks - 1
+	bitMask     = blockBits - 1
+)
+
+// slidingWindow rejects duplicated packet IDs and IDs too far behind the
+// largest one seen, as described in RFC 6479.
+type slidingWindow struct {
+	last uint64
+	ring [ringBlocks]uint64
+}
+
+func (f *slidingWindow) check(counter uint64) bool {
+	indexBlock := counter >> blockBitLog
+	if counter > f.last { // move the window forward
+		current := f.last >> blockBitLog
+		diff := indexBlock - current
+		if diff > ringBlocks {
+			diff = ringBlocks
+		}
+		for i := current + 1; i <= current+diff; i++ {
+			f.ring[i&blockMask] = 0
+		}
+		f.last = counter
+	} else if f.last-counter > windowSize {
+		return false
+	}
+	indexBlock &= blockMask
+	indexBit := counter & bitMask
+	old := f.ring[indexBlock]
+	f.ring[indexBlock] = old | 1<<indexBit
+	return old != f.ring[indexBlock]
+}
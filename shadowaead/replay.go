@@ -0,0 +1,140 @@
+package shadowaead
+
+import (
+	"crypto/rand"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrRepeatedSalt means a salt has been seen before, most likely because the
+// stream or packet carrying it was replayed.
+var ErrRepeatedSalt = errors.New("repeated salt detected")
+
+// ReplayFilter remembers salts in a rotating pair of Bloom filters. Once the
+// current filter holds capacity salts it becomes the previous one and a fresh
+// filter takes its place, so between capacity and 2*capacity of the most
+// recent salts are remembered at any time.
+type ReplayFilter struct {
+	checked  uint64 // number of salts checked, first for 64-bit alignment
+	replayed uint64 // number of salts rejected
+
+	sync.Mutex
+	capacity int
+	seed     []byte
+	current  *bloomFilter
+	previous *bloomFilter
+}
+
+// NewReplayFilter creates a ReplayFilter for capacity salts per filter with a
+// false positive rate of fpr.
+func NewReplayFilter(capacity int, fpr float64) *ReplayFilter {
+	if capacity <= 0 {
+		capacity = 1e6
+	}
+	if fpr <= 0 || fpr >= 1 {
+		fpr = 1e-6
+	}
+	seed := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, seed); err != nil {
+		panic(err) // should never happen
+	}
+	return &ReplayFilter{
+		capacity: capacity,
+		seed:     seed,
+		current:  newBloomFilter(capacity, fpr),
+		previous: newBloomFilter(capacity, fpr),
+	}
+}
+
+// Check records salt and reports whether it has not been seen before.
+func (f *ReplayFilter) Check(salt []byte) bool {
+	atomic.AddUint64(&f.checked, 1)
+	if !f.add(salt) {
+		atomic.AddUint64(&f.replayed, 1)
+		return false
+	}
+	return true
+}
+
+// Add records salt without counting it, e.g. a salt generated locally so it
+// cannot be reflected back.
+func (f *ReplayFilter) Add(salt []byte) { f.add(salt) }
+
+func (f *ReplayFilter) add(salt []byte) bool {
+	h1, h2 := f.hash(salt)
+
+	f.Lock()
+	defer f.Unlock()
+	if f.current.test(h1, h2) || f.previous.test(h1, h2) {
+		return false
+	}
+	if f.current.count >= f.capacity {
+		f.previous, f.current = f.current, f.previous
+		f.current.reset()
+	}
+	f.current.add(h1, h2)
+	return true
+}
+
+func (f *ReplayFilter) hash(salt []byte) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write(f.seed)
+	h.Write(salt)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+// Checked returns the number of salts checked so far.
+func (f *ReplayFilter) Checked() uint64 { return atomic.LoadUint64(&f.checked) }
+
+// Replayed returns the number of salts rejected as repeated so far.
+func (f *ReplayFilter) Replayed() uint64 { return atomic.LoadUint64(&f.replayed) }
+
+type bloomFilter struct {
+	bits  []uint64
+	m     uint32 // number of bits
+	k     uint32 // number of hash functions
+	count int
+}
+
+func newBloomFilter(n int, fpr float64) *bloomFilter {
+	m := math.Ceil(-float64(n) * math.Log(fpr) / (math.Ln2 * math.Ln2))
+	if m > math.MaxUint32 {
+		m = math.MaxUint32
+	}
+	k := math.Ceil(m / float64(n) * math.Ln2)
+	return &bloomFilter{
+		bits: make([]uint64, (uint64(m)+63)/64),
+		m:    uint32(m),
+		k:    uint32(k),
+	}
+}
+
+func (b *bloomFilter) add(h1, h2 uint32) {
+	for i := uint32(0); i < b.k; i++ {
+		n := (h1 + i*h2) % b.m
+		b.bits[n/64] |= 1 << (n % 64)
+	}
+	b.count++
+}
+
+func (b *bloomFilter) test(h1, h2 uint32) bool {
+	for i := uint32(0); i < b.k; i++ {
+		n := (h1 + i*h2) % b.m
+		if b.bits[n/64]&(1<<(n%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) reset() {
+	for i := range b.bits {
+		b.bits[i] = 0
+	}
+	b.count = 0
+}
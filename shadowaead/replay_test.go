@@ -0,0 +1,90 @@
+package shadowaead
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func randomSalts(n int) [][]byte {
+	salts := make([][]byte, n)
+	for i := range salts {
+		salts[i] = make([]byte, 32)
+		rand.Read(salts[i])
+	}
+	return salts
+}
+
+func TestReplayFilterRotation(t *testing.T) {
+	const capacity = 4
+	f := NewReplayFilter(capacity, 1e-9)
+	salts := randomSalts(3*capacity + 1)
+	if !f.Check(salts[0]) {
+		t.Fatal("new salt rejected")
+	}
+	if f.Check(salts[0]) {
+		t.Error("replayed salt accepted")
+	}
+	for _, salt := range salts[1:capacity] { // fill the current filter
+		f.Check(salt)
+	}
+	f.Check(salts[capacity]) // rotates
+	if f.Check(salts[0]) {
+		t.Error("replayed salt accepted after one rotation")
+	}
+	for _, salt := range salts[capacity+1 : 2*capacity+1] { // rotates again
+		f.Check(salt)
+	}
+	if !f.Check(salts[0]) {
+		t.Error("salt still remembered after two rotations")
+	}
+	if f.Checked() != 2*capacity+4 || f.Replayed() != 2 {
+		t.Errorf("%d checked, %d replayed, want %d, 2", f.Checked(), f.Replayed(), 2*capacity+4)
+	}
+
+	f.Add(salts[2*capacity+1])
+	if f.Checked() != 2*capacity+4 {
+		t.Error("Add counted as a check")
+	}
+	if f.Check(salts[2*capacity+1]) {
+		t.Error("salt recorded by Add accepted")
+	}
+}
+
+func TestReplayFilterParameters(t *testing.T) {
+	tests := []struct {
+		capacity int
+		fpr      float64
+		m, k     uint32
+	}{
+		{1000, 0.01, 9586, 7},
+		{1e6, 1e-6, 28755176, 20},
+		{0, 0, 28755176, 20}, // defaults
+		{-1, 1, 28755176, 20},
+	}
+	for _, tt := range tests {
+		f := NewReplayFilter(tt.capacity, tt.fpr)
+		for _, b := range []*bloomFilter{f.current, f.previous} {
+			if b.m != tt.m || b.k != tt.k || len(b.bits) != int(tt.m+63)/64 {
+				t.Errorf("NewReplayFilter(%d, %g): %d bits in %d words, %d hashes, want %d bits, %d hashes",
+					tt.capacity, tt.fpr, b.m, len(b.bits), b.k, tt.m, tt.k)
+			}
+		}
+	}
+}
+
+func TestReplayFilterFalsePositives(t *testing.T) {
+	const capacity, fpr = 10000, 0.01
+	f := NewReplayFilter(capacity, fpr)
+	for _, salt := range randomSalts(capacity) {
+		f.Check(salt)
+	}
+	rejected := 0
+	for _, salt := range randomSalts(capacity) {
+		if !f.Check(salt) {
+			rejected++
+		}
+	}
+	if rate := float64(rejected) / capacity; rate > 2*fpr {
+		t.Errorf("%.2f%% of new salts rejected, want about %.2f%%", 100*rate, 100*fpr)
+	}
+}
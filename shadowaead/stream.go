@@ -11,19 +11,25 @@ import (
 type writer struct {
 	io.Writer
 	cipher.AEAD
-	nonce []byte
-	buf   []byte
+	nonce   []byte
+	buf     []byte
+	maxSize int // maximum payload size of a record
 }
 
 // NewWriter wraps an io.Writer with AEAD encryption.
 func NewWriter(w io.Writer, aead cipher.AEAD) io.Writer { return newWriter(w, aead) }
 
 func newWriter(w io.Writer, aead cipher.AEAD) *writer {
+	return newWriterSize(w, aead, payloadSizeMask)
+}
+
+func newWriterSize(w io.Writer, aead cipher.AEAD, maxSize int) *writer {
 	return &writer{
-		Writer: w,
-		AEAD:   aead,
-		buf:    make([]byte, 2+aead.Overhead()+payloadSizeMask+aead.Overhead()),
-		nonce:  make([]byte, aead.NonceSize()),
+		Writer:  w,
+		AEAD:    aead,
+		buf:     make([]byte, 2+aead.Overhead()+maxSize+aead.Overhead()),
+		nonce:   make([]byte, aead.NonceSize()),
+		maxSize: maxSize,
 	}
 }
 
@@ -39,7 +45,7 @@ func (w *writer) Write(b []byte) (int, error) {
 func (w *writer) ReadFrom(r io.Reader) (n int64, err error) {
 	for {
 		buf := w.buf
-		payloadBuf := buf[2+w.Overhead() : 2+w.Overhead()+payloadSizeMask]
+		payloadBuf := buf[2+w.Overhead() : 2+w.Overhead()+w.maxSize]
 		nr, er := r.Read(payloadBuf)
 
 		if nr > 0 {
@@ -77,17 +83,23 @@ type reader struct {
 	nonce    []byte
 	buf      []byte
 	leftover []byte
+	sizeMask int
 }
 
 // NewReader wraps an io.Reader with AEAD decryption.
 func NewReader(r io.Reader, aead cipher.AEAD) io.Reader { return newReader(r, aead) }
 
 func newReader(r io.Reader, aead cipher.AEAD) *reader {
+	return newReaderSize(r, aead, payloadSizeMask)
+}
+
+func newReaderSize(r io.Reader, aead cipher.AEAD, sizeMask int) *reader {
 	return &reader{
-		Reader: r,
-		AEAD:   aead,
-		buf:    make([]byte, payloadSizeMask+aead.Overhead()),
-		nonce:  make([]byte, aead.NonceSize()),
+		Reader:   r,
+		AEAD:     aead,
+		buf:      make([]byte, sizeMask+aead.Overhead()),
+		nonce:    make([]byte, aead.NonceSize()),
+		sizeMask: sizeMask,
 	}
 }
 
@@ -106,7 +118,7 @@ func (r *reader) read() (int, error) {
 		return 0, err
 	}
 
-	size := (int(buf[0])<<8 + int(buf[1])) & payloadSizeMask
+	size := (int(buf[0])<<8 + int(buf[1])) & r.sizeMask
 
 	// decrypt payload
 	buf = r.buf[:size+r.Overhead()]
@@ -206,7 +218,16 @@ func (c *streamConn) initReader() error {
 		return err
 	}
 
-	c.r = newReader(c.Conn, aead)
+	r := newReader(c.Conn, aead)
+	n, err := r.read()
+	if err != nil {
+		return err
+	}
+	if err := checkSalt(salt); err != nil { // only authentic salts are recorded
+		return err
+	}
+	r.leftover = r.buf[:n]
+	c.r = r
 	return nil
 }
 
@@ -241,6 +262,7 @@ func (c *streamConn) initWriter() error {
 	if err != nil {
 		return err
 	}
+	addSalt(salt)
 	c.w = newWriter(c.Conn, aead)
 	return nil
 }
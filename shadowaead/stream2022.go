@@ -0,0 +1,300 @@
+package shadowaead
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const (
+	headerTypeClient = 0
+	headerTypeServer = 1
+
+	// payloadSizeMax2022 is the maximum size of payload in bytes of the 2022 edition.
+	payloadSizeMax2022 = 0xFFFF
+	// maxPaddingLength is the upper bound of the padding sent by clients without initial payload.
+	maxPaddingLength = 900
+	// maxTimeDiff is the maximum allowed difference between the timestamp in a header and local time.
+	maxTimeDiff = 30 * time.Second
+)
+
+var (
+	// ErrBadTimestamp means the timestamp of a header is too far from local time.
+	ErrBadTimestamp = errors.New("bad timestamp")
+	// ErrBadHeader means a header has an unexpected type or request salt.
+	ErrBadHeader = errors.New("bad header")
+	// ErrMissingAddr means the first write of a client stream does not start with a SOCKS address.
+	ErrMissingAddr = errors.New("missing target address")
+
+	errNoRequest = errors.New("no request to respond to")
+)
+
+func checkTimestamp(b []byte) error {
+	diff := time.Since(time.Unix(int64(binary.BigEndian.Uint64(b)), 0))
+	if diff < -maxTimeDiff || diff > maxTimeDiff {
+		return ErrBadTimestamp
+	}
+	return nil
+}
+
+func putTimestamp(b []byte) {
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Unix()))
+}
+
+// readChunk reads and decrypts a record of exactly n bytes of plaintext
+// into the internal buffer.
+func (r *reader) readChunk(n int) ([]byte, error) {
+	buf := r.buf[:n+r.Overhead()]
+	if _, err := io.ReadFull(r.Reader, buf); err != nil {
+		return nil, err
+	}
+	_, err := r.Open(buf[:0], r.nonce, buf, nil)
+	increment(r.nonce)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// seal appends the encrypted record of plaintext b to dst.
+func (w *writer) seal(dst, b []byte) []byte {
+	dst = w.Seal(dst, w.nonce, b, nil)
+	increment(w.nonce)
+	return dst
+}
+
+// streamConn2022 is the stream-oriented connection of the 2022 edition. The
+// client sends a request header, and the server answers with a response
+// header carrying the request salt.
+type streamConn2022 struct {
+	net.Conn
+	Cipher
+	isServer bool
+	r        *reader
+	w        *writer
+
+	sync.Mutex
+	requestSalt []byte // salt sent by the client
+}
+
+// NewConn2022 wraps a stream-oriented net.Conn with a cipher of the 2022
+// edition as the client end.
+func NewConn2022(c net.Conn, ciph Cipher) net.Conn { return &streamConn2022{Conn: c, Cipher: ciph} }
+
+// NewServerConn2022 wraps a stream-oriented net.Conn with a cipher of the
+// 2022 edition as the server end.
+func NewServerConn2022(c net.Conn, ciph Cipher) net.Conn {
+	return &streamConn2022{Conn: c, Cipher: ciph, isServer: true}
+}
+
+func (c *streamConn2022) initReader() error {
+	salt := make([]byte, c.SaltSize())
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	aead, err := c.Decrypter(salt)
+	if err != nil {
+		return err
+	}
+	r := newReaderSize(c.Conn, aead, payloadSizeMax2022)
+
+	if c.isServer { // request: type, timestamp, length of variable-length header
+		hdr, err := r.readChunk(1 + 8 + 2)
+		if err != nil {
+			return err
+		}
+		if hdr[0] != headerTypeClient {
+			return ErrBadHeader
+		}
+		if err := checkTimestamp(hdr[1:9]); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(hdr[9:]))
+
+		// variable-length header: address, padding length, padding, initial payload
+		b, err := r.readChunk(length)
+		if err != nil {
+			return err
+		}
+		addr := socks.SplitTarget(b)
+		if addr == nil || len(b) < len(addr)+2 {
+			return ErrBadHeader
+		}
+		padding := int(binary.BigEndian.Uint16(b[len(addr):]))
+		if len(b) < len(addr)+2+padding {
+			return ErrBadHeader
+		}
+		n := copy(b[len(addr):], b[len(addr)+2+padding:])
+		r.leftover = b[:len(addr)+n]
+
+		c.Lock()
+		c.requestSalt = salt
+		c.Unlock()
+	} else { // response: type, timestamp, request salt, length of first chunk
+		c.Lock()
+		requestSalt := c.requestSalt
+		c.Unlock()
+		if requestSalt == nil { // a response arrived before the request was sent
+			return ErrBadHeader
+		}
+		hdr, err := r.readChunk(1 + 8 + len(requestSalt) + 2)
+		if err != nil {
+			return err
+		}
+		if hdr[0] != headerTypeServer || !bytes.Equal(hdr[9:9+len(requestSalt)], requestSalt) {
+			return ErrBadHeader
+		}
+		if err := checkTimestamp(hdr[1:9]); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(hdr[9+len(requestSalt):]))
+		b, err := r.readChunk(length)
+		if err != nil {
+			return err
+		}
+		r.leftover = b
+	}
+
+	if err := checkSalt(salt); err != nil { // only authentic salts are recorded
+		return err
+	}
+	c.r = r
+	return nil
+}
+
+func (c *streamConn2022) Read(b []byte) (int, error) {
+	if c.r == nil {
+		if err := c.initReader(); err != nil {
+			return 0, err
+		}
+	}
+	return c.r.Read(b)
+}
+
+func (c *streamConn2022) WriteTo(w io.Writer) (int64, error) {
+	if c.r == nil {
+		if err := c.initReader(); err != nil {
+			return 0, err
+		}
+	}
+	return c.r.WriteTo(w)
+}
+
+// initWriter sends the header along with the first bytes of b and returns
+// the number of bytes of b consumed.
+func (c *streamConn2022) initWriter(b []byte) (int, error) {
+	salt := make([]byte, c.SaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return 0, err
+	}
+	aead, err := c.Encrypter(salt)
+	if err != nil {
+		return 0, err
+	}
+	w := newWriterSize(c.Conn, aead, payloadSizeMax2022)
+
+	c.Lock()
+	defer c.Unlock()
+
+	var fixed, variable []byte
+	n := 0
+	if c.isServer {
+		if c.requestSalt == nil {
+			return 0, errNoRequest
+		}
+		n = len(b)
+		if n > payloadSizeMax2022 {
+			n = payloadSizeMax2022
+		}
+		fixed = make([]byte, 1+8+len(c.requestSalt)+2)
+		fixed[0] = headerTypeServer
+		putTimestamp(fixed[1:9])
+		copy(fixed[9:], c.requestSalt)
+		binary.BigEndian.PutUint16(fixed[9+len(c.requestSalt):], uint16(n))
+		variable = b[:n]
+	} else {
+		addr := socks.SplitTarget(b)
+		if addr == nil {
+			return 0, ErrMissingAddr
+		}
+		payload := b[len(addr):]
+		padding := 0
+		if len(payload) == 0 {
+			p, err := rand.Int(rand.Reader, big.NewInt(maxPaddingLength))
+			if err != nil {
+				return 0, err
+			}
+			padding = int(p.Int64()) + 1
+		}
+		if max := payloadSizeMax2022 - len(addr) - 2 - padding; len(payload) > max {
+			payload = payload[:max]
+		}
+		n = len(addr) + len(payload)
+		variable = make([]byte, len(addr)+2+padding+len(payload))
+		copy(variable, addr)
+		binary.BigEndian.PutUint16(variable[len(addr):], uint16(padding))
+		copy(variable[len(addr)+2+padding:], payload)
+
+		fixed = make([]byte, 1+8+2)
+		fixed[0] = headerTypeClient
+		putTimestamp(fixed[1:9])
+		binary.BigEndian.PutUint16(fixed[9:], uint16(len(variable)))
+		c.requestSalt = salt
+	}
+
+	buf := make([]byte, 0, len(salt)+len(fixed)+len(variable)+2*aead.Overhead())
+	buf = append(buf, salt...)
+	buf = w.seal(buf, fixed)
+	buf = w.seal(buf, variable)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	addSalt(salt)
+	c.w = w
+	return n, nil
+}
+
+func (c *streamConn2022) Write(b []byte) (int, error) {
+	if c.w == nil {
+		n, err := c.initWriter(b)
+		if err != nil || n == len(b) {
+			return n, err
+		}
+		nw, err := c.w.Write(b[n:])
+		return n + nw, err
+	}
+	return c.w.Write(b)
+}
+
+func (c *streamConn2022) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	if c.w == nil { // the header goes out with the first bytes read from r
+		buf := make([]byte, payloadSizeMax2022)
+		for c.w == nil {
+			nr, er := r.Read(buf)
+			if nr > 0 {
+				nw, err := c.Write(buf[:nr])
+				n += int64(nw)
+				if err != nil {
+					return n, err
+				}
+			}
+			if er != nil {
+				if er == io.EOF { // ignore EOF as per io.ReaderFrom contract
+					er = nil
+				}
+				return n, er
+			}
+		}
+	}
+	nw, err := c.w.ReadFrom(r)
+	return n + nw, err
+}
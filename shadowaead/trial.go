@@ -0,0 +1,44 @@
+package shadowaead
+
+// overhead returns the tag size of the AEAD of ciph.
+func overhead(ciph Cipher) int {
+	aead, err := ciph.Decrypter(make([]byte, ciph.SaltSize()))
+	if err != nil {
+		return 0
+	}
+	return aead.Overhead()
+}
+
+// StreamHeaderSize returns the number of leading bytes of a stream needed by
+// TryStream: the salt followed by the encrypted length of the first record.
+func StreamHeaderSize(ciph Cipher) int { return ciph.SaltSize() + 2 + overhead(ciph) }
+
+// TryStream reports whether the leading bytes of a stream in hdr are
+// authentic under ciph. hdr is not modified.
+func TryStream(ciph Cipher, hdr []byte) bool {
+	return tryStream(ciph, hdr, 2)
+}
+
+// StreamHeaderSize2022 returns the number of leading bytes of a stream of
+// the 2022 edition needed by TryStream2022: the salt followed by the
+// encrypted fixed-length request header.
+func StreamHeaderSize2022(ciph Cipher) int { return ciph.SaltSize() + 1 + 8 + 2 + overhead(ciph) }
+
+// TryStream2022 reports whether the leading bytes of a stream of the 2022
+// edition in hdr are authentic under ciph. hdr is not modified.
+func TryStream2022(ciph Cipher, hdr []byte) bool {
+	return tryStream(ciph, hdr, 1+8+2)
+}
+
+func tryStream(ciph Cipher, hdr []byte, size int) bool {
+	saltSize := ciph.SaltSize()
+	if len(hdr) < saltSize {
+		return false
+	}
+	aead, err := ciph.Decrypter(hdr[:saltSize])
+	if err != nil || len(hdr) < saltSize+size+aead.Overhead() {
+		return false
+	}
+	_, err = aead.Open(nil, _zerononce[:aead.NonceSize()], hdr[saltSize:saltSize+size+aead.Overhead()], nil)
+	return err == nil
+}
@@ -11,3 +11,26 @@ func SetPayloadSize(size uint) {
 func SetPacketConnBufSize(size uint) {
 	packetConnBufSize = size
 }
+
+// replayFilter checks the salts of incoming streams and packets if set.
+var replayFilter *ReplayFilter
+
+// SetReplayFilter makes all connections reject salts seen before by f.
+// Salts sent by local connections are recorded as well so they cannot be
+// reflected back. A nil f disables the check.
+func SetReplayFilter(f *ReplayFilter) {
+	replayFilter = f
+}
+
+func checkSalt(salt []byte) error {
+	if f := replayFilter; f != nil && !f.Check(salt) {
+		return ErrRepeatedSalt
+	}
+	return nil
+}
+
+func addSalt(salt []byte) {
+	if f := replayFilter; f != nil {
+		f.Add(salt)
+	}
+}
@@ -0,0 +1,236 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrBadReply means a proxy replied something other than SOCKS5.
+var ErrBadReply = errors.New("malformed SOCKS5 reply")
+
+// handshakeTimeout bounds handshakes without a Timeout or a deadline.
+const handshakeTimeout = 30 * time.Second
+
+// Dialer connects to addresses through a SOCKS5 proxy.
+type Dialer struct {
+	Proxy    string // address of the proxy
+	Username string // authenticate with Username and Password if not empty (RFC 1929)
+	Password string
+
+	// Timeout bounds connecting to the proxy and the handshake when the
+	// context has no deadline, 30 seconds if zero.
+	Timeout time.Duration
+}
+
+// Dial connects to addr on the TCP network through the proxy.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial with a context, and can be used as the
+// DialContext of an http.Transport.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	tgt := ParseAddr(addr)
+	if tgt == nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ErrAddressNotSupported}
+	}
+	c, _, err := d.connect(ctx, CmdConnect, tgt)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	return c, nil
+}
+
+// ListenPacket opens a UDP ASSOCIATE session with the proxy and returns a
+// PacketConn sending packets to any address through it from the local
+// address, the session ending when closed. Fragmented packets from the
+// proxy are dropped.
+func (d *Dialer) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	laddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	src := Addr{AtypIPv4, 0, 0, 0, 0, 0, 0} // the client address is not known before sending
+	c, bnd, err := d.connect(context.Background(), CmdUDPAssociate, src)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	relay, err := net.ResolveUDPAddr(network, bnd.String())
+	if err == nil && relay.IP.IsUnspecified() { // the relay is on the proxy
+		relay.IP = c.RemoteAddr().(*net.TCPAddr).IP
+	}
+	var uc *net.UDPConn
+	if err == nil {
+		uc, err = net.DialUDP(network, laddr, relay)
+	}
+	if err != nil {
+		c.Close()
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	go func() {
+		io.Copy(ioutil.Discard, c) // the session lasts as long as the connection
+		uc.Close()
+	}()
+	return &packetConn{Conn: uc, tcp: c, buf: make([]byte, 64*1024)}, nil
+}
+
+// connect connects to the proxy and sends the request cmd for addr. Returns
+// the connection and BND.ADDR of the reply.
+func (d *Dialer) connect(ctx context.Context, cmd byte, addr Addr) (net.Conn, Addr, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := d.Timeout
+		if timeout == 0 {
+			timeout = handshakeTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var nd net.Dialer
+	c, err := nd.DialContext(ctx, "tcp", d.Proxy)
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+	bnd, err := d.handshake(c, cmd, addr)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, bnd, nil
+}
+
+func (d *Dialer) handshake(rw io.ReadWriter, cmd byte, addr Addr) (Addr, error) {
+	method := byte(MethodNoAuth)
+	if d.Username != "" {
+		method = MethodUserPass
+	}
+	// write VER NMETHODS METHODS, read VER METHOD
+	if _, err := rw.Write([]byte{5, 1, method}); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return nil, err
+	}
+	if buf[0] != 5 {
+		return nil, ErrBadReply
+	}
+	if buf[1] != method {
+		return nil, ErrAuthFailed
+	}
+	if method == MethodUserPass {
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return nil, ErrAuthFailed
+		}
+		req := append([]byte{1, byte(len(d.Username))}, d.Username...)
+		req = append(append(req, byte(len(d.Password))), d.Password...)
+		if _, err := rw.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+			return nil, err
+		}
+		if buf[1] != 0 {
+			return nil, ErrAuthFailed
+		}
+	}
+
+	// write VER CMD RSV ATYP DST.ADDR DST.PORT, read VER REP RSV ATYP BND.ADDR BND.PORT
+	if _, err := rw.Write(append([]byte{5, cmd, 0}, addr...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return nil, err
+	}
+	if buf[0] != 5 {
+		return nil, ErrBadReply
+	}
+	if buf[1] != 0 {
+		return nil, Error(buf[1])
+	}
+	return ReadAddr(rw)
+}
+
+// packetConn sends packets through the UDP relay of a proxy.
+type packetConn struct {
+	net.Conn // connected to the relay
+	tcp      net.Conn
+
+	sync.Mutex
+	buf []byte
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tgt := ParseAddr(addr.String())
+	if tgt == nil {
+		return 0, ErrAddressNotSupported
+	}
+	// write RSV FRAG ATYP DST.ADDR DST.PORT DATA
+	if _, err := c.Conn.Write(append(append([]byte{0, 0, 0}, tgt...), b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.Lock()
+	defer c.Unlock()
+	for {
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < 3 || c.buf[0] != 0 || c.buf[1] != 0 || c.buf[2] != 0 {
+			continue // malformed or fragmented
+		}
+		src := SplitAddr(c.buf[3:n])
+		if src == nil {
+			continue
+		}
+		from, err := udpAddr(src)
+		if err != nil {
+			continue
+		}
+		return copy(b, c.buf[3+len(src):n]), from, nil
+	}
+}
+
+// udpAddr returns a as a *net.UDPAddr, resolving only domain names.
+func udpAddr(a Addr) (*net.UDPAddr, error) {
+	var ip []byte
+	switch a[0] {
+	case AtypIPv4:
+		ip = a[1 : 1+net.IPv4len]
+	case AtypIPv6:
+		ip = a[1 : 1+net.IPv6len]
+	default:
+		return net.ResolveUDPAddr("udp", a.String())
+	}
+	port := int(a[1+len(ip)])<<8 | int(a[1+len(ip)+1])
+	return &net.UDPAddr{IP: append(net.IP{}, ip...), Port: port}, nil
+}
+
+func (c *packetConn) Close() error {
+	c.tcp.Close()
+	return c.Conn.Close()
+}
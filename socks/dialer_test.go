@@ -0,0 +1,62 @@
+package socks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPAddr(t *testing.T) {
+	for _, s := range []string{"1.2.3.4:53", "[2001:db8::1]:443", "127.0.0.1:0"} {
+		a := ParseAddr(s)
+		got, err := udpAddr(a)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		a[1]++ // the address must not share memory with a
+		if got.String() != s {
+			t.Errorf("udpAddr(%s) = %s", s, got)
+		}
+	}
+	got, err := udpAddr(ParseAddr("localhost:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.IP.IsLoopback() || got.Port != 53 {
+		t.Errorf("udpAddr(localhost:53) = %s", got)
+	}
+}
+
+func TestDialerTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() { // a proxy accepting connections and saying nothing
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	const timeout = 100 * time.Millisecond
+	d := &Dialer{Proxy: l.Addr().String(), Timeout: timeout}
+	dial := func() error { _, err := d.Dial("tcp", "127.0.0.1:1"); return err }
+	listen := func() error { _, err := d.ListenPacket("udp", "127.0.0.1:0"); return err }
+	for name, f := range map[string]func() error{"Dial": dial, "ListenPacket": listen} {
+		done := make(chan error, 1)
+		go func() { done <- f() }()
+		select {
+		case err := <-done:
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				t.Errorf("%s: got %v, want a timeout", name, err)
+			}
+		case <-time.After(20 * timeout):
+			t.Errorf("%s: handshake with a silent proxy still running", name)
+		}
+	}
+}
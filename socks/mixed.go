@@ -0,0 +1,193 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrBadRequest means a client sent something other than a SOCKS4, SOCKS5 or HTTP proxy request.
+var ErrBadRequest = errors.New("bad proxy request")
+
+const badRequest = "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+
+// bufConn is a net.Conn reading through a bufio.Reader.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// HandshakeMixed serves a client speaking SOCKS4, SOCKS4a, SOCKS5 or HTTP
+// proxy, told apart by the first byte, and returns the target address along
+// with bytes to send to the target before relaying the rest of c. Those are
+// the request rewritten for the target in case of plain HTTP forwarding,
+// followed by anything the client sent early. Clients must authenticate if
+// auth is not nil, which rules out SOCKS4. UDP ASSOCIATE is answered if udp
+// is set, returning InfoUDPAssociate.
+func HandshakeMixed(c net.Conn, auth Auth, udp bool) (Addr, []byte, error) {
+	r, err := ReadRequest(c, auth, udp)
+	if err == InfoUDPAssociate {
+		return r.Addr, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.Cmd != CmdConnect {
+		r.Reply(ErrCommandNotSupported, nil)
+		return nil, nil, ErrCommandNotSupported
+	}
+	return r.Addr, r.Payload, r.Reply(nil, nil)
+}
+
+// handshake4 reads the CONNECT request of SOCKS4 and SOCKS4a.
+func handshake4(c *bufConn, auth Auth) (Addr, error) {
+	// read VN CD DSTPORT DSTIP
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return nil, err
+	}
+	if _, err := readString4(c.r); err != nil { // USERID
+		if err == ErrBadRequest {
+			reply4(c, err)
+		}
+		return nil, err
+	}
+	if auth != nil {
+		reply4(c, ErrAuthFailed)
+		return nil, ErrAuthFailed
+	}
+	if buf[1] != CmdConnect {
+		reply4(c, ErrCommandNotSupported)
+		return nil, ErrCommandNotSupported
+	}
+
+	if buf[4] == 0 && buf[5] == 0 && buf[6] == 0 && buf[7] != 0 { // SOCKS4a: domain name follows
+		host, err := readString4(c.r)
+		if err == ErrBadRequest {
+			reply4(c, ErrAddressNotSupported)
+			return nil, ErrAddressNotSupported
+		}
+		if err != nil {
+			return nil, err
+		}
+		addr := append([]byte{AtypDomainName, byte(len(host))}, host...)
+		return append(addr, buf[2:4]...), nil
+	}
+	addr := append([]byte{AtypIPv4}, buf[4:8]...)
+	return append(addr, buf[2:4]...), nil
+}
+
+// readString4 reads a null-terminated field of SOCKS4, failing with
+// ErrBadRequest if longer than 255 bytes.
+func readString4(r *bufio.Reader) (string, error) {
+	var b []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		if len(b) == 255 {
+			return "", ErrBadRequest
+		}
+		b = append(b, c)
+	}
+}
+
+// reply4 writes a SOCKS4 reply granting the request if err is nil.
+func reply4(w io.Writer, err error) error {
+	reply := []byte{0, 90, 0, 0, 0, 0, 0, 0} // request granted
+	if err != nil {
+		reply[1] = 91 // request rejected or failed
+	}
+	_, e := w.Write(reply)
+	return e
+}
+
+// handshakeHTTP reads an HTTP CONNECT request, or a plain HTTP request with an
+// absolute URI returned rewritten to be sent to the target.
+func handshakeHTTP(c *bufConn, auth Auth) (addr Addr, payload []byte, connect bool, err error) {
+	req, err := http.ReadRequest(c.r)
+	if err != nil {
+		io.WriteString(c, badRequest)
+		return nil, nil, false, ErrBadRequest
+	}
+	if auth != nil && !checkProxyAuth(req, auth) {
+		io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+			"Proxy-Authenticate: Basic realm=\"proxy\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return nil, nil, false, ErrAuthFailed
+	}
+
+	if req.Method == http.MethodConnect {
+		if addr = ParseAddr(req.Host); addr == nil {
+			io.WriteString(c, badRequest)
+			return nil, nil, false, ErrAddressNotSupported
+		}
+		return addr, nil, true, nil
+	}
+
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		io.WriteString(c, badRequest)
+		return nil, nil, false, ErrBadRequest
+	}
+	host := req.URL.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "80")
+	}
+	if addr = ParseAddr(host); addr == nil {
+		io.WriteString(c, badRequest)
+		return nil, nil, false, ErrAddressNotSupported
+	}
+
+	// The body, if any, is relayed as is after the header. One request is
+	// served per connection, so the target is asked to close it afterwards.
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Set("Connection", "close")
+	if len(req.TransferEncoding) > 0 {
+		req.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+	var b bytes.Buffer
+	b.WriteString(req.Method + " " + req.URL.RequestURI() + " HTTP/" +
+		strconv.Itoa(req.ProtoMajor) + "." + strconv.Itoa(req.ProtoMinor) + "\r\n")
+	b.WriteString("Host: " + req.Host + "\r\n")
+	req.Header.Write(&b)
+	b.WriteString("\r\n")
+	return addr, b.Bytes(), false, nil
+}
+
+// replyHTTP answers a CONNECT request, or a plain request if the target
+// could not be reached, whose response otherwise comes from the target.
+func replyHTTP(w io.Writer, err error, connect bool) error {
+	var e error
+	switch {
+	case err != nil:
+		_, e = io.WriteString(w, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	case connect:
+		_, e = io.WriteString(w, "HTTP/1.1 200 Connection established\r\n\r\n")
+	}
+	return e
+}
+
+func checkProxyAuth(req *http.Request, auth Auth) bool {
+	s := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(s, "Basic ") {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(s[len("Basic "):])
+	if err != nil {
+		return false
+	}
+	i := bytes.IndexByte(b, ':')
+	return i >= 0 && auth(string(b[:i]), string(b[i+1:]))
+}
@@ -0,0 +1,56 @@
+package socks
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHandshake4(t *testing.T) {
+	long := strings.Repeat("a", 256)
+	tests := []struct {
+		name string
+		req  string
+		addr Addr
+		err  error
+	}{
+		{"SOCKS4", "\x04\x01\x00\x50\x0a\x00\x00\x01user\x00", ParseAddr("10.0.0.1:80"), nil},
+		{"SOCKS4a", "\x04\x01\x00\x50\x00\x00\x00\x01user\x00example.com\x00", ParseAddr("example.com:80"), nil},
+		{"longest host", "\x04\x01\x00\x50\x00\x00\x00\x01\x00" + long[:255] + "\x00", ParseAddr(long[:255] + ":80"), nil},
+		{"long USERID", "\x04\x01\x00\x50\x0a\x00\x00\x01" + long + "\x00", nil, ErrBadRequest},
+		{"long host", "\x04\x01\x00\x50\x00\x00\x00\x01\x00" + long + "\x00", nil, ErrAddressNotSupported},
+	}
+	for _, tt := range tests {
+		c, s := net.Pipe()
+		go c.Write([]byte(tt.req))
+		replied := make(chan []byte, 1)
+		go func() {
+			b := make([]byte, 8)
+			n, _ := c.Read(b)
+			replied <- b[:n]
+		}()
+		r, err := ReadRequest(s, nil, false)
+		if err == nil {
+			r.Reply(nil, nil)
+		}
+		reply := <-replied
+		c.Close()
+		s.Close()
+
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && !bytes.Equal(r.Addr, tt.addr) {
+			t.Errorf("%s: got address %v, want %v", tt.name, r.Addr, tt.addr)
+		}
+		want := byte(90) // granted
+		if err != nil {
+			want = 91 // rejected
+		}
+		if len(reply) != 8 || reply[1] != want {
+			t.Errorf("%s: got reply %v, want code %d", tt.name, reply, want)
+		}
+	}
+}
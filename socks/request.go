@@ -0,0 +1,155 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Flags set in the address type of a target address sent to a shadowsocks
+// server of this package's users, asking for more than a plain relay.
+const (
+	FlagReply = 0x40 // reply with the outcome of dialing the target before relaying
+	FlagBind  = 0x80 // accept a connection from the target instead of dialing it, replying twice
+)
+
+const targetFlags = FlagReply | FlagBind
+
+// ReadTarget reads a target address from r and returns it without the flags
+// set in its address type.
+func ReadTarget(r io.Reader) (Addr, byte, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return nil, 0, err
+	}
+	flags := atyp[0] & targetFlags
+	atyp[0] &^= targetFlags
+	addr, err := readAddr(io.MultiReader(bytes.NewReader(atyp[:]), r), make([]byte, MaxAddrLen))
+	return addr, flags, err
+}
+
+// SplitTarget is like SplitAddr but ignores flags set in the address type.
+func SplitTarget(b []byte) Addr {
+	if len(b) == 0 {
+		return nil
+	}
+	a := SplitAddr(append([]byte{b[0] &^ targetFlags}, b[1:]...))
+	if a == nil {
+		return nil
+	}
+	return b[:len(a)]
+}
+
+// WriteReply writes the reply of a server to a target address sent with
+// FlagReply: the reply code of err, nil for success, followed by the bound
+// address bnd, 0.0.0.0:0 if nil.
+func WriteReply(w io.Writer, err error, bnd Addr) error {
+	if bnd == nil {
+		bnd = Addr{AtypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	_, e := w.Write(append([]byte{byte(ReplyCode(err))}, bnd...))
+	return e
+}
+
+// ReadReply reads a reply written by WriteReply and returns the bound
+// address, or the Error of a reply telling a failure.
+func ReadReply(r io.Reader) (Addr, error) {
+	var code [1]byte
+	if _, err := io.ReadFull(r, code[:]); err != nil {
+		return nil, err
+	}
+	bnd, err := ReadAddr(r)
+	if err != nil {
+		return nil, err
+	}
+	if code[0] != 0 {
+		return bnd, Error(code[0])
+	}
+	return bnd, nil
+}
+
+// ReplyCode returns the reply code telling a client about err, the outcome of
+// dialing its target: 0 for success, ErrConnectionRefused,
+// ErrHostUnreachable or ErrNetworkUnreachable for the matching network
+// errors, the Error itself for an Error, possibly wrapped in a *net.OpError
+// by Dialer, and ErrGeneralFailure otherwise.
+func ReplyCode(err error) Error {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*net.OpError); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
+	if e, ok := err.(Error); ok { // the reply of an upstream proxy
+		return e
+	}
+	switch err {
+	case syscall.ECONNREFUSED:
+		return ErrConnectionRefused
+	case syscall.EHOSTUNREACH:
+		return ErrHostUnreachable
+	case syscall.ENETUNREACH:
+		return ErrNetworkUnreachable
+	}
+	if _, ok := err.(*net.DNSError); ok {
+		return ErrHostUnreachable
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return ErrHostUnreachable
+	}
+	return ErrGeneralFailure
+}
+
+// Request is a proxy request read by ReadRequest.
+type Request struct {
+	Cmd     byte   // CmdConnect, CmdBind or CmdUDPAssociate
+	Addr    Addr   // target address
+	Payload []byte // bytes to send to Addr before relaying
+	reply   func(err error, bnd Addr) error
+}
+
+// Reply tells the client the outcome err of the request, nil for success,
+// and the bound address bnd, 0.0.0.0:0 if nil. A BIND request is replied to
+// twice: with the address listening for the target, then with the address
+// of the target once connected.
+func (r *Request) Reply(err error, bnd Addr) error { return r.reply(err, bnd) }
+
+// ReadRequest is like HandshakeMixed but leaves the reply to the caller, so
+// that clients learn whether the target could be reached. SOCKS5 clients
+// may also send BIND requests. UDP ASSOCIATE is answered if udp is set,
+// returning InfoUDPAssociate.
+func ReadRequest(c net.Conn, auth Auth, udp bool) (*Request, error) {
+	bc := &bufConn{Conn: c, r: bufio.NewReader(c)}
+	first, err := bc.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Request{Cmd: CmdConnect}
+	switch first[0] {
+	case 5:
+		r.Cmd, r.Addr, err = handshake5(bc, auth, udp)
+		r.reply = func(err error, bnd Addr) error { return reply5(c, err, bnd) }
+	case 4:
+		r.Addr, err = handshake4(bc, auth)
+		r.reply = func(err error, _ Addr) error { return reply4(c, err) }
+	default:
+		var connect bool
+		r.Addr, r.Payload, connect, err = handshakeHTTP(bc, auth)
+		r.reply = func(err error, _ Addr) error { return replyHTTP(c, err, connect) }
+	}
+	if err != nil {
+		return r, err
+	}
+	if n := bc.r.Buffered(); n > 0 {
+		early, _ := bc.r.Peek(n)
+		r.Payload = append(r.Payload, early...)
+	}
+	return r, nil
+}
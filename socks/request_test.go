@@ -0,0 +1,67 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestReplyCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code Error
+	}{
+		{nil, 0},
+		{ErrTTLExpired, ErrTTLExpired},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: ErrConnectionRefused}, ErrConnectionRefused},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}, ErrConnectionRefused},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.EHOSTUNREACH}, ErrHostUnreachable},
+		{syscall.ENETUNREACH, ErrNetworkUnreachable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Name: "example.invalid"}}, ErrHostUnreachable},
+		{errors.New("other"), ErrGeneralFailure},
+	}
+	for _, tt := range tests {
+		if got := ReplyCode(tt.err); got != tt.code {
+			t.Errorf("ReplyCode(%v) = %d, want %d", tt.err, got, tt.code)
+		}
+	}
+}
+
+func TestReplyCodeOfUpstream(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() { // a proxy refusing every request
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		c.Write([]byte{5, MethodNoAuth})
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		if _, err := ReadAddr(c); err != nil {
+			return
+		}
+		c.Write([]byte{5, byte(ErrConnectionRefused), 0, AtypIPv4, 0, 0, 0, 0, 0, 0})
+	}()
+
+	d := &Dialer{Proxy: l.Addr().String()}
+	_, err = d.Dial("tcp", "127.0.0.1:1")
+	if err == nil {
+		t.Fatal("dial through a refusing proxy succeeded")
+	}
+	if code := ReplyCode(err); code != ErrConnectionRefused {
+		t.Errorf("ReplyCode(%v) = %d, want ErrConnectionRefused", err, code)
+	}
+}
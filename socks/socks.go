@@ -2,14 +2,15 @@
 package socks
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
 	"io"
 	"net"
 	"strconv"
+	"sync"
 )
 
-// UDPEnabled is the toggle for UDP support
-var UDPEnabled = false
-
 // SOCKS request commands as defined in RFC 1928 section 4.
 const (
 	CmdConnect      = 1
@@ -44,6 +45,70 @@ const (
 	InfoUDPAssociate        = Error(9)
 )
 
+// SOCKS authentication methods as defined in RFC 1928 section 3.
+const (
+	MethodNoAuth       = 0
+	MethodUserPass     = 2
+	MethodNoAcceptable = 0xFF
+)
+
+// ErrAuthFailed means a client offered no acceptable authentication method or
+// wrong credentials.
+var ErrAuthFailed = errors.New("SOCKS authentication failed")
+
+// Auth checks the username and password of a client.
+type Auth func(username, password string) bool
+
+// UserPassAuth returns an Auth accepting only username and password.
+func UserPassAuth(username, password string) Auth {
+	return func(u, p string) bool {
+		// check both without short-circuit so timing does not tell which is wrong
+		okUser := subtle.ConstantTimeCompare([]byte(u), []byte(username))
+		okPass := subtle.ConstantTimeCompare([]byte(p), []byte(password))
+		return okUser&okPass == 1
+	}
+}
+
+// authenticate selects the username/password method among methods offered by
+// the client and checks the credentials as described in RFC 1929.
+func authenticate(rw io.ReadWriter, methods []byte, auth Auth) error {
+	if bytes.IndexByte(methods, MethodUserPass) < 0 {
+		rw.Write([]byte{5, MethodNoAcceptable})
+		return ErrAuthFailed
+	}
+	if _, err := rw.Write([]byte{5, MethodUserPass}); err != nil {
+		return err
+	}
+	// read VER ULEN UNAME PLEN PASSWD
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != 1 {
+		rw.Write([]byte{1, 1})
+		return ErrAuthFailed
+	}
+	ulen := buf[1]
+	if _, err := io.ReadFull(rw, buf[:ulen]); err != nil {
+		return err
+	}
+	username := string(buf[:ulen])
+	if _, err := io.ReadFull(rw, buf[:1]); err != nil {
+		return err
+	}
+	plen := buf[0]
+	if _, err := io.ReadFull(rw, buf[:plen]); err != nil {
+		return err
+	}
+	password := string(buf[:plen])
+	if !auth(username, password) {
+		rw.Write([]byte{1, 1}) // VER STATUS: failure
+		return ErrAuthFailed
+	}
+	_, err := rw.Write([]byte{1, 0}) // VER STATUS: success
+	return err
+}
+
 // MaxAddrLen is the maximum size of SOCKS address in bytes.
 const MaxAddrLen = 1 + 1 + 255 + 2
 
@@ -179,45 +244,132 @@ func ParseAddr(s string) Addr {
 
 // Handshake fast-tracks SOCKS initialization to get target address to connect.
 func Handshake(rw io.ReadWriter) (Addr, error) {
+	return HandshakeAuth(rw, nil, false)
+}
+
+// HandshakeAuth is like Handshake but requires clients to authenticate with a
+// username and password accepted by auth. A nil auth requires no authentication.
+// UDP ASSOCIATE is answered if udp is set, returning InfoUDPAssociate.
+func HandshakeAuth(rw io.ReadWriter, auth Auth, udp bool) (Addr, error) {
+	cmd, addr, err := handshake5(rw, auth, udp)
+	if err != nil {
+		return addr, err
+	}
+	if cmd != CmdConnect {
+		reply5(rw, ErrCommandNotSupported, nil)
+		return nil, ErrCommandNotSupported
+	}
+	return addr, reply5(rw, nil, nil)
+}
+
+// handshake5 authenticates a SOCKS5 client and reads its request. UDP
+// ASSOCIATE is answered here, refused unless udp is set, CONNECT and BIND
+// are left to the caller.
+func handshake5(rw io.ReadWriter, auth Auth, udp bool) (byte, Addr, error) {
 	// Read RFC 1928 for request and reply structure and sizes.
 	buf := make([]byte, MaxAddrLen)
 	// read VER, NMETHODS, METHODS
 	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	nmethods := buf[1]
 	if _, err := io.ReadFull(rw, buf[:nmethods]); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
-	// write VER METHOD
-	if _, err := rw.Write([]byte{5, 0}); err != nil {
-		return nil, err
+	if auth == nil {
+		// write VER METHOD
+		if _, err := rw.Write([]byte{5, MethodNoAuth}); err != nil {
+			return 0, nil, err
+		}
+	} else if err := authenticate(rw, buf[:nmethods], auth); err != nil {
+		return 0, nil, err
 	}
 	// read VER CMD RSV ATYP DST.ADDR DST.PORT
 	if _, err := io.ReadFull(rw, buf[:3]); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	cmd := buf[1]
 	addr, err := readAddr(rw, buf)
+	if err == ErrAddressNotSupported {
+		reply5(rw, err, nil)
+	}
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	switch cmd {
-	case CmdConnect:
-		_, err = rw.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}) // SOCKS v5, reply succeeded
+	case CmdConnect, CmdBind:
 	case CmdUDPAssociate:
-		if !UDPEnabled {
-			return nil, ErrCommandNotSupported
+		if !udp {
+			reply5(rw, ErrCommandNotSupported, nil)
+			return 0, nil, ErrCommandNotSupported
 		}
 		listenAddr := ParseAddr(rw.(net.Conn).LocalAddr().String())
-		_, err = rw.Write(append([]byte{5, 0, 0}, listenAddr...)) // SOCKS v5, reply succeeded
-		if err != nil {
-			return nil, ErrCommandNotSupported
+		if err := reply5(rw, nil, listenAddr); err != nil {
+			return 0, nil, ErrCommandNotSupported
 		}
-		err = InfoUDPAssociate
+		return cmd, addr, InfoUDPAssociate
 	default:
-		return nil, ErrCommandNotSupported
+		reply5(rw, ErrCommandNotSupported, nil)
+		return 0, nil, ErrCommandNotSupported
+	}
+	return cmd, addr, nil // skip VER, CMD, RSV fields
+}
+
+// reply5 writes a SOCKS5 reply telling the outcome err of a request, nil
+// for success, and the bound address bnd, 0.0.0.0:0 if nil.
+func reply5(w io.Writer, err error, bnd Addr) error {
+	if bnd == nil {
+		bnd = Addr{AtypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	_, e := w.Write(append([]byte{5, byte(ReplyCode(err)), 0}, bnd...)) // SOCKS v5, REP, RSV
+	return e
+}
+
+// UDPClients tracks the IP addresses of clients holding a UDP ASSOCIATE
+// connection, so that a UDP relay can drop datagrams from anyone else.
+type UDPClients struct {
+	sync.Mutex
+	m map[string]int
+}
+
+func NewUDPClients() *UDPClients {
+	return &UDPClients{m: make(map[string]int)}
+}
+
+// Hold allows the IP address of c until c is closed by the client.
+func (u *UDPClients) Hold(c net.Conn) {
+	ip := hostOf(c.RemoteAddr())
+	u.Lock()
+	u.m[ip]++
+	u.Unlock()
+
+	defer func() {
+		u.Lock()
+		if u.m[ip]--; u.m[ip] <= 0 {
+			delete(u.m, ip)
+		}
+		u.Unlock()
+	}()
+
+	buf := make([]byte, 1)
+	for {
+		if _, err := c.Read(buf); err != nil {
+			return
+		}
 	}
+}
 
-	return addr, err // skip VER, CMD, RSV fields
+// Allowed reports whether addr belongs to a client holding a UDP ASSOCIATE connection.
+func (u *UDPClients) Allowed(addr net.Addr) bool {
+	u.Lock()
+	defer u.Unlock()
+	return u.m[hostOf(addr)] > 0
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
 }
@@ -0,0 +1,124 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestUserPassAuth(t *testing.T) {
+	auth := UserPassAuth("admin", "secret")
+	tests := []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"admin", "secret", true},
+		{"admin", "wrong", false},
+		{"root", "secret", false},
+		{"admi", "secret", false},
+		{"admin", "secret!", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if ok := auth(tt.user, tt.pass); ok != tt.ok {
+			t.Errorf("auth(%q, %q) = %v, want %v", tt.user, tt.pass, ok, tt.ok)
+		}
+	}
+}
+
+func TestHandshakeAuth(t *testing.T) {
+	target := ParseAddr("example.com:80")
+	tests := []struct {
+		name       string
+		methods    []byte
+		user, pass string
+		method     byte // selected by the server
+		status     byte // of the username/password check
+		err        error
+	}{
+		{"success", []byte{MethodNoAuth, MethodUserPass}, "admin", "secret", MethodUserPass, 0, nil},
+		{"wrong password", []byte{MethodUserPass}, "admin", "wrong", MethodUserPass, 1, ErrAuthFailed},
+		{"wrong username", []byte{MethodUserPass}, "nobody", "secret", MethodUserPass, 1, ErrAuthFailed},
+		{"no username/password method", []byte{MethodNoAuth}, "", "", MethodNoAcceptable, 0, ErrAuthFailed},
+	}
+	for _, tt := range tests {
+		c, s := net.Pipe()
+		type result struct {
+			addr Addr
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			addr, err := HandshakeAuth(s, UserPassAuth("admin", "secret"), false)
+			s.Close()
+			done <- result{addr, err}
+		}()
+
+		c.Write(append([]byte{5, byte(len(tt.methods))}, tt.methods...))
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if buf[0] != 5 || buf[1] != tt.method {
+			t.Errorf("%s: server selected method %d, want %d", tt.name, buf[1], tt.method)
+		}
+		if tt.method == MethodUserPass {
+			req := append([]byte{1, byte(len(tt.user))}, tt.user...)
+			req = append(append(req, byte(len(tt.pass))), tt.pass...)
+			c.Write(req)
+			if _, err := io.ReadFull(c, buf); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if buf[0] != 1 || buf[1] != tt.status {
+				t.Errorf("%s: got status %v, want %d", tt.name, buf, tt.status)
+			}
+		}
+		if tt.err == nil {
+			c.Write(append([]byte{5, CmdConnect, 0}, target...))
+			reply := make([]byte, 10)
+			if _, err := io.ReadFull(c, reply); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if reply[1] != 0 {
+				t.Errorf("%s: got reply %d to CONNECT", tt.name, reply[1])
+			}
+		}
+		r := <-done
+		c.Close()
+		if r.err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, r.err, tt.err)
+		}
+		if tt.err == nil && !bytes.Equal(r.addr, target) {
+			t.Errorf("%s: got target %v, want %v", tt.name, r.addr, target)
+		}
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	for _, udp := range []bool{true, false} {
+		c, s := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			_, err := ReadRequest(s, nil, udp)
+			s.Close()
+			done <- err
+		}()
+		go c.Write(append([]byte{5, 1, MethodNoAuth, 5, CmdUDPAssociate, 0}, ParseAddr("0.0.0.0:0")...))
+		reply := make([]byte, 12)
+		if _, err := io.ReadFull(c, reply); err != nil {
+			t.Fatalf("udp %v: %v", udp, err)
+		}
+		err, code, want := <-done, reply[3], ErrCommandNotSupported
+		if udp {
+			want = 0
+		}
+		if code != byte(want) {
+			t.Errorf("udp %v: replied %d, want %d", udp, code, want)
+		}
+		if udp && err != InfoUDPAssociate || !udp && err != ErrCommandNotSupported {
+			t.Errorf("udp %v: got error %v", udp, err)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,105 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrBadUDPRequest means a SOCKS5 UDP request has a malformed header.
+var ErrBadUDPRequest = errors.New("malformed SOCKS5 UDP request")
+
+const (
+	fragTimeout   = 5 * time.Second // reassembly timer, no less than 5 seconds as required by RFC 1928
+	fragMaxQueues = 1024            // clients reassembling at the same time
+	fragMaxSize   = 64 * 1024       // bytes of a reassembled datagram
+	fragEnd       = 0x80            // FRAG bit marking the last fragment
+)
+
+// fragQueue is the reassembly queue of a client.
+type fragQueue struct {
+	addr     Addr
+	pos      byte // position of the last fragment received
+	data     []byte
+	deadline time.Time
+}
+
+// UDPReassembler reassembles the fragmented SOCKS5 UDP requests of clients as
+// described in section 7 of RFC 1928. It is not safe for concurrent use.
+type UDPReassembler struct {
+	queues map[string]*fragQueue
+}
+
+// NewUDPReassembler returns a UDPReassembler with no datagram in progress.
+func NewUDPReassembler() *UDPReassembler {
+	return &UDPReassembler{queues: make(map[string]*fragQueue)}
+}
+
+// Add takes a UDP request b from client and returns the datagram to relay,
+// the target address followed by the data, once complete, or nil while
+// waiting for more fragments. Fragments must arrive in order with the same
+// target address before the reassembly timer expires, otherwise the
+// datagram is dropped.
+func (r *UDPReassembler) Add(client net.Addr, b []byte) ([]byte, error) {
+	// +----+------+------+----------+----------+----------+
+	// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+	// +----+------+------+----------+----------+----------+
+	if len(b) < 3 || b[0] != 0 || b[1] != 0 {
+		return nil, ErrBadUDPRequest
+	}
+	addr := SplitAddr(b[3:])
+	if addr == nil {
+		return nil, ErrBadUDPRequest
+	}
+	frag := b[2]
+	key := client.String()
+	if frag == 0 { // standalone datagram
+		delete(r.queues, key)
+		return b[3:], nil
+	}
+	pos := frag &^ fragEnd
+	if pos == 0 {
+		return nil, ErrBadUDPRequest
+	}
+	data := b[3+len(addr):]
+
+	now := time.Now()
+	q := r.queues[key]
+	if q != nil && (now.After(q.deadline) || pos != q.pos+1 || !bytes.Equal(addr, q.addr) ||
+		len(q.data)+len(data) > fragMaxSize) {
+		delete(r.queues, key) // expired, out of order or too large
+		q = nil
+	}
+	if q == nil {
+		if pos != 1 {
+			return nil, nil // the start of the datagram is lost
+		}
+		if len(r.queues) >= fragMaxQueues {
+			r.expire(now)
+			if len(r.queues) >= fragMaxQueues {
+				return nil, nil
+			}
+		}
+		q = &fragQueue{addr: append(Addr{}, addr...), deadline: now.Add(fragTimeout)}
+		q.data = append(q.data, addr...)
+		r.queues[key] = q
+	}
+	q.pos = pos
+	q.data = append(q.data, data...)
+
+	if frag&fragEnd == 0 {
+		return nil, nil
+	}
+	delete(r.queues, key)
+	return q.data, nil
+}
+
+// expire drops the queues whose timer expired by now.
+func (r *UDPReassembler) expire(now time.Time) {
+	for k, q := range r.queues {
+		if now.After(q.deadline) {
+			delete(r.queues, k)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package socks
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func udpRequest(frag byte, target, data string) []byte {
+	return append(append([]byte{0, 0, frag}, ParseAddr(target)...), data...)
+}
+
+func datagram(target, data string) string {
+	return string(append(ParseAddr(target), data...))
+}
+
+func TestUDPReassembler(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	b := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	type add struct {
+		client net.Addr
+		req    []byte
+		want   string // datagram returned, "" for none
+	}
+	tests := []struct {
+		name string
+		adds []add
+	}{
+		{"standalone", []add{
+			{a, udpRequest(0, "1.2.3.4:53", "query"), datagram("1.2.3.4:53", "query")},
+		}},
+		{"in order", []add{
+			{a, udpRequest(1, "1.2.3.4:53", "ab"), ""},
+			{a, udpRequest(2, "1.2.3.4:53", "cd"), ""},
+			{a, udpRequest(3|fragEnd, "1.2.3.4:53", "ef"), datagram("1.2.3.4:53", "abcdef")},
+		}},
+		{"out of order", []add{
+			{a, udpRequest(1, "1.2.3.4:53", "ab"), ""},
+			{a, udpRequest(3, "1.2.3.4:53", "ef"), ""},
+			{a, udpRequest(2|fragEnd, "1.2.3.4:53", "cd"), ""},
+			{a, udpRequest(1, "1.2.3.4:53", "gh"), ""},
+			{a, udpRequest(2|fragEnd, "1.2.3.4:53", "ij"), datagram("1.2.3.4:53", "ghij")},
+		}},
+		{"lost start", []add{
+			{a, udpRequest(2|fragEnd, "1.2.3.4:53", "cd"), ""},
+		}},
+		{"target changed", []add{
+			{a, udpRequest(1, "1.2.3.4:53", "ab"), ""},
+			{a, udpRequest(2|fragEnd, "5.6.7.8:53", "cd"), ""},
+		}},
+		{"standalone drops the queue", []add{
+			{a, udpRequest(1, "1.2.3.4:53", "ab"), ""},
+			{a, udpRequest(0, "1.2.3.4:53", "xy"), datagram("1.2.3.4:53", "xy")},
+			{a, udpRequest(2|fragEnd, "1.2.3.4:53", "cd"), ""},
+		}},
+		{"clients apart", []add{
+			{a, udpRequest(1, "1.2.3.4:53", "a1"), ""},
+			{b, udpRequest(1, "example.com:53", "b1"), ""},
+			{a, udpRequest(2|fragEnd, "1.2.3.4:53", "a2"), datagram("1.2.3.4:53", "a1a2")},
+			{b, udpRequest(2|fragEnd, "example.com:53", "b2"), datagram("example.com:53", "b1b2")},
+		}},
+	}
+	for _, tt := range tests {
+		r := NewUDPReassembler()
+		for i, add := range tt.adds {
+			got, err := r.Add(add.client, add.req)
+			if err != nil {
+				t.Errorf("%s: fragment %d: %v", tt.name, i, err)
+			}
+			if string(got) != add.want {
+				t.Errorf("%s: fragment %d: got %q, want %q", tt.name, i, got, add.want)
+			}
+		}
+	}
+}
+
+func TestUDPReassemblerBadRequest(t *testing.T) {
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	for _, b := range [][]byte{
+		{0, 0},
+		{1, 0, 0, AtypIPv4, 1, 2, 3, 4, 0, 53},
+		{0, 0, 0, AtypIPv4, 1, 2},
+		{0, 0, fragEnd, AtypIPv4, 1, 2, 3, 4, 0, 53},
+	} {
+		if _, err := NewUDPReassembler().Add(client, b); err != ErrBadUDPRequest {
+			t.Errorf("Add(%v) = %v, want ErrBadUDPRequest", b, err)
+		}
+	}
+}
+
+func TestUDPReassemblerTimeout(t *testing.T) {
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	r := NewUDPReassembler()
+	r.Add(client, udpRequest(1, "1.2.3.4:53", "ab"))
+	r.queues[client.String()].deadline = time.Now().Add(-time.Millisecond)
+	if got, _ := r.Add(client, udpRequest(2|fragEnd, "1.2.3.4:53", "cd")); got != nil {
+		t.Errorf("got %q after the reassembly timer expired", got)
+	}
+
+	// Queues of clients whose timer expired make room for new ones.
+	for i := 0; i < fragMaxQueues; i++ {
+		c := &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 1}
+		r.Add(c, udpRequest(1, "1.2.3.4:53", strconv.Itoa(i)))
+	}
+	r.Add(client, udpRequest(1, "1.2.3.4:53", "ab"))
+	if got, _ := r.Add(client, udpRequest(2|fragEnd, "1.2.3.4:53", "cd")); got != nil {
+		t.Errorf("got %q with %d queues in progress", got, fragMaxQueues)
+	}
+	for _, q := range r.queues {
+		q.deadline = time.Now().Add(-time.Millisecond)
+	}
+	r.Add(client, udpRequest(1, "1.2.3.4:53", "ab"))
+	if got, _ := r.Add(client, udpRequest(2|fragEnd, "1.2.3.4:53", "cd")); string(got) != datagram("1.2.3.4:53", "abcd") {
+		t.Errorf("got %q once the other queues expired", got)
+	}
+}
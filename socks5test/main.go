@@ -5,28 +5,30 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"sync"
 	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
 var (
 	parallel = flag.Int("p", 10, "parallel of connections")
 	socks5   = flag.String("socks5", "127.0.0.1:1080", "Socks5 proxy")
 	getURL   = flag.String("url", "https://abs.fobwifi.com/api/1/ip", "url to test")
+	username = flag.String("user", "", "Socks5 username")
+	password = flag.String("pass", "", "Socks5 password")
 )
 
 func main() {
 	flag.Parse()
-	proxy := func(_ *http.Request) (*url.URL, error) {
-		return url.Parse("socks5://" + *socks5)
-	}
-	transport := &http.Transport{Proxy: proxy}
+	dialer := &socks.Dialer{Proxy: *socks5, Username: *username, Password: *password}
+	transport := &http.Transport{DialContext: dialer.DialContext}
 	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
 	wg := sync.WaitGroup{}
 	for i := 0; i < *parallel; i++ {
 		wg.Add(1)
 		go func(no int) {
+			defer wg.Done()
 			res, err := client.Get(*getURL)
 			if err != nil {
 				log.Print(err)
@@ -35,7 +37,6 @@ func main() {
 			defer res.Body.Close()
 			ioutil.ReadAll(res.Body)
 			log.Printf("[%d] finish!", no)
-			wg.Done()
 		}(i)
 	}
 	wg.Wait()
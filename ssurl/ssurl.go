@@ -0,0 +1,139 @@
+// Package ssurl parses and formats ss:// URLs as described in SIP002, as well
+// as the legacy form with the whole URL base64-encoded.
+package ssurl
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ErrInvalidURL means a string is not an ss:// URL of any known form.
+var ErrInvalidURL = errors.New("invalid ss:// URL")
+
+// URL is the configuration of a Shadowsocks server carried by an ss:// URL.
+type URL struct {
+	Cipher     string
+	Password   string
+	Host       string // host:port
+	Plugin     string // SIP003 plugin name, empty if none
+	PluginOpts string // options of the plugin, e.g. "obfs=http;obfs-host=example.com"
+	Tag        string // human-readable name of the server
+}
+
+// Parse parses s in the SIP002 form
+//
+//	ss://base64url(cipher:password)@host:port/?plugin=name;opts#tag
+//
+// where the userinfo may also be the percent-encoded cipher:password, as
+// required for 2022 ciphers, or in the legacy form
+//
+//	ss://base64(cipher:password@host:port)#tag
+func Parse(s string) (*URL, error) {
+	if !strings.HasPrefix(s, "ss://") {
+		return nil, ErrInvalidURL
+	}
+	rest, tag := s[len("ss://"):], ""
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		t, err := url.PathUnescape(rest[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		rest, tag = rest[:i], t
+	}
+	if !strings.ContainsAny(rest, "@:") { // legacy: everything but the tag is base64
+		b, err := decodeBase64(rest)
+		if err != nil {
+			return nil, ErrInvalidURL
+		}
+		rest = string(b)
+		i := strings.LastIndexByte(rest, '@')
+		if i < 0 {
+			return nil, ErrInvalidURL
+		}
+		u := &URL{Host: rest[i+1:], Tag: tag}
+		if !u.setUserinfo(rest[:i]) || !validHost(u.Host) {
+			return nil, ErrInvalidURL
+		}
+		return u, nil
+	}
+
+	pu, err := url.Parse("ss://" + rest)
+	if err != nil {
+		return nil, err
+	}
+	if pu.User == nil || !validHost(pu.Host) || (pu.Path != "" && pu.Path != "/") {
+		return nil, ErrInvalidURL
+	}
+	u := &URL{Host: pu.Host, Tag: tag}
+	if password, ok := pu.User.Password(); ok {
+		u.Cipher, u.Password = pu.User.Username(), password
+	} else if b, err := decodeBase64(pu.User.Username()); err != nil || !u.setUserinfo(string(b)) {
+		return nil, ErrInvalidURL
+	}
+	if u.Cipher == "" {
+		return nil, ErrInvalidURL
+	}
+	if p := pu.Query().Get("plugin"); p != "" {
+		u.Plugin, u.PluginOpts = p, ""
+		if i := strings.IndexByte(p, ';'); i >= 0 {
+			u.Plugin, u.PluginOpts = p[:i], p[i+1:]
+		}
+	}
+	return u, nil
+}
+
+// setUserinfo splits cipher:password into u.
+func (u *URL) setUserinfo(s string) bool {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 {
+		return false
+	}
+	u.Cipher, u.Password = s[:i], s[i+1:]
+	return true
+}
+
+// String returns u in the SIP002 form. The userinfo is base64url-encoded
+// except for 2022 ciphers, whose userinfo is percent-encoded as SIP002 requires.
+func (u *URL) String() string {
+	var userinfo string
+	if strings.HasPrefix(strings.ToUpper(u.Cipher), "2022-") {
+		userinfo = escape(u.Cipher) + ":" + escape(u.Password)
+	} else {
+		userinfo = base64.RawURLEncoding.EncodeToString([]byte(u.Cipher + ":" + u.Password))
+	}
+	s := "ss://" + userinfo + "@" + u.Host
+	if u.Plugin != "" {
+		p := u.Plugin
+		if u.PluginOpts != "" {
+			p += ";" + u.PluginOpts
+		}
+		s += "/?plugin=" + url.QueryEscape(p)
+	}
+	if u.Tag != "" {
+		s += "#" + url.PathEscape(u.Tag)
+	}
+	return s
+}
+
+// escape percent-encodes everything but unreserved characters, so base64
+// keys come out as in the examples of SIP002.
+func escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func validHost(hostport string) bool {
+	_, port, err := net.SplitHostPort(hostport)
+	return err == nil && port != ""
+}
+
+// decodeBase64 decodes s in the standard or URL alphabet, with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
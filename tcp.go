@@ -1,49 +1,82 @@
 package main
 
 import (
+	"context"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
-// Create a SOCKS server listening on addr and proxy to server.
-func socksLocal(addr, server string, shadow func(net.Conn) net.Conn) {
-	logf("SOCKS proxy %s <-> %s", addr, server)
-	tcpLocal(addr, server, shadow, func(c net.Conn) (socks.Addr, error) { return socks.Handshake(c) })
+// Create a SOCKS and HTTP proxy server listening on addr and proxy to server.
+// Clients must authenticate if auth is not nil, may UDP ASSOCIATE if udp is
+// set, and those holding a UDP ASSOCIATE connection are tracked in
+// udpClients if not nil. If reply is set, clients are replied to once server
+// reached the target, and SOCKS5 clients may BIND, which only servers of this
+// program support.
+func socksLocal(ctx context.Context, addr, server string, shadow func(net.Conn) net.Conn, auth socks.Auth, udp bool, udpClients *socks.UDPClients, reply bool) {
+	logf("SOCKS/HTTP proxy %s <-> %s", addr, server)
+	tcpLocal(ctx, addr, server, shadow, reply, func(c net.Conn) (*socks.Request, error) {
+		r, err := socks.ReadRequest(c, auth, udp)
+		if err == socks.InfoUDPAssociate && udpClients != nil {
+			udpClients.Hold(c)
+		}
+		if err == nil && !reply {
+			if r.Cmd != socks.CmdConnect {
+				r.Reply(socks.ErrCommandNotSupported, nil)
+				return nil, socks.ErrCommandNotSupported
+			}
+			err = r.Reply(nil, nil)
+		}
+		return r, err
+	})
 }
 
 // Create a TCP tunnel from addr to target via server.
-func tcpTun(addr, server, target string, shadow func(net.Conn) net.Conn) {
+func tcpTun(ctx context.Context, addr, server, target string, shadow func(net.Conn) net.Conn) {
 	tgt := socks.ParseAddr(target)
 	if tgt == nil {
 		logf("invalid target address %q", target)
 		return
 	}
 	logf("TCP tunnel %s <-> %s <-> %s", addr, server, target)
-	tcpLocal(addr, server, shadow, func(net.Conn) (socks.Addr, error) { return tgt, nil })
+	tcpLocal(ctx, addr, server, shadow, false, func(net.Conn) (*socks.Request, error) {
+		return &socks.Request{Cmd: socks.CmdConnect, Addr: tgt}, nil
+	})
 }
 
-// Listen on addr and proxy to server to reach target from getAddr.
-func tcpLocal(addr, server string, shadow func(net.Conn) net.Conn, getAddr func(net.Conn) (socks.Addr, error)) {
+// Listen on addr and proxy to server the requests from getRequest until ctx is
+// done. If reply is set, the requests are replied to with the replies of server.
+func tcpLocal(ctx context.Context, addr, server string, shadow func(net.Conn) net.Conn, reply bool, getRequest func(net.Conn) (*socks.Request, error)) {
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		logf("failed to listen on %s: %v", addr, err)
 		return
 	}
 
+	closeWhenDone(ctx, l)
+	l = activeConns.listener(l)
+
+	m := metrics.client(server)
 	for {
 		c, err := l.Accept()
 		if err != nil {
-			logf("failed to accept: %s", err)
-			continue
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logf("failed to accept: %s", err)
+				continue
+			}
+			return
 		}
 
 		go func() {
 			defer c.Close()
-			c.(*net.TCPConn).SetKeepAlive(true)
-			tgt, err := getAddr(c)
+			if tc, ok := c.(*net.TCPConn); ok {
+				tc.SetKeepAlive(true)
+			}
+			r, err := getRequest(c)
 			if err != nil {
 
 				// UDP: keep the connection until disconnect then free the UDP socket
@@ -64,21 +97,46 @@ func tcpLocal(addr, server string, shadow func(net.Conn) net.Conn, getAddr func(
 				return
 			}
 
-			rc, err := net.Dial("tcp", server)
+			rc, err := m.dialServer(server)
 			if err != nil {
 				logf("failed to connect to server %v: %v", server, err)
+				if reply {
+					r.Reply(err, nil)
+				}
 				return
 			}
-			defer rc.Close()
 			rc.(*net.TCPConn).SetKeepAlive(true)
+			rc = m.conn(rc)
+			defer rc.Close()
 			rc = shadow(rc)
 
-			if _, err = rc.Write(tgt); err != nil {
+			tgt := append([]byte{}, r.Addr...)
+			replies := 0
+			if reply {
+				tgt[0] |= socks.FlagReply
+				replies = 1
+				if r.Cmd == socks.CmdBind {
+					tgt[0] |= socks.FlagBind
+					replies = 2
+				}
+			}
+			if _, err = rc.Write(append(tgt, r.Payload...)); err != nil {
 				logf("failed to send target address: %v", err)
+				if reply {
+					r.Reply(err, nil)
+				}
 				return
 			}
+			for i := 0; i < replies; i++ {
+				bnd, err := socks.ReadReply(rc)
+				r.Reply(err, bnd)
+				if err != nil {
+					logf("failed to reach %s: %v", r.Addr, err)
+					return
+				}
+			}
 
-			logf("proxy %s <-> %s <-> %s", c.RemoteAddr(), server, tgt)
+			logf("proxy %s <-> %s <-> %s", c.RemoteAddr(), server, r.Addr)
 			_, _, err = relay(rc, c)
 			if err != nil {
 				if err, ok := err.(net.Error); ok && err.Timeout() {
@@ -90,50 +148,162 @@ func tcpLocal(addr, server string, shadow func(net.Conn) net.Conn, getAddr func(
 	}
 }
 
-// Listen on addr for incoming connections.
-func tcpRemote(addr string, shadow func(net.Conn) net.Conn) {
+// Listen on addr for incoming connections of users and connect to their targets
+// through out until ctx is done. Connections failing authentication go to probe.
+func tcpRemote(ctx context.Context, addr string, users *userTable, out outbound, probe probeDefense) {
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		logf("failed to listen on %s: %v", addr, err)
 		return
 	}
 
+	closeWhenDone(ctx, l)
 	logf("listening TCP on %s", addr)
+	tcpServe(activeConns.listener(l), users, out, probe)
+}
+
+// tcpServe serves the connections of users accepted from l until l is closed.
+func tcpServe(l net.Listener, users *userTable, out outbound, probe probeDefense) {
 	for {
 		c, err := l.Accept()
 		if err != nil {
-			logf("failed to accept: %v", err)
-			continue
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logf("failed to accept: %v", err)
+				continue
+			}
+			return
 		}
 
 		go func() {
 			defer c.Close()
-			c.(*net.TCPConn).SetKeepAlive(true)
-			c = shadow(c)
-
-			tgt, err := socks.ReadAddr(c)
-			if err != nil {
-				logf("failed to get target address: %v", err)
-				return
+			if tc, ok := c.(*net.TCPConn); ok {
+				tc.SetKeepAlive(true)
 			}
-
-			rc, err := net.Dial("tcp", tgt.String())
+			g := probe.guard(c)
+			sc, k, err := users.StreamConn(g)
 			if err != nil {
-				logf("failed to connect to target: %v", err)
+				logf("failed to identify user of %s: %v", c.RemoteAddr(), err)
+				g.fail()
 				return
 			}
-			defer rc.Close()
-			rc.(*net.TCPConn).SetKeepAlive(true)
+			serveStream(sc, k, out, g)
+		}()
+	}
+}
 
-			logf("proxy %s <-> %s", c.RemoteAddr(), tgt)
-			_, _, err = relay(c, rc)
-			if err != nil {
-				if err, ok := err.(net.Error); ok && err.Timeout() {
-					return // ignore i/o timeout
-				}
-				logf("relay error: %v", err)
+// serveStream proxies c, authenticated by key k, to the target address read
+// from it through out. The target address failing to decrypt goes to g.
+func serveStream(c net.Conn, k *userKey, out outbound, g *probeGuard) {
+	u := k.user
+	tgt, flags, err := socks.ReadTarget(c)
+	if err != nil {
+		atomic.AddUint64(&u.fails, 1)
+		u.logf("failed to get target address: %v", err)
+		g.fail()
+		return
+	}
+	g.pass()
+
+	if !u.acquire() {
+		u.logf("too many connections, rejecting %s", c.RemoteAddr())
+		return
+	}
+	defer u.release()
+	if flags&socks.FlagBind != 0 {
+		if _, ok := out.(direct); !ok { // the connection from the target would bypass the proxy
+			u.logf("rejecting BIND for %s through an upstream proxy", tgt)
+			socks.WriteReply(c, socks.ErrCommandNotSupported, nil)
+			return
+		}
+		serveBind(c, u, tgt)
+		return
+	}
+
+	rc, err := metrics.dialTarget(out, tgt.String())
+	if flags&socks.FlagReply != 0 {
+		var bnd socks.Addr
+		if err == nil {
+			bnd = socks.ParseAddr(rc.LocalAddr().String())
+		}
+		if err := socks.WriteReply(c, err, bnd); err != nil {
+			u.logf("failed to reply: %v", err)
+			if rc != nil {
+				rc.Close()
 			}
-		}()
+			return
+		}
+	}
+	if err != nil {
+		u.logf("failed to connect to target: %v", err)
+		return
+	}
+	defer rc.Close()
+	rc.(*net.TCPConn).SetKeepAlive(true)
+
+	if !k.expires.IsZero() {
+		u.logf("proxy %s <-> %s with retiring key %s", c.RemoteAddr(), tgt, k.name)
+	} else {
+		u.logf("proxy %s <-> %s", c.RemoteAddr(), tgt)
+	}
+	_, _, err = relay(c, rc)
+	if err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return // ignore i/o timeout
+		}
+		u.logf("relay error: %v", err)
+	}
+}
+
+// bindTimeout is how long a BIND waits for the connection from the target.
+const bindTimeout = 2 * time.Minute
+
+// serveBind serves a BIND request of c: it listens next to the address c was
+// accepted on for a connection from tgt, and proxies c of user u to it.
+func serveBind(c net.Conn, u *user, tgt socks.Addr) {
+	host, _, _ := net.SplitHostPort(c.LocalAddr().String())
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(host)})
+	if err != nil {
+		u.logf("failed to bind for %s: %v", tgt, err)
+		socks.WriteReply(c, err, nil)
+		return
+	}
+	defer l.Close()
+	l.SetDeadline(time.Now().Add(bindTimeout))
+	if err := socks.WriteReply(c, nil, socks.ParseAddr(l.Addr().String())); err != nil {
+		u.logf("failed to reply: %v", err)
+		return
+	}
+
+	u.logf("bind %s for %s", l.Addr(), tgt)
+	rc, err := l.AcceptTCP()
+	if err != nil {
+		u.logf("failed to accept from %s: %v", tgt, err)
+		socks.WriteReply(c, err, nil)
+		return
+	}
+	defer rc.Close()
+	l.Close()
+
+	// Only the target may connect if its IP address is known.
+	tgtHost, _, _ := net.SplitHostPort(tgt.String())
+	if ip := net.ParseIP(tgtHost); ip != nil && !ip.IsUnspecified() && !ip.Equal(rc.RemoteAddr().(*net.TCPAddr).IP) {
+		u.logf("rejecting %s bound for %s", rc.RemoteAddr(), tgt)
+		socks.WriteReply(c, socks.ErrConnectionNotAllowed, nil)
+		return
+	}
+	if err := socks.WriteReply(c, nil, socks.ParseAddr(rc.RemoteAddr().String())); err != nil {
+		u.logf("failed to reply: %v", err)
+		return
+	}
+	rc.SetKeepAlive(true)
+
+	u.logf("proxy %s <-> %s", c.RemoteAddr(), rc.RemoteAddr())
+	_, _, err = relay(c, rc)
+	if err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return // ignore i/o timeout
+		}
+		u.logf("relay error: %v", err)
 	}
 }
 
@@ -163,3 +333,96 @@ func relay(left, right net.Conn) (int64, int64, error) {
 	}
 	return n, rs.N, err
 }
+
+// connSet tracks the connections accepted from its listeners to close them
+// all at once.
+type connSet struct {
+	sync.Mutex
+	m map[*setConn]struct{}
+}
+
+func newConnSet() *connSet {
+	return &connSet{m: make(map[*setConn]struct{})}
+}
+
+// activeConns are all the TCP connections being served, drained on shutdown.
+var activeConns = newConnSet()
+
+// closeWhenDone closes c once ctx is done.
+func closeWhenDone(ctx context.Context, c io.Closer) {
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+}
+
+// listener returns l adding the connections it accepts to s.
+func (s *connSet) listener(l net.Listener) net.Listener {
+	return &setListener{Listener: l, s: s}
+}
+
+func (s *connSet) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.m)
+}
+
+// drain waits for the connections of s to close until ctx is done, then
+// closes the rest. Returns how many closed by themselves and how many were
+// closed.
+func (s *connSet) drain(ctx context.Context) (drained, killed int) {
+	n := s.len()
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for s.len() > 0 {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			killed = s.closeAll()
+			return n - killed, killed
+		}
+	}
+	return n, 0
+}
+
+// closeAll closes the connections of s and returns how many there were.
+func (s *connSet) closeAll() int {
+	s.Lock()
+	conns := s.m
+	s.m = make(map[*setConn]struct{})
+	s.Unlock()
+	for c := range conns {
+		c.Conn.Close()
+	}
+	return len(conns)
+}
+
+type setListener struct {
+	net.Listener
+	s *connSet
+}
+
+func (l *setListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	sc := &setConn{Conn: c, s: l.s}
+	l.s.Lock()
+	l.s.m[sc] = struct{}{}
+	l.s.Unlock()
+	return sc, nil
+}
+
+// setConn leaves its connSet once closed.
+type setConn struct {
+	net.Conn
+	s *connSet
+}
+
+func (c *setConn) Close() error {
+	c.s.Lock()
+	delete(c.s.m, c)
+	c.s.Unlock()
+	return c.Conn.Close()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net"
 	"syscall"
@@ -15,19 +16,28 @@ const (
 )
 
 // Listen on addr for netfilter redirected TCP connections
-func redirLocal(addr, server string, shadow func(net.Conn) net.Conn) {
+func redirLocal(ctx context.Context, addr, server string, shadow func(net.Conn) net.Conn) {
 	logf("TCP redirect %s <-> %s", addr, server)
-	tcpLocal(addr, server, shadow, func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, false) })
+	tcpLocal(ctx, addr, server, shadow, false, func(c net.Conn) (*socks.Request, error) {
+		tgt, err := getOrigDst(c, false)
+		return &socks.Request{Cmd: socks.CmdConnect, Addr: tgt}, err
+	})
 }
 
 // Listen on addr for netfilter redirected TCP IPv6 connections.
-func redir6Local(addr, server string, shadow func(net.Conn) net.Conn) {
+func redir6Local(ctx context.Context, addr, server string, shadow func(net.Conn) net.Conn) {
 	logf("TCP6 redirect %s <-> %s", addr, server)
-	tcpLocal(addr, server, shadow, func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, true) })
+	tcpLocal(ctx, addr, server, shadow, false, func(c net.Conn) (*socks.Request, error) {
+		tgt, err := getOrigDst(c, true)
+		return &socks.Request{Cmd: socks.CmdConnect, Addr: tgt}, err
+	})
 }
 
 // Get the original destination of a TCP connection.
 func getOrigDst(conn net.Conn, ipv6 bool) (socks.Addr, error) {
+	if sc, ok := conn.(*setConn); ok {
+		conn = sc.Conn
+	}
 	c, ok := conn.(*net.TCPConn)
 	if !ok {
 		return nil, errors.New("only work with TCP connection")
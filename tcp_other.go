@@ -2,12 +2,15 @@
 
 package main
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
-func redirLocal(addr, server string, shadow func(net.Conn) net.Conn) {
+func redirLocal(ctx context.Context, addr, server string, shadow func(net.Conn) net.Conn) {
 	logf("TCP redirect not supported")
 }
 
-func redir6Local(addr, server string, shadow func(net.Conn) net.Conn) {
+func redir6Local(ctx context.Context, addr, server string, shadow func(net.Conn) net.Conn) {
 	logf("TCP6 redirect not supported")
 }
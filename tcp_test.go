@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// acceptConns connects n clients to a listener of s and returns the
+// accepted connections along with the clients.
+func acceptConns(t *testing.T, s *connSet, n int) (accepted, clients []net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sl := s.listener(l)
+	for i := 0; i < n; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := sl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted, clients = append(accepted, a), append(clients, c)
+	}
+	return accepted, clients
+}
+
+func TestConnSetDrain(t *testing.T) {
+	s := newConnSet()
+	accepted, clients := acceptConns(t, s, 3)
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	accepted[0].Close() // ended before the shutdown, not counted
+	if n := s.len(); n != 2 {
+		t.Fatalf("%d connections tracked, want 2", n)
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { accepted[1].Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	drained, killed := s.drain(ctx)
+	if drained != 1 || killed != 1 {
+		t.Errorf("drain() = %d drained, %d killed, want 1, 1", drained, killed)
+	}
+	clients[2].SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(clients[2]); err != nil {
+		t.Errorf("the connection left was not closed: %v", err)
+	}
+	if n := s.len(); n != 0 {
+		t.Errorf("%d connections tracked after drain, want 0", n)
+	}
+}
+
+func TestConnSetDrainAll(t *testing.T) {
+	s := newConnSet()
+	accepted, clients := acceptConns(t, s, 2)
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	for _, c := range accepted {
+		c := c
+		time.AfterFunc(20*time.Millisecond, func() { c.Close() })
+	}
+	drained, killed := s.drain(context.Background())
+	if drained != 2 || killed != 0 {
+		t.Errorf("drain() = %d drained, %d killed, want 2, 0", drained, killed)
+	}
+	if drained, killed := newConnSet().drain(context.Background()); drained != 0 || killed != 0 {
+		t.Errorf("drain() of no connections = %d, %d", drained, killed)
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"time"
 
 	"sync"
+	"sync/atomic"
 
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
@@ -20,8 +23,9 @@ const (
 
 const udpBufSize = 64 * 1024
 
-// Listen on laddr for UDP packets, encrypt and send to server to reach target.
-func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.PacketConn) {
+// Listen on laddr for UDP packets, encrypt and send to server to reach target,
+// until ctx is done.
+func udpLocal(ctx context.Context, laddr, server, target string, shadow func(net.PacketConn) net.PacketConn) {
 	srvAddr, err := net.ResolveUDPAddr("udp", server)
 	if err != nil {
 		logf("UDP server address error: %v", err)
@@ -41,8 +45,10 @@ func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.Pack
 		return
 	}
 	defer c.Close()
+	closeWhenDone(ctx, c)
 
 	nm := newNATmap(config.UDPTimeout)
+	m := metrics.client(server)
 	buf := make([]byte, udpBufSize)
 	copy(buf, tgt)
 
@@ -50,6 +56,9 @@ func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.Pack
 	for {
 		n, raddr, err := c.ReadFrom(buf[len(tgt):])
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && !ne.Temporary() {
+				return // closed
+			}
 			logf("UDP local read error: %v", err)
 			continue
 		}
@@ -62,7 +71,7 @@ func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.Pack
 				continue
 			}
 
-			pc = shadow(pc)
+			pc = shadow(m.packetConn(pc))
 			nm.Add(raddr, c, pc, relayClient)
 		}
 
@@ -74,8 +83,10 @@ func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.Pack
 	}
 }
 
-// Listen on laddr for Socks5 UDP packets, encrypt and send to server to reach target.
-func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketConn) {
+// Listen on laddr for Socks5 UDP packets, encrypt and send to server to reach target,
+// until ctx is done. Packets from clients not in udpClients are dropped if
+// udpClients is not nil.
+func udpSocksLocal(ctx context.Context, laddr, server string, shadow func(net.PacketConn) net.PacketConn, udpClients *socks.UDPClients) {
 	srvAddr, err := net.ResolveUDPAddr("udp", server)
 	if err != nil {
 		logf("UDP server address error: %v", err)
@@ -88,16 +99,34 @@ func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketC
 		return
 	}
 	defer c.Close()
+	closeWhenDone(ctx, c)
 
 	nm := newNATmap(config.UDPTimeout)
+	m := metrics.client(server)
+	frags := socks.NewUDPReassembler()
 	buf := make([]byte, udpBufSize)
 
 	for {
 		n, raddr, err := c.ReadFrom(buf)
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && !ne.Temporary() {
+				return // closed
+			}
 			logf("UDP local read error: %v", err)
 			continue
 		}
+		if udpClients != nil && !udpClients.Allowed(raddr) {
+			logf("UDP socks packet from %s without UDP ASSOCIATE, dropped", raddr)
+			continue
+		}
+		pkt, err := frags.Add(raddr, buf[:n])
+		if err != nil {
+			logf("UDP socks packet from %s dropped: %v", raddr, err)
+			continue
+		}
+		if pkt == nil {
+			continue // more fragments to come
+		}
 
 		pc := nm.Get(raddr.String())
 		if pc == nil {
@@ -106,12 +135,12 @@ func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketC
 				logf("UDP local listen error: %v", err)
 				continue
 			}
-			logf("UDP socks tunnel %s <-> %s <-> %s", laddr, server, socks.Addr(buf[3:]))
-			pc = shadow(pc)
+			logf("UDP socks tunnel %s <-> %s <-> %s", laddr, server, socks.SplitAddr(pkt))
+			pc = shadow(m.packetConn(pc))
 			nm.Add(raddr, c, pc, socksClient)
 		}
 
-		_, err = pc.WriteTo(buf[3:n], srvAddr)
+		_, err = pc.WriteTo(pkt, srvAddr)
 		if err != nil {
 			logf("UDP local write error: %v", err)
 			continue
@@ -119,55 +148,78 @@ func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketC
 	}
 }
 
-// Listen on addr for encrypted packets and basically do UDP NAT.
-func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
-	c, err := net.ListenPacket("udp", addr)
+// Listen on addr for encrypted packets of users and basically do UDP NAT
+// with sockets from out, until ctx is done.
+func udpRemote(ctx context.Context, addr string, users *userTable, out outbound) {
+	lc, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		logf("UDP remote listen error: %v", err)
 		return
 	}
-	defer c.Close()
-	c = shadow(c)
+	defer lc.Close()
+	closeWhenDone(ctx, lc)
+
+	logf("listening UDP on %s", addr)
+	udpServe(users.PacketConn(lc), 0, out)
+}
 
+// udpServe relays the packets read from c until c is closed, closing then
+// the NAT entries which could no longer send replies. Each packet starts
+// with skip bytes to ignore, then the target address.
+func udpServe(c *userPacketConn, skip int, out outbound) {
 	nm := newNATmap(config.UDPTimeout)
+	nm.expired = c.Forget
+	defer nm.closeAll()
 	buf := make([]byte, udpBufSize)
 
-	logf("listening UDP on %s", addr)
 	for {
-		n, raddr, err := c.ReadFrom(buf)
+		n, raddr, t, err := c.readFrom(buf)
 		if err != nil {
+			if ne, ok := err.(net.Error); err == io.EOF || ok && !ne.Temporary() {
+				return // closed
+			}
 			logf("UDP remote read error: %v", err)
 			continue
 		}
+		u := t.user // not looked up by raddr, forgotten as its NAT entry expires
+		if !u.allowUp(n) {
+			continue // beyond the rate limit
+		}
+		if n < skip {
+			u.logf("packet too short: %q", buf[:n])
+			continue
+		}
 
-		tgtAddr := socks.SplitAddr(buf[:n])
+		tgtAddr := socks.SplitAddr(buf[skip:n])
 		if tgtAddr == nil {
-			logf("failed to split target address from packet: %q", buf[:n])
+			u.logf("failed to split target address from packet: %q", buf[:n])
 			continue
 		}
 
 		tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr.String())
 		if err != nil {
-			logf("failed to resolve target UDP address: %v", err)
+			u.logf("failed to resolve target UDP address: %v", err)
 			continue
 		}
 
-		payload := buf[len(tgtAddr):n]
+		payload := buf[skip+len(tgtAddr) : n]
 
 		pc := nm.Get(raddr.String())
 		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
+			pc, err = out.ListenPacket("udp", "")
 			if err != nil {
-				logf("UDP remote listen error: %v", err)
+				u.logf("UDP remote listen error: %v", err)
 				continue
 			}
+			atomic.AddInt64(&u.udp, 1)
+			pc = &meteredPacketConn{PacketConn: pc, active: &u.udp}
 
-			nm.Add(raddr, c, pc, remoteServer)
+			nm.Add(raddr, c.replies(t), pc, remoteServer)
 		}
 
 		_, err = pc.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
 		if err != nil {
-			logf("UDP remote write error: %v", err)
+			u.logf("UDP remote write error: %v", err)
 			continue
 		}
 	}
@@ -178,6 +230,7 @@ type natmap struct {
 	sync.RWMutex
 	m       map[string]net.PacketConn
 	timeout time.Duration
+	expired func(peer net.Addr) // called after the entry of peer timed out, if set
 }
 
 func newNATmap(timeout time.Duration) *natmap {
@@ -212,6 +265,16 @@ func (m *natmap) Del(key string) net.PacketConn {
 	return nil
 }
 
+// closeAll closes all entries.
+func (m *natmap) closeAll() {
+	m.Lock()
+	defer m.Unlock()
+	for k, pc := range m.m {
+		pc.Close()
+		delete(m.m, k)
+	}
+}
+
 func (m *natmap) Add(peer net.Addr, dst, src net.PacketConn, role mode) {
 	m.Set(peer.String(), src)
 
@@ -220,6 +283,9 @@ func (m *natmap) Add(peer net.Addr, dst, src net.PacketConn, role mode) {
 		if pc := m.Del(peer.String()); pc != nil {
 			pc.Close()
 		}
+		if m.expired != nil {
+			m.expired(peer)
+		}
 	}()
 }
 
@@ -243,7 +309,7 @@ func timedCopy(dst net.PacketConn, target net.Addr, src net.PacketConn, timeout
 		case relayClient: // client -> user: strip original packet source
 			srcAddr := socks.SplitAddr(buf[:n])
 			_, err = dst.WriteTo(buf[len(srcAddr):n], target)
-		case socksClient: // client -> socks5 program: just set RSV and FRAG = 0
+		case socksClient: // client -> socks5 program: just set RSV and FRAG = 0, replies are never fragmented
 			_, err = dst.WriteTo(append([]byte{0, 0, 0}, buf[:n]...), target)
 		}
 
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// udpSink counts the UDP packets it receives until closed.
+func udpSink(t *testing.T, n *int64) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := pc.ReadFrom(buf); err != nil {
+				return
+			}
+			atomic.AddInt64(n, 1)
+		}
+	}()
+	return pc
+}
+
+// serveUDP serves UDP with the users of passwords until the returned
+// connection is closed.
+func serveUDP(t *testing.T, passwords ...string) *userPacketConn {
+	var users []*user
+	for _, pw := range passwords {
+		uc := testUser(pw, pw)
+		u, err := uc.newUser()
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, u)
+	}
+	ut, err := newUserTable(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upc := ut.PacketConn(pc)
+	go udpServe(upc, 0, direct{})
+	return upc
+}
+
+func TestUDPServeNATExpiry(t *testing.T) {
+	defer func(d time.Duration) { config.UDPTimeout = d }(config.UDPTimeout)
+	config.UDPTimeout = time.Millisecond // entries expire between the packets from their address
+	var received int64
+	sink := udpSink(t, &received)
+	defer sink.Close()
+
+	upc := serveUDP(t, "a", "b") // keys to identify, so addresses are remembered
+	defer upc.Close()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	cpc := testCipher(t, "b").PacketConn(client)
+	pkt := append(socks.ParseAddr(sink.LocalAddr().String()), "hello"...)
+	const sent = 5000
+	for i := 0; i < sent; i++ {
+		if _, err := cpc.WriteTo(pkt, upc.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if i%100 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt64(&received) < sent/2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d packets of %d relayed", atomic.LoadInt64(&received), sent)
+		}
+	}
+}
+
+func TestUDPServeForgottenAddress(t *testing.T) {
+	defer func(d time.Duration) { config.UDPTimeout = d }(config.UDPTimeout)
+	config.UDPTimeout = time.Minute
+	const delay = 100 * time.Millisecond
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() { // echoes packets late
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			time.Sleep(delay)
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	upc := serveUDP(t, "a", "b")
+	defer upc.Close()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	cpc := testCipher(t, "b").PacketConn(client)
+	if _, err := cpc.WriteTo(append(socks.ParseAddr(echo.LocalAddr().String()), "hello"...), upc.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(delay / 2)
+	// The expiry of a previous entry of the address, after the packet
+	// opened a new one.
+	upc.Forget(client.LocalAddr())
+	buf := make([]byte, 2048)
+	n, _, err := cpc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no reply once the address was forgotten: %v", err)
+	}
+	if tgt := socks.SplitAddr(buf[:n]); string(buf[len(tgt):n]) != "hello" {
+		t.Errorf("got reply %q", buf[:n])
+	}
+}
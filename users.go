@@ -0,0 +1,621 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/freconn"
+)
+
+// errUnknownUser means no user's key authenticates a stream or packet.
+var errUnknownUser = errors.New("unknown user")
+
+// A user of the server. A single-user server has one user without name.
+type user struct {
+	rx    uint64 // bytes received from the user, first for 64-bit alignment
+	tx    uint64 // bytes sent to the user
+	fails uint64 // streams and packets of the user failing to decrypt
+	conns int64  // active TCP connections
+	udp   int64  // active UDP NAT entries
+
+	Name      string
+	MaxConns  int           // maximum concurrent TCP connections, 0 for unlimited
+	keys      []*userKey    // primary first, then the retiring keys, guarded by the table of u
+	limit     rateLimit     // of all the traffic of the user
+	connLimit connRateLimit // of each TCP connection
+}
+
+// userKey is a key a user authenticates with: the primary key, or one still
+// accepted until it expires while clients move to the primary key.
+type userKey struct {
+	streams uint64 // TCP connections authenticated, first for 64-bit alignment
+	*user
+	cipher  core.Cipher
+	name    string
+	expires time.Time         // zero for the primary key
+	cfg     retiringKeyConfig // as configured, with the cipher of the user by default
+}
+
+// sameKey reports whether k and o are configured alike, so that k can stand
+// for o across reloads.
+func (k *userKey) sameKey(o *userKey) bool {
+	a, b := k.cfg, o.cfg
+	return k.name == o.name && a.Cipher == b.Cipher && a.Key == b.Key && a.Password == b.Password &&
+		a.Expires.Equal(b.Expires)
+}
+
+// expired reports whether k is no longer accepted at now.
+func (k *userKey) expired(now time.Time) bool {
+	return !k.expires.IsZero() && now.After(k.expires)
+}
+
+// rateLimit limits the bandwidth to and from users, TCP and UDP together.
+type rateLimit struct {
+	down, up *freconn.Limiter
+}
+
+func newRateLimit(rc rateConfig) rateLimit {
+	return rateLimit{freconn.NewLimiter(rc.Download, rc.Burst), freconn.NewLimiter(rc.Upload, rc.Burst)}
+}
+
+// set changes the rates while in use.
+func (r rateLimit) set(rc rateConfig) {
+	r.down.SetRate(rc.Download, rc.Burst)
+	r.up.SetRate(rc.Upload, rc.Burst)
+}
+
+// connRateLimit limits the bandwidth of each TCP connection.
+type connRateLimit struct {
+	down, up *freconn.ConnLimiter
+}
+
+func newConnRateLimit(rc rateConfig) connRateLimit {
+	return connRateLimit{freconn.NewConnLimiter(rc.Download, rc.Burst), freconn.NewConnLimiter(rc.Upload, rc.Burst)}
+}
+
+// set changes the rates of all connections.
+func (r connRateLimit) set(rc rateConfig) {
+	r.down.SetRate(rc.Download, rc.Burst)
+	r.up.SetRate(rc.Upload, rc.Burst)
+}
+
+// globalLimit limits the traffic of all users.
+var globalLimit = newRateLimit(rateConfig{})
+
+// allowUp reports whether a packet of n bytes from u is within the limits.
+func (u *user) allowUp(n int) bool {
+	return freconn.Limiters{globalLimit.up, u.limit.up}.Allow(int64(n) * 8)
+}
+
+// allowDown reports whether a packet of n bytes to u is within the limits.
+func (u *user) allowDown(n int) bool {
+	return freconn.Limiters{globalLimit.down, u.limit.down}.Allow(int64(n) * 8)
+}
+
+func (u *user) logf(f string, v ...interface{}) {
+	if config.Verbose {
+		if u != nil && u.Name != "" {
+			f = "[" + u.Name + "] " + f
+		}
+		logger.Output(2, fmt.Sprintf(f, v...))
+	}
+}
+
+// acquire counts a new TCP connection of u. Returns false if u has too many.
+func (u *user) acquire() bool {
+	if n := atomic.AddInt64(&u.conns, 1); u.MaxConns > 0 && n > int64(u.MaxConns) {
+		atomic.AddInt64(&u.conns, -1)
+		return false
+	}
+	return true
+}
+
+func (u *user) release() { atomic.AddInt64(&u.conns, -1) }
+
+// Traffic returns the number of bytes received from and sent to u.
+func (u *user) Traffic() (rx, tx uint64) {
+	return atomic.LoadUint64(&u.rx), atomic.LoadUint64(&u.tx)
+}
+
+// userConfig describes a user in a users file.
+type userConfig struct {
+	Name         string              `json:"name" yaml:"name"`
+	Cipher       string              `json:"cipher" yaml:"cipher"`
+	Key          string              `json:"key" yaml:"key"` // base64url-encoded, derived from password if empty
+	Password     string              `json:"password" yaml:"password"`
+	RetiringKeys []retiringKeyConfig `json:"retiring_keys" yaml:"retiring_keys"` // tried after the key above
+	MaxConns     int                 `json:"max_conns" yaml:"max_conns"`
+
+	limitConfig `yaml:",inline"`
+}
+
+// retiringKeyConfig is a former key of a user accepted until Expires. Cipher
+// defaults to the cipher of the user.
+type retiringKeyConfig struct {
+	Name     string    `json:"name" yaml:"name"` // reported with connections, retiring-1 and so on if empty
+	Cipher   string    `json:"cipher" yaml:"cipher"`
+	Key      string    `json:"key" yaml:"key"`
+	Password string    `json:"password" yaml:"password"`
+	Expires  time.Time `json:"expires" yaml:"expires"` // RFC 3339
+}
+
+func (uc *userConfig) newUser() (*user, error) {
+	ciph, err := (&cipherConfig{uc.Cipher, uc.Key, uc.Password}).pick()
+	if err != nil {
+		return nil, err
+	}
+	u := &user{Name: uc.Name, MaxConns: uc.MaxConns,
+		limit: newRateLimit(uc.RateLimit), connLimit: newConnRateLimit(uc.ConnRateLimit)}
+	u.keys = []*userKey{{user: u, cipher: ciph, name: "primary",
+		cfg: retiringKeyConfig{Cipher: uc.Cipher, Key: uc.Key, Password: uc.Password}}}
+	for i, rk := range uc.RetiringKeys {
+		cc := cipherConfig{rk.Cipher, rk.Key, rk.Password}
+		if cc.Cipher == "" {
+			cc.Cipher = uc.Cipher
+		}
+		ciph, err := cc.pick()
+		if err != nil {
+			return nil, fmt.Errorf("retiring key %d: %v", i+1, err)
+		}
+		if rk.Expires.IsZero() {
+			return nil, fmt.Errorf("retiring key %d: missing expires", i+1)
+		}
+		name := rk.Name
+		if name == "" {
+			name = fmt.Sprintf("retiring-%d", i+1)
+		}
+		for _, k := range u.keys {
+			if k.name == name {
+				return nil, fmt.Errorf("retiring key %d: name %q is not unique", i+1, name)
+			}
+		}
+		rk.Cipher = cc.Cipher
+		u.keys = append(u.keys, &userKey{user: u, cipher: ciph, name: name, expires: rk.Expires, cfg: rk})
+	}
+	return u, nil
+}
+
+// loadUsers reads a JSON array of users from path.
+func loadUsers(path string) ([]userConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ucs []userConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&ucs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return ucs, nil
+}
+
+// userTable identifies the user of a stream or packet by trying the keys of
+// every user in turn. The users can be replaced while in use.
+type userTable struct {
+	unknownStreams uint64 // atomic, first for 64-bit alignment
+	unknownPackets uint64
+
+	sync.RWMutex
+	users []*user
+	keys  []*userKey // of all users in order
+	sizes []int      // distinct stream header sizes of keys in increasing order
+	gen   int        // incremented whenever the users are replaced
+}
+
+func newUserTable(users []*user) (*userTable, error) {
+	t := &userTable{}
+	if err := t.set(users, nil); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// set replaces the users of t, and the keys of users in rekeyed. Streams
+// already identified keep their user, while packets are identified with the
+// new users and keys from now on.
+func (t *userTable) set(users []*user, rekeyed map[*user][]*userKey) error {
+	if len(users) == 0 {
+		return errors.New("no users")
+	}
+	var keys []*userKey
+	names := make(map[string]bool)
+	for _, u := range users {
+		if len(users) > 1 && (u.Name == "" || names[u.Name]) {
+			return fmt.Errorf("user name %q is empty or not unique", u.Name)
+		}
+		names[u.Name] = true
+		if uk, ok := rekeyed[u]; ok {
+			keys = append(keys, uk...)
+		} else {
+			keys = append(keys, u.keys...)
+		}
+	}
+	sizes, err := headerSizes(keys)
+	if err != nil {
+		return err
+	}
+	t.Lock()
+	for u, uk := range rekeyed {
+		u.keys = uk
+	}
+	t.users, t.keys, t.sizes = users, keys, sizes
+	t.gen++
+	t.Unlock()
+	return nil
+}
+
+// headerSizes returns the distinct stream header sizes of keys in increasing
+// order, none for a single key which needs no identification.
+func headerSizes(keys []*userKey) ([]int, error) {
+	if len(keys) == 1 {
+		return nil, nil
+	}
+	var sizes []int
+	seen := make(map[int]bool)
+	for _, k := range keys {
+		tc, ok := k.cipher.(core.TrialCipher)
+		if !ok {
+			who := "key " + k.name
+			if k.Name != "" {
+				who = "user " + k.Name + " " + who
+			}
+			return nil, fmt.Errorf("%s: cipher cannot be told apart from others, use an AEAD cipher", who)
+		}
+		if n := tc.StreamHeaderSize(); !seen[n] {
+			seen[n] = true
+			sizes = append(sizes, n)
+		}
+	}
+	sort.Ints(sizes)
+	return sizes, nil
+}
+
+// list returns the users of t.
+func (t *userTable) list() []*user {
+	t.RLock()
+	defer t.RUnlock()
+	return t.users
+}
+
+// keysOf returns the keys of u, a user of t.
+func (t *userTable) keysOf(u *user) []*userKey {
+	t.RLock()
+	defer t.RUnlock()
+	return u.keys
+}
+
+// StreamConn identifies the key of c and returns c wrapped with its cipher.
+func (t *userTable) StreamConn(c net.Conn) (net.Conn, *userKey, error) {
+	t.RLock()
+	keys, sizes := t.keys, t.sizes
+	t.RUnlock()
+	sc, k, err := identify(c, keys, sizes)
+	if err != nil {
+		atomic.AddUint64(&t.unknownStreams, 1)
+	}
+	return sc, k, err
+}
+
+// handshakeTimeout is how long a stream may take to send the header
+// identifying its key.
+const handshakeTimeout = 30 * time.Second
+
+// identify returns c wrapped with the cipher of the first of keys that
+// authenticates it. sizes are the distinct stream header sizes of keys in
+// increasing order.
+func identify(c net.Conn, keys []*userKey, sizes []int) (net.Conn, *userKey, error) {
+	if len(keys) == 1 {
+		k := keys[0]
+		atomic.AddUint64(&k.streams, 1)
+		return core.ServerStreamConn(k.cipher, newUserConn(c, k.user)), k, nil
+	}
+
+	now := time.Now()
+	c.SetReadDeadline(now.Add(handshakeTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	hdr := make([]byte, sizes[len(sizes)-1])
+	have := 0
+	for _, size := range sizes { // read no more than needed by the keys tried so far
+		if _, err := io.ReadFull(c, hdr[have:size]); err != nil {
+			return nil, nil, err
+		}
+		have = size
+		for _, k := range keys {
+			tc := k.cipher.(core.TrialCipher)
+			if tc.StreamHeaderSize() == size && !k.expired(now) && tc.TryStream(hdr[:size]) {
+				atomic.AddUint64(&k.streams, 1)
+				pc := &prefixConn{Conn: c, prefix: hdr[:have]}
+				return core.ServerStreamConn(k.cipher, newUserConn(pc, k.user)), k, nil
+			}
+		}
+	}
+	return nil, nil, errUnknownUser
+}
+
+// userStreamConn returns c wrapped with the cipher of the key of u, a user
+// of t, that authenticates it.
+func (t *userTable) userStreamConn(c net.Conn, u *user) (net.Conn, *userKey, error) {
+	keys := t.keysOf(u)
+	sizes, err := headerSizes(keys) // checked by set
+	if err != nil {
+		return nil, nil, err
+	}
+	sc, k, err := identify(c, keys, sizes)
+	if err != nil {
+		atomic.AddUint64(&t.unknownStreams, 1)
+	}
+	return sc, k, err
+}
+
+// byName returns the user called name, or the only user whatever the name.
+func (t *userTable) byName(name string) *user {
+	users := t.list()
+	if len(users) == 1 {
+		return users[0]
+	}
+	for _, u := range users {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// PacketConn returns a PacketConn identifying the user of each packet read from c.
+func (t *userTable) PacketConn(c net.PacketConn) *userPacketConn {
+	return t.userPacketConn(c, nil)
+}
+
+// userPacketConn returns a PacketConn identifying the key of each packet read
+// from c among the keys of u, or of all users if u is nil.
+func (t *userTable) userPacketConn(c net.PacketConn, u *user) *userPacketConn {
+	upc := &userPacketConn{PacketConn: c, table: t, user: u, last: make(map[string]*userTrial)}
+	upc.refresh()
+	return upc
+}
+
+// prefixConn is a net.Conn returning prefix before reading from the embedded Conn.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// userConn counts and limits the traffic of a user.
+type userConn struct {
+	net.Conn
+	*user
+	down, up freconn.Limiters
+}
+
+func newUserConn(c net.Conn, u *user) *userConn {
+	return &userConn{Conn: c, user: u,
+		down: freconn.Limiters{globalLimit.down, u.limit.down, u.connLimit.down.Limiter()},
+		up:   freconn.Limiters{globalLimit.up, u.limit.up, u.connLimit.up.Limiter()},
+	}
+}
+
+func (c *userConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.rx, uint64(n))
+	c.up.Wait(int64(n) * 8)
+	return n, err
+}
+
+func (c *userConn) Write(b []byte) (int, error) {
+	c.down.Wait(int64(len(b)) * 8)
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.tx, uint64(n))
+	return n, err
+}
+
+// trialPacketConn hands a packet already read to the cipher of a user and
+// counts the traffic sent to the user.
+type trialPacketConn struct {
+	net.PacketConn
+	*user
+	pkt  []byte
+	addr net.Addr
+}
+
+func (c *trialPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	atomic.AddUint64(&c.tx, uint64(n))
+	return n, err
+}
+
+func (c *trialPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(b) < len(c.pkt) {
+		return 0, c.addr, io.ErrShortBuffer
+	}
+	return copy(b, c.pkt), c.addr, nil
+}
+
+type userTrial struct {
+	*userKey
+	pc     *trialPacketConn
+	shadow net.PacketConn
+}
+
+// userPacketConn decrypts packets with the key of the user who sent them and
+// encrypts packets with the key last used by the address they are sent to.
+type userPacketConn struct {
+	net.PacketConn
+	table *userTable
+	user  *user // whose keys alone are tried, nil for all users
+
+	sync.RWMutex
+	trials []*userTrial          // replaced by the reader only
+	gen    int                   // of the table the trials are from
+	last   map[string]*userTrial // of the last packet from an address, until forgotten
+}
+
+// refresh follows the users of the table once replaced, keeping the trials
+// of the keys still there. The addresses of the others keep their trial
+// until forgotten, so that sessions outlive the removal of their key.
+func (c *userPacketConn) refresh() {
+	c.table.RLock()
+	keys, gen := c.table.keys, c.table.gen
+	if c.user != nil {
+		keys = c.user.keys
+	}
+	c.table.RUnlock()
+	if c.trials != nil && gen == c.gen {
+		return
+	}
+	old := make(map[*userKey]*userTrial, len(c.trials))
+	for _, t := range c.trials {
+		old[t.userKey] = t
+	}
+	trials := make([]*userTrial, 0, len(keys))
+	for _, k := range keys {
+		t, ok := old[k]
+		if !ok {
+			tc := &trialPacketConn{PacketConn: c.PacketConn, user: k.user}
+			t = &userTrial{userKey: k, pc: tc, shadow: core.ServerPacketConn(k.cipher, tc)}
+		}
+		trials = append(trials, t)
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.trials, c.gen = trials, gen
+}
+
+func (c *userPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, _, err := c.readFrom(b)
+	return n, addr, err
+}
+
+// readFrom is like ReadFrom, also returning the trial of the key the packet
+// was decrypted with.
+func (c *userPacketConn) readFrom(b []byte) (int, net.Addr, *userTrial, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, nil, err
+	}
+	pkt := make([]byte, n)
+	copy(pkt, b)
+	c.refresh()
+
+	now := time.Now()
+	c.RLock()
+	last := c.last[addr.String()]
+	c.RUnlock()
+	try := func(t *userTrial) (int, error) {
+		if t.expired(now) {
+			return 0, errUnknownUser
+		}
+		t.pc.pkt, t.pc.addr = pkt, addr
+		n, _, err := t.shadow.ReadFrom(b)
+		t.pc.pkt = nil
+		if err == nil {
+			atomic.AddUint64(&t.rx, uint64(len(pkt)))
+		}
+		return n, err
+	}
+	if last != nil { // the trial of the last packet from addr goes first
+		if n, err = try(last); err == nil {
+			return n, addr, last, nil
+		}
+	}
+	for _, t := range c.trials {
+		if t == last {
+			continue
+		}
+		if n, err = try(t); err == nil {
+			c.Lock()
+			c.last[addr.String()] = t
+			c.Unlock()
+			return n, addr, t, nil
+		}
+	}
+	if len(c.trials) == 1 { // nothing to identify
+		atomic.AddUint64(&c.trials[0].fails, 1)
+		return 0, addr, nil, err
+	}
+	atomic.AddUint64(&c.table.unknownPackets, 1)
+	return 0, addr, nil, errUnknownUser
+}
+
+func (c *userPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.writeTo(b, addr, nil)
+}
+
+// writeTo sends b to addr with the key of the last packet from addr, or with
+// that of t if the address was forgotten.
+func (c *userPacketConn) writeTo(b []byte, addr net.Addr, t *userTrial) (int, error) {
+	if last := c.trial(addr); last != nil {
+		t = last
+	}
+	if t == nil {
+		return 0, errUnknownUser
+	}
+	if !t.allowDown(len(b)) {
+		return len(b), nil // dropped as by the network
+	}
+	return t.shadow.WriteTo(b, addr)
+}
+
+// replies returns a PacketConn sending the replies of the NAT entry opened
+// by a packet decrypted with t, with the key of t once c forgot the address.
+func (c *userPacketConn) replies(t *userTrial) net.PacketConn {
+	return &replyPacketConn{c, t}
+}
+
+type replyPacketConn struct {
+	*userPacketConn
+	trial *userTrial
+}
+
+func (c *replyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.writeTo(b, addr, c.trial)
+}
+
+// trial returns the trial of the last packet read from addr, or the only
+// one.
+func (c *userPacketConn) trial(addr net.Addr) *userTrial {
+	c.RLock()
+	defer c.RUnlock()
+	if t := c.last[addr.String()]; t != nil {
+		return t
+	}
+	if len(c.trials) == 1 {
+		return c.trials[0]
+	}
+	return nil
+}
+
+// key returns the key of the last packet read from addr.
+func (c *userPacketConn) key(addr net.Addr) *userKey {
+	if t := c.trial(addr); t != nil {
+		return t.userKey
+	}
+	return nil
+}
+
+// Forget drops the trial of addr once its NAT entry expires.
+func (c *userPacketConn) Forget(addr net.Addr) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.last, addr.String())
+}
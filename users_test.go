@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+)
+
+// retiringTable returns a table of a user whose primary key has password
+// "new", with the retiring keys "old", valid for an hour, and "gone",
+// expired.
+func retiringTable(t *testing.T) *userTable {
+	uc := userConfig{Name: "alice", Cipher: "AEAD_CHACHA20_POLY1305", Password: "new", RetiringKeys: []retiringKeyConfig{
+		{Name: "old", Password: "old", Expires: time.Now().Add(time.Hour)},
+		{Name: "gone", Password: "gone", Expires: time.Now().Add(-time.Second)},
+	}}
+	u, err := uc.newUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut, err := newUserTable([]*user{u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ut
+}
+
+func testCipher(t *testing.T, password string) core.Cipher {
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciph
+}
+
+func TestIdentifyRetiringKeys(t *testing.T) {
+	ut := retiringTable(t)
+	tests := []struct {
+		password string
+		key      string // "" for none
+	}{
+		{"new", "primary"},
+		{"old", "old"},
+		{"gone", ""},
+		{"other", ""},
+	}
+	for _, tt := range tests {
+		c, s := net.Pipe()
+		go func() {
+			ciph := testCipher(t, tt.password)
+			ciph.StreamConn(c).Write([]byte("hello"))
+		}()
+		sc, k, err := ut.StreamConn(s)
+		if tt.key == "" {
+			if err != errUnknownUser {
+				t.Errorf("password %s: got %v, want errUnknownUser", tt.password, err)
+			}
+			s.Close()
+			c.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("password %s: %v", tt.password, err)
+			s.Close()
+			c.Close()
+			continue
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("password %s: read %q, %v", tt.password, buf, err)
+		}
+		if k.name != tt.key {
+			t.Errorf("password %s: identified key %s, want %s", tt.password, k.name, tt.key)
+		}
+		if n := atomic.LoadUint64(&k.streams); n != 1 {
+			t.Errorf("key %s authenticated %d streams, want 1", k.name, n)
+		}
+		s.Close()
+		c.Close()
+	}
+	if n := atomic.LoadUint64(&ut.unknownStreams); n != 2 {
+		t.Errorf("%d unknown streams, want 2", n)
+	}
+}
+
+func TestUserPacketConnRetiringKeys(t *testing.T) {
+	ut := retiringTable(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	upc := ut.PacketConn(pc)
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// read sends a packet with password and returns the key it was
+	// identified with.
+	read := func(password string) (*userKey, error) {
+		if _, err := testCipher(t, password).PacketConn(client).WriteTo([]byte("hello"), pc.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 2048)
+		n, addr, err := upc.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		if string(buf[:n]) != "hello" {
+			t.Errorf("password %s: read %q", password, buf[:n])
+		}
+		return upc.key(addr), nil
+	}
+
+	if k, err := read("old"); err != nil || k.name != "old" {
+		t.Fatalf("packet with the retiring key: key %v, %v", k, err)
+	}
+	if _, err := read("gone"); err != errUnknownUser {
+		t.Errorf("packet with the expired key: got %v, want errUnknownUser", err)
+	}
+
+	// The key of the last packet from an address is tried first, and
+	// checked for expiry all the same.
+	k, _ := read("old")
+	k.expires = time.Now().Add(-time.Second)
+	if _, err := read("old"); err != errUnknownUser {
+		t.Errorf("packet with a key expired since the last one: got %v, want errUnknownUser", err)
+	}
+	if k, err := read("new"); err != nil || k.name != "primary" {
+		t.Errorf("packet with the primary key: key %v, %v", k, err)
+	}
+	if n := atomic.LoadUint64(&ut.unknownPackets); n != 2 {
+		t.Errorf("%d unknown packets, want 2", n)
+	}
+}
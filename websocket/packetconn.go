@@ -2,6 +2,7 @@ package websocket
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
@@ -71,6 +72,14 @@ func (ws *WSPacketConn) SetWSTimeout(timeout time.Duration) {
 	}
 }
 
+// SetTLSConfig sets the TLS configuration used to dial wss:// addresses.
+func (ws *WSPacketConn) SetTLSConfig(cfg *tls.Config) {
+	if ws.dailer == nil {
+		ws.dailer = &websocket.Dialer{}
+	}
+	ws.dailer.TLSClientConfig = cfg
+}
+
 func (ws *WSPacketConn) HandleWSConn(conn *websocket.Conn, remoteAddr net.Addr) error {
 	_, exist := ws.wsConnMap.LoadOrStore(remoteAddr.String(), conn)
 	if exist {
@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// ErrPinMismatch means the certificate of a server matches none of the pinned keys.
+var ErrPinMismatch = errors.New("certificate does not match any pinned key")
+
+// TLSOptions configures the TLS of wss:// connections.
+type TLSOptions struct {
+	ServerName string // SNI and name to verify, the host of the URL if empty
+	RootCAs    []byte // PEM-encoded certificates trusted instead of the system roots
+	// PinnedSHA256 lists base64-encoded SHA-256 hashes of the SubjectPublicKeyInfo
+	// of certificates. If not empty, the certificate of the server must match one,
+	// in addition to passing verification unless Insecure is set.
+	PinnedSHA256 []string
+	Insecure     bool // skip verification of the certificate chain and name, for testing
+}
+
+// ClientConfig returns the tls.Config of a client with the options.
+func (o *TLSOptions) ClientConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.Insecure,
+	}
+	if len(o.RootCAs) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(o.RootCAs) {
+			return nil, errors.New("no certificates found in root CAs")
+		}
+		cfg.RootCAs = pool
+	}
+	if len(o.PinnedSHA256) > 0 {
+		var pins [][]byte
+		for _, p := range o.PinnedSHA256 {
+			b, err := base64.StdEncoding.DecodeString(p)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid pinned SHA-256 %q", p)
+			}
+			pins = append(pins, b)
+		}
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrPinMismatch
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0]) // the key of the leaf proven by the handshake
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+					return nil
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,139 @@
+package websocket
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testPKI struct {
+	caPEM   []byte
+	caPin   string // pin of the key of the CA
+	leafPin string // pin of the key of the server certificate
+	leaf    tls.Certificate
+}
+
+// newTestPKI generates a CA and a certificate it issues for ws.example.
+func newTestPKI(t *testing.T) *testPKI {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca, err = x509.ParseCertificate(caDER); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "ws.example"},
+		DNSNames:     []string{"ws.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf, err = x509.ParseCertificate(leafDER); err != nil {
+		t.Fatal(err)
+	}
+
+	pin := func(c *x509.Certificate) string {
+		sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	return &testPKI{
+		caPEM:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		caPin:   pin(ca),
+		leafPin: pin(leaf),
+		leaf:    tls.Certificate{Certificate: [][]byte{leafDER}, PrivateKey: key},
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	pki := newTestPKI(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{pki.leaf}}
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // failed handshakes are expected
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		opts TLSOptions
+		err  error // nil for any error if fail is set
+		fail bool
+	}{
+		{"system roots", TLSOptions{ServerName: "ws.example"}, nil, true},
+		{"custom root CA", TLSOptions{ServerName: "ws.example", RootCAs: pki.caPEM}, nil, false},
+		{"wrong name", TLSOptions{ServerName: "other.example", RootCAs: pki.caPEM}, nil, true},
+		{"pin match", TLSOptions{ServerName: "ws.example", RootCAs: pki.caPEM, PinnedSHA256: []string{pki.caPin, pki.leafPin}}, nil, false},
+		{"pin mismatch", TLSOptions{ServerName: "ws.example", RootCAs: pki.caPEM, PinnedSHA256: []string{pki.caPin}}, ErrPinMismatch, true},
+		{"insecure", TLSOptions{Insecure: true}, nil, false},
+		{"insecure pin match", TLSOptions{Insecure: true, PinnedSHA256: []string{pki.leafPin}}, nil, false},
+		{"insecure pin mismatch", TLSOptions{Insecure: true, PinnedSHA256: []string{pki.caPin}}, ErrPinMismatch, true},
+	}
+	for _, tt := range tests {
+		cfg, err := tt.opts.ClientConfig()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		c, err := tls.Dial("tcp", srv.Listener.Addr().String(), cfg)
+		if err == nil {
+			c.Close()
+		}
+		switch {
+		case tt.fail && err == nil:
+			t.Errorf("%s: handshake succeeded, want it to fail", tt.name)
+		case !tt.fail && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != nil && err != tt.err:
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestTLSOptionsInvalid(t *testing.T) {
+	for _, o := range []TLSOptions{
+		{RootCAs: []byte("not PEM")},
+		{PinnedSHA256: []string{"not base64"}},
+		{PinnedSHA256: []string{base64.StdEncoding.EncodeToString([]byte("too short"))}},
+	} {
+		if _, err := o.ClientConfig(); err == nil {
+			t.Errorf("%+v: ClientConfig succeeded, want an error", o)
+		}
+	}
+}
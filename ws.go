@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	ssw "github.com/shadowsocks/go-shadowsocks2/websocket"
+)
+
+// transipInfoSize is the size of the outbound ID clientlib puts before the
+// target address of every packet.
+const transipInfoSize = 4
+
+// wsServer accepts the WebSocket connections of clientlib.WSConnecter. The
+// Shadowsocks-Username header names the user, and Shadowsocks-Type tells a
+// stream ("connection") carried over the raw connection after the handshake
+// from packets ("packet") carried in binary messages.
+type wsServer struct {
+	ctx      context.Context // closing the packets of users once done
+	users    *userTable
+	out      outbound
+	upgrader websocket.Upgrader
+
+	sync.Mutex
+	packets map[*user]*ssw.WSPacketConn
+}
+
+// wsRemote listens on the ws:// or wss:// URL addr for WebSocket connections
+// of users, connecting to their targets through out, until ctx is done.
+// Connections to a wss:// URL are served with tlsConfig.
+func wsRemote(ctx context.Context, addr string, tlsConfig *tls.Config, users *userTable, out outbound) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		logf("invalid WebSocket URL %s: %v", addr, err)
+		return
+	}
+	s := &wsServer{
+		ctx:   ctx,
+		users: users,
+		out:   out,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(*http.Request) bool { return true }, // clients are not browsers
+		},
+		packets: make(map[*user]*ssw.WSPacketConn),
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, s)
+
+	l, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
+	closeWhenDone(ctx, l)
+	l = activeConns.listener(l)
+	if u.Scheme == "wss" {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	logf("listening WebSocket on %s", addr)
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       2 * time.Minute, // upgraded connections are not affected
+	}
+	if err := srv.Serve(l); err != nil && ctx.Err() == nil {
+		logf("failed to serve %s: %v", addr, err)
+	}
+}
+
+func (s *wsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u := s.users.byName(r.Header.Get("Shadowsocks-Username"))
+	if u == nil {
+		atomic.AddUint64(&s.users.unknownStreams, 1)
+		logf("unknown WebSocket user %q from %s", r.Header.Get("Shadowsocks-Username"), r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	typ := r.Header.Get("Shadowsocks-Type")
+	if typ != "connection" && typ != "packet" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	wc, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		u.logf("failed to upgrade %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	switch typ {
+	case "connection":
+		c := wc.UnderlyingConn()
+		defer c.Close()
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.SetKeepAlive(true)
+		}
+		sc, k, err := s.users.userStreamConn(c, u)
+		if err != nil {
+			u.logf("failed to identify the key of %s: %v", r.RemoteAddr, err)
+			return
+		}
+		serveStream(sc, k, s.out, nil)
+	case "packet":
+		if err := s.packetConn(u).HandleWSConn(wc, wc.RemoteAddr()); err != nil {
+			u.logf("failed to handle packets from %s: %v", r.RemoteAddr, err)
+		}
+	}
+}
+
+// packetConn returns the PacketConn of the packets of u, relaying them on
+// first use until s.ctx is done.
+func (s *wsServer) packetConn(u *user) *ssw.WSPacketConn {
+	s.Lock()
+	defer s.Unlock()
+	pc := s.packets[u]
+	if pc == nil {
+		pc = ssw.NewWSPacketConn(nil, "")
+		s.packets[u] = pc
+		closeWhenDone(s.ctx, pc)
+		go udpServe(s.users.userPacketConn(pc, u), transipInfoSize, s.out)
+	}
+	return pc
+}
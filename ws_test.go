@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	ssw "github.com/shadowsocks/go-shadowsocks2/websocket"
+)
+
+// wsPacketSession starts a WebSocket server of a single user until stop is
+// called, and relays a packet of the user to an echo server through it. The
+// server has returned once done is closed, and cleanup closes the client.
+func wsPacketSession(t *testing.T) (u *user, stop, cleanup func(), done <-chan struct{}) {
+	echo := udpEcho(t)
+	uc := userConfig{Name: "alice", Cipher: "AEAD_CHACHA20_POLY1305", Password: "secret"}
+	u, err := uc.newUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut, err := newUserTable([]*user{u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	served := make(chan struct{})
+	go func() {
+		wsRemote(ctx, "ws://"+addr+"/", nil, ut, direct{})
+		close(served)
+	}()
+	waitListening(t, addr)
+
+	ciph, err := core.PickCipher(uc.Cipher, nil, uc.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wspc := ssw.NewWSPacketConn(nil, "alice")
+	pc := ciph.PacketConn(wspc)
+	cleanup = func() {
+		stop()
+		wspc.Close()
+		echo.Close()
+	}
+	server := &ssw.WSAddr{URL: url.URL{Scheme: "ws", Host: addr, Path: "/"}}
+	tgt := socks.ParseAddr(echo.LocalAddr().String())
+	pkt := append(append(make([]byte, transipInfoSize), tgt...), "ping"...)
+	if _, err := pc.WriteTo(pkt, server); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	got := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 2048)
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			close(got)
+			return
+		}
+		got <- buf[:n]
+	}()
+	select {
+	case b := <-got:
+		if !bytes.HasSuffix(b, []byte("ping")) {
+			cleanup()
+			t.Fatalf("got %q back, want the echo", b)
+		}
+	case <-time.After(5 * time.Second):
+		cleanup()
+		t.Fatal("no echo through the WebSocket server")
+	}
+	if n := atomic.LoadInt64(&u.udp); n != 1 {
+		cleanup()
+		t.Fatalf("%d UDP sessions, want 1", n)
+	}
+	return u, stop, cleanup, served
+}
+
+func TestWSPacketsClosedWhenDone(t *testing.T) {
+	defer func(d time.Duration) { config.UDPTimeout = d }(config.UDPTimeout)
+	config.UDPTimeout = time.Minute
+	u, stop, cleanup, done := wsPacketSession(t)
+	defer cleanup()
+	stop()
+	<-done
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&u.udp) != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("UDP session still open after the server stopped")
+		}
+	}
+}
+
+func TestWSPacketsShutdown(t *testing.T) {
+	defer func(d time.Duration) { config.UDPTimeout = d }(config.UDPTimeout)
+	config.UDPTimeout = time.Minute
+	_, stop, cleanup, done := wsPacketSession(t)
+	defer cleanup()
+	if activeConns.len() == 0 {
+		t.Fatal("the connection carrying packets is not tracked for the shutdown")
+	}
+
+	// As on shutdown: the context is done, then connections are drained.
+	stop()
+	<-done
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, killed := activeConns.drain(ctx); killed != 0 {
+		t.Errorf("%d connections closed by the drain timeout, want the packet sessions closed on shutdown", killed)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("drained after %v", d)
+	}
+}